@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/AlexGustafsson/grapevine/internal/state"
+)
+
+// backupPassphrase returns the configured passphrase used to encrypt and
+// decrypt exported archives, if any.
+func backupPassphrase(config Config) (string, error) {
+	if config.BackupPassphrase != "" && config.BackupPassphraseFile != "" {
+		return "", fmt.Errorf("only one of a backup passphrase or backup passphrase file may be configured")
+	}
+
+	if config.BackupPassphraseFile != "" {
+		content, err := os.ReadFile(config.BackupPassphraseFile)
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+
+	return config.BackupPassphrase, nil
+}
+
+// exportState writes an archive of config.json and all state to a file, or to
+// stdout. The state is only read, so Grapevine may be running.
+func exportState(config Config, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	output := flags.String("o", "-", "file to write the archive to, or - for stdout")
+	flags.Parse(args)
+
+	passphrase, err := backupPassphrase(config)
+	if err != nil {
+		return err
+	}
+
+	backend, err := openBackendReadOnly(config, state.BackendKind(config.StorageBackend))
+	if err != nil {
+		return fmt.Errorf("failed to open storage backend: %w", err)
+	}
+	defer backend.Close()
+
+	if *output == "-" {
+		return state.Export(os.Stdout, config.BasePath, backend, state.ExportOptions{Passphrase: passphrase})
+	}
+
+	file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := state.Export(file, config.BasePath, backend, state.ExportOptions{Passphrase: passphrase}); err != nil {
+		file.Close()
+		os.Remove(*output)
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	slog.Info("Exported state", slog.String("path", *output), slog.Bool("encrypted", passphrase != ""))
+	return nil
+}
+
+// importState imports an archive written by exportState.
+func importState(config Config, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s import [-replace] <archive|->\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Grapevine must not be running. Use the internal API to import into a running instance.\n\n")
+		flags.PrintDefaults()
+	}
+	replace := flags.Bool("replace", false, "replace the existing state and config.json, rather than merging")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	passphrase, err := backupPassphrase(config)
+	if err != nil {
+		return err
+	}
+
+	options := state.ImportOptions{
+		Mode:       state.ImportMerge,
+		Passphrase: passphrase,
+	}
+
+	if *replace {
+		options.Mode = state.ImportReplace
+	}
+
+	var input io.Reader = os.Stdin
+	if path := flags.Arg(0); path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		input = file
+	}
+
+	backend, err := openBackend(config, state.BackendKind(config.StorageBackend))
+	if err != nil {
+		return fmt.Errorf("failed to open storage backend: %w", err)
+	}
+
+	if err := state.Import(input, config.BasePath, backend, options); err != nil {
+		backend.Close()
+		return err
+	}
+
+	return backend.Close()
+}
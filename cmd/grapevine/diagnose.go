@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/AlexGustafsson/grapevine/internal/state"
+	"github.com/AlexGustafsson/grapevine/internal/vapid"
+	"github.com/AlexGustafsson/grapevine/internal/webpush"
+)
+
+// defaultDiagnosticAudience is the push service checked for topics without
+// subscriptions. Apple's push service is the strictest about tokens.
+const defaultDiagnosticAudience = "https://web.push.apple.com"
+
+// diagnose verifies the VAPID tokens that would be sent for every topic, like
+// push services do. Unless audiences are specified, the tokens are verified
+// for the push services of the topic's subscriptions, using the keys they were
+// made with.
+func diagnose(config Config, args []string) error {
+	flags := flag.NewFlagSet("diagnose", flag.ExitOnError)
+	var audiences []string
+	flags.Func("audience", "origin of a push service to verify tokens for, instead of those of subscriptions (may be repeated)", func(value string) error {
+		u, err := url.Parse(value)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("must be an absolute https URL")
+		}
+
+		audience, _ := (&webpush.PushTarget{Endpoint: value}).Audience()
+		audiences = append(audiences, audience)
+		return nil
+	})
+	flags.Parse(args)
+
+	tokenCache, err := vapid.NewTokenCache(config.VAPIDTokenExpiry)
+	if err != nil {
+		return err
+	}
+
+	// NOTE: Diagnostics never change the state, so that they may be run while
+	// Grapevine is running
+	backend, err := openBackendReadOnly(config, state.BackendKind(config.StorageBackend))
+	if err != nil {
+		return fmt.Errorf("failed to open storage backend: %w", err)
+	}
+	defer backend.Close()
+
+	store, err := state.Load(config.BasePath, backend, state.Options{
+		PublicURL:      config.PublicURL,
+		VAPIDSubject:   config.VAPIDSubject,
+		TokenCache:     tokenCache,
+		KeyGracePeriod: config.KeyRotationGracePeriod,
+		ReadOnly:       true,
+	})
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, client := range store.Clients() {
+		fmt.Printf("Topic %s (key %s)\n", client.Topic(), client.KeyID())
+
+		// Audiences to check, by the id of the key used for them
+		checks := map[string][]string{client.KeyID(): audiences}
+		if len(audiences) == 0 {
+			checks, err = subscriptionAudiences(store, &client)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, keyID := range slices.Sorted(maps.Keys(checks)) {
+			for _, audience := range checks[keyID] {
+				if err := verifyAuthorization(&client, keyID, audience); err != nil {
+					fmt.Printf("  FAIL %s (key %s): %s\n", audience, keyID, err)
+					failed++
+				}
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+
+	return nil
+}
+
+// subscriptionAudiences returns the sorted push service origins of the
+// subscriptions of a topic, by the id of the key they were made with.
+func subscriptionAudiences(store *state.Store, client *state.Client) (map[string][]string, error) {
+	subscriptions, err := store.GetSubscriptions(client.Topic())
+	if err != nil {
+		return nil, err
+	}
+
+	checks := make(map[string][]string)
+	for _, subscription := range subscriptions {
+		keyID := subscription.KeyID
+		if keyID == "" {
+			keyID = client.KeyID()
+		}
+
+		// NOTE: Subscriptions are validated when added
+		audience, _ := (&webpush.PushTarget{Endpoint: subscription.Endpoint}).Audience()
+		if !slices.Contains(checks[keyID], audience) {
+			checks[keyID] = append(checks[keyID], audience)
+		}
+	}
+
+	if len(checks) == 0 {
+		checks[client.KeyID()] = []string{defaultDiagnosticAudience}
+	}
+
+	for _, audiences := range checks {
+		slices.Sort(audiences)
+	}
+
+	return checks, nil
+}
+
+// verifyAuthorization verifies the Authorization header of push messages sent
+// to audience using a topic's key, and prints the verified claims.
+func verifyAuthorization(client *state.Client, keyID string, audience string) error {
+	webPushClient, err := client.WebPushClientFor(keyID)
+	if err == state.ErrKeyRetired {
+		return fmt.Errorf("key was retired, subscriptions must re-subscribe")
+	} else if err != nil {
+		return err
+	}
+
+	header, err := webPushClient.AuthorizationHeader(audience)
+	if err != nil {
+		return err
+	}
+
+	// NOTE: The time is taken once the token is signed, as a token expiring at
+	// the maximum expiry would otherwise appear to expire too late
+	now := time.Now()
+
+	token, key, err := vapid.ParseAuthorizationHeader(header)
+	if err != nil {
+		return err
+	}
+
+	// NOTE: Keys are verified to be P-256 keys when parsed
+	publicKey, _ := key.Bytes()
+	if base64.RawURLEncoding.EncodeToString(publicKey) != webPushClient.PublicKeyString() {
+		return fmt.Errorf("key (k) of header doesn't match the topic's key")
+	}
+
+	claims, err := vapid.VerifyToken(token, key, audience, now)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("  ok   %s (key %s): subject %s, expires in %s\n", audience, keyID, claims.Subject, claims.Expires.Sub(now).Round(time.Second))
+	return nil
+}
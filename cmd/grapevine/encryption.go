@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/AlexGustafsson/grapevine/internal/envelope"
+	"github.com/AlexGustafsson/grapevine/internal/state"
+)
+
+// MasterKeyConfig configures a master key used to encrypt state at rest. At
+// most one of the options may be set.
+type MasterKeyConfig struct {
+	// Key is a base64 encoded 32 byte key.
+	Key string `env:"KEY"`
+	// KeyFile is the path to a file containing a base64 encoded 32 byte key.
+	KeyFile string `env:"KEY_FILE"`
+	// Passphrase is a passphrase to derive the key from.
+	Passphrase string `env:"PASSPHRASE"`
+	// PassphraseFile is the path to a file containing a passphrase to derive
+	// the key from.
+	PassphraseFile string `env:"PASSPHRASE_FILE"`
+}
+
+// masterKey returns the configured master key, or nil if none is configured.
+// Keys derived from passphrases are salted using a salt stored in basePath.
+func (c *MasterKeyConfig) masterKey(basePath string) (*envelope.Key, error) {
+	configured := 0
+	for _, value := range []string{c.Key, c.KeyFile, c.Passphrase, c.PassphraseFile} {
+		if value != "" {
+			configured++
+		}
+	}
+
+	if configured == 0 {
+		return nil, nil
+	} else if configured > 1 {
+		return nil, fmt.Errorf("only one of a key, key file, passphrase or passphrase file may be configured")
+	}
+
+	switch {
+	case c.Key != "":
+		return envelope.ParseKey(c.Key)
+	case c.KeyFile != "":
+		key, err := os.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return envelope.ParseKey(string(key))
+	}
+
+	passphrase := c.Passphrase
+	if c.PassphraseFile != "" {
+		content, err := os.ReadFile(c.PassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+
+		passphrase = strings.TrimRight(string(content), "\r\n")
+	}
+
+	salt, err := readOrCreateSalt(filepath.Join(basePath, "master-key.salt"))
+	if err != nil {
+		return nil, err
+	}
+
+	return envelope.DeriveKey(passphrase, salt)
+}
+
+// readOrCreateSalt reads the salt stored in path, creating it if it doesn't
+// exist.
+//
+// NOTE: The salt is not secret, but losing it makes state encrypted using a
+// passphrase unrecoverable.
+func readOrCreateSalt(path string) ([]byte, error) {
+	salt, err := os.ReadFile(path)
+	if err == nil {
+		return salt, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	salt = make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Write(salt); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return salt, file.Close()
+}
+
+// backendOptions returns the options for opening the configured backend.
+func backendOptions(config Config) (state.BackendOptions, error) {
+	primary, err := config.MasterKey.masterKey(config.BasePath)
+	if err != nil {
+		return state.BackendOptions{}, fmt.Errorf("invalid master key: %w", err)
+	}
+
+	previous, err := config.PreviousMasterKey.masterKey(config.BasePath)
+	if err != nil {
+		return state.BackendOptions{}, fmt.Errorf("invalid previous master key: %w", err)
+	}
+
+	if primary == nil {
+		if previous != nil {
+			return state.BackendOptions{}, fmt.Errorf("a previous master key is configured without a master key")
+		}
+
+		return state.BackendOptions{}, nil
+	}
+
+	return state.BackendOptions{
+		Keyring: envelope.NewKeyring(primary, previous),
+	}, nil
+}
+
+// openBackend opens the backend of the specified kind, configured by config.
+func openBackend(config Config, kind state.BackendKind) (state.Backend, error) {
+	options, err := backendOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return state.OpenBackend(kind, config.BasePath, options)
+}
+
+// openBackendReadOnly opens the backend of the specified kind, configured by
+// config, for reading only. Unlike [openBackend], it may be used while
+// Grapevine is running.
+func openBackendReadOnly(config Config, kind state.BackendKind) (state.Backend, error) {
+	options, err := backendOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
+	options.ReadOnly = true
+	return state.OpenBackend(kind, config.BasePath, options)
+}
@@ -1,19 +1,85 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io/fs"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"sync"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/AlexGustafsson/grapevine/internal/api"
+	"github.com/AlexGustafsson/grapevine/internal/listen"
+	"github.com/AlexGustafsson/grapevine/internal/queue"
 	"github.com/AlexGustafsson/grapevine/internal/state"
+	"github.com/AlexGustafsson/grapevine/internal/vapid"
 	"github.com/AlexGustafsson/grapevine/internal/web"
 	"github.com/caarlos0/env/v10"
 )
 
 type Config struct {
-	BasePath string `env:"BASE_PATH" envDefault:"./config"`
+	BasePath        string `env:"BASE_PATH" envDefault:"./config"`
+	PushConcurrency int    `env:"PUSH_CONCURRENCY" envDefault:"8"`
+	PublicURL       string `env:"PUBLIC_URL"`
+	// VAPIDSubject is the mailto: or https: URL push services can contact the
+	// operator through. It's required unless PUBLIC_URL is an https URL or all
+	// topics configure their own.
+	VAPIDSubject string `env:"VAPID_SUBJECT"`
+	// VAPIDTokenExpiry is the lifetime of VAPID tokens, which are reused for
+	// push messages to the same push service until half of it has passed. At
+	// most 24h.
+	VAPIDTokenExpiry time.Duration `env:"VAPID_TOKEN_EXPIRY" envDefault:"1h"`
+
+	// SubscriptionExpiryWarning is the time before a subscription expires that
+	// the PWA is told to renew it.
+	SubscriptionExpiryWarning time.Duration `env:"SUBSCRIPTION_EXPIRY_WARNING" envDefault:"168h"`
+	// KeyRotationGracePeriod is the time a rotated topic key remains valid for
+	// subscriptions made with it, unless specified when rotating. The stored
+	// key of a topic whose key is moved to a key provider is kept as long.
+	KeyRotationGracePeriod time.Duration `env:"KEY_ROTATION_GRACE_PERIOD" envDefault:"720h"`
+
+	// StorageBackend is the backend to store state in, either "json" or
+	// "sqlite".
+	StorageBackend string `env:"STORAGE_BACKEND" envDefault:"json"`
+	// ArchiveRetention is the time topics removed from config.json are kept
+	// archived before being purged by the purge-topics command.
+	ArchiveRetention time.Duration `env:"ARCHIVE_RETENTION" envDefault:"720h"`
+
+	// MasterKey, if configured, encrypts secrets, subscriptions and queued
+	// push messages at rest. Only supported by the json storage backend.
+	MasterKey MasterKeyConfig `envPrefix:"MASTER_"`
+	// PreviousMasterKey is the master key being rotated away from, if any.
+	// State encrypted using it is re-encrypted using MasterKey.
+	PreviousMasterKey MasterKeyConfig `envPrefix:"PREVIOUS_MASTER_"`
+
+	// BackupPassphrase, if configured, encrypts exported archives and decrypts
+	// imported archives.
+	BackupPassphrase     string `env:"BACKUP_PASSPHRASE"`
+	BackupPassphraseFile string `env:"BACKUP_PASSPHRASE_FILE"`
+
+	// PublicAddress is either a TCP address or a Unix domain socket path
+	// prefixed with "unix:".
+	PublicAddress     string `env:"PUBLIC_ADDRESS" envDefault:":8080"`
+	PublicSocketMode  string `env:"PUBLIC_SOCKET_MODE" envDefault:"0660"`
+	PublicTLSCertFile string `env:"PUBLIC_TLS_CERT_FILE"`
+	PublicTLSKeyFile  string `env:"PUBLIC_TLS_KEY_FILE"`
+
+	// InternalAddress is either a TCP address or a Unix domain socket path
+	// prefixed with "unix:".
+	InternalAddress     string `env:"INTERNAL_ADDRESS" envDefault:":8081"`
+	InternalSocketMode  string `env:"INTERNAL_SOCKET_MODE" envDefault:"0660"`
+	InternalTLSCertFile string `env:"INTERNAL_TLS_CERT_FILE"`
+	InternalTLSKeyFile  string `env:"INTERNAL_TLS_KEY_FILE"`
+
+	// ShutdownTimeout is the maximum time to wait for in-flight requests,
+	// deliveries and saves when shutting down.
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"30s"`
 }
 
 func main() {
@@ -23,21 +89,92 @@ func main() {
 		os.Exit(1)
 	}
 
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "migrate":
+			err = migrate(config, os.Args[2:])
+		case "purge-topics":
+			err = purgeTopics(config, os.Args[2:])
+		case "migrate-storage":
+			err = migrateStorage(config, os.Args[2:])
+		case "export":
+			err = exportState(config, os.Args[2:])
+		case "import":
+			err = importState(config, os.Args[2:])
+		case "signer":
+			err = runSigner(config, os.Args[2:])
+		case "diagnose":
+			err = diagnose(config, os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command %q", os.Args[1])
+		}
+
+		if err != nil {
+			slog.Error("Command failed", slog.Any("error", err))
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	storageOptions, err := backendOptions(config)
+	if err != nil {
+		slog.Error("Failed to open storage backend", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	slog.Info("Opening storage backend", slog.String("backend", config.StorageBackend))
+	backend, err := state.OpenBackend(state.BackendKind(config.StorageBackend), config.BasePath, storageOptions)
+	if err != nil {
+		slog.Error("Failed to open storage backend", slog.Any("error", err))
+		os.Exit(1)
+	}
+
 	slog.Info("Migrating state store")
-	if err := state.Migrate(config.BasePath); err != nil {
+	if err := state.Migrate(config.BasePath, backend); err != nil {
 		slog.Error("Failed to migrate state store", slog.Any("error", err))
 		os.Exit(1)
 	}
 
+	tokenCache, err := vapid.NewTokenCache(config.VAPIDTokenExpiry)
+	if err != nil {
+		slog.Error("Failed to parse VAPID token expiry", slog.Any("error", err))
+		os.Exit(1)
+	}
+
 	slog.Info("Loading state store")
-	store, err := state.Load(config.BasePath)
+	store, err := state.Load(config.BasePath, backend, state.Options{
+		PublicURL:      config.PublicURL,
+		VAPIDSubject:   config.VAPIDSubject,
+		TokenCache:     tokenCache,
+		KeyGracePeriod: config.KeyRotationGracePeriod,
+	})
 	if err != nil {
 		slog.Error("Failed to load state store", slog.Any("error", err))
 		os.Exit(1)
 	}
 
+	slog.Info("Loading delivery queue")
+	deliveryQueue, err := queue.Open(filepath.Join(config.BasePath, "queue"), storageOptions.Keyring)
+	if err != nil {
+		slog.Error("Failed to load delivery queue", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	passphrase, err := backupPassphrase(config)
+	if err != nil {
+		slog.Error("Failed to read backup passphrase", slog.Any("error", err))
+		os.Exit(1)
+	}
+
 	webPushAPI := &api.WebPushAPI{
-		Store: store,
+		Store:            store,
+		Queue:            deliveryQueue,
+		Concurrency:      config.PushConcurrency,
+		ExpiryWarning:    config.SubscriptionExpiryWarning,
+		BackupPassphrase: passphrase,
+		KeyGracePeriod:   config.KeyRotationGracePeriod,
 	}
 
 	publicMux := http.NewServeMux()
@@ -45,44 +182,198 @@ func main() {
 	publicMux.Handle("/", web.NewServer(store))
 
 	publicServer := &http.Server{
-		Addr:    ":8080",
 		Handler: publicMux,
 	}
 
+	if err := configureTLS(publicServer, config.PublicTLSCertFile, config.PublicTLSKeyFile); err != nil {
+		slog.Error("Failed to configure TLS for public endpoint", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	publicSocketMode, err := strconv.ParseUint(config.PublicSocketMode, 8, 32)
+	if err != nil {
+		slog.Error("Failed to parse public socket mode", slog.Any("error", err))
+		os.Exit(1)
+	}
+
 	internalMux := http.NewServeMux()
 	internalMux.Handle("/api/v1/", api.NewPrivateServer(webPushAPI))
 
 	internalServer := &http.Server{
-		Addr:    ":8081",
 		Handler: internalMux,
 	}
 
-	var wg sync.WaitGroup
-	failed := false
+	if err := configureTLS(internalServer, config.InternalTLSCertFile, config.InternalTLSKeyFile); err != nil {
+		slog.Error("Failed to configure TLS for internal endpoint", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	internalSocketMode, err := strconv.ParseUint(config.InternalSocketMode, 8, 32)
+	if err != nil {
+		slog.Error("Failed to parse internal socket mode", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	// NOTE: Listen only once everything else is configured, so that failing to
+	// start never leaves a listener, such as a Unix socket file, behind
+	publicListener, err := listen.Listen(config.PublicAddress, fs.FileMode(publicSocketMode))
+	if err != nil {
+		slog.Error("Failed to listen on public address", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	internalListener, err := listen.Listen(config.InternalAddress, fs.FileMode(internalSocketMode))
+	if err != nil {
+		publicListener.Close()
+		slog.Error("Failed to listen on internal address", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Reload config.json on SIGHUP. It's also reloaded when changed
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	go func() {
+		for range reload {
+			slog.Info("Received SIGHUP, reloading config.json")
+			if err := store.Reload(); err != nil {
+				slog.Error("Failed to reload config.json, keeping the current config", slog.Any("error", err))
+			}
+		}
+	}()
+
+	storeCtx, cancelStore := context.WithCancel(context.Background())
+	defer cancelStore()
+
+	storeDone := make(chan error, 1)
+	go func() {
+		storeDone <- store.Run(storeCtx)
+	}()
 
-	// TODO: Error handling, cancellation
-	wg.Go(func() {
-		err := publicServer.ListenAndServe()
+	queueCtx, cancelQueue := context.WithCancel(context.Background())
+	defer cancelQueue()
+
+	queueDone := make(chan struct{})
+	go func() {
+		deliveryQueue.Run(queueCtx, webPushAPI.Deliver)
+		close(queueDone)
+	}()
+
+	serveErrors := make(chan error, 2)
+
+	go func() {
+		slog.Info("Serving public endpoint", slog.String("address", config.PublicAddress))
+		err := serve(publicServer, publicListener)
 		if err != nil && err != http.ErrServerClosed {
-			slog.Error("Failed to serve public endpoint", slog.Any("error", err))
-			// Close the other server
-			internalServer.Close()
-			failed = true
+			serveErrors <- fmt.Errorf("failed to serve public endpoint: %w", err)
 		}
-	})
+	}()
 
-	wg.Go(func() {
-		err := internalServer.ListenAndServe()
+	go func() {
+		slog.Info("Serving internal endpoint", slog.String("address", config.InternalAddress))
+		err := serve(internalServer, internalListener)
 		if err != nil && err != http.ErrServerClosed {
-			slog.Error("Failed to serve internal endpoint", slog.Any("error", err))
-			// Close the other server
-			publicServer.Close()
+			serveErrors <- fmt.Errorf("failed to serve internal endpoint: %w", err)
+		}
+	}()
+
+	failed := false
+	select {
+	case <-ctx.Done():
+		slog.Info("Received signal, shutting down", slog.Duration("timeout", config.ShutdownTimeout))
+	case err := <-serveErrors:
+		slog.Error("Failed to serve, shutting down", slog.Any("error", err))
+		failed = true
+	}
+
+	// Restore default signal handling, allowing a second signal to terminate
+	// immediately
+	stop()
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancelShutdown()
+
+	// Stop accepting requests and wait for in-flight requests, including
+	// pushes, to complete
+	shutdownErrors := make(chan error, 2)
+	for _, server := range []*http.Server{publicServer, internalServer} {
+		go func() {
+			err := server.Shutdown(shutdownCtx)
+			if err != nil {
+				server.Close()
+			}
+			shutdownErrors <- err
+		}()
+	}
+
+	for range 2 {
+		if err := <-shutdownErrors; err != nil {
+			slog.Error("Failed to gracefully shut down server", slog.Any("error", err))
 			failed = true
 		}
-	})
+	}
+
+	// Wait for in-flight queued deliveries
+	cancelQueue()
+	select {
+	case <-queueDone:
+	case <-shutdownCtx.Done():
+		slog.Error("Timed out waiting for queued deliveries")
+		failed = true
+	}
+
+	// Save any pending modifications
+	cancelStore()
+	select {
+	case err := <-storeDone:
+		if err != nil {
+			slog.Error("Failed to save store", slog.Any("error", err))
+			failed = true
+		}
+	case <-shutdownCtx.Done():
+		slog.Error("Timed out waiting for store to be saved")
+		failed = true
+	}
+
+	if err := store.Close(); err != nil {
+		slog.Error("Failed to close store", slog.Any("error", err))
+		failed = true
+	}
 
-	wg.Wait()
 	if failed {
 		os.Exit(1)
 	}
+
+	slog.Info("Shut down gracefully")
+}
+
+// configureTLS configures server to serve TLS using a certificate which is
+// reloaded when changed. TLS is not configured unless both files are set.
+func configureTLS(server *http.Server, certFile string, keyFile string) error {
+	if certFile == "" && keyFile == "" {
+		return nil
+	} else if certFile == "" || keyFile == "" {
+		return fmt.Errorf("both a certificate and a key file must be configured")
+	}
+
+	reloader, err := listen.NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	server.TLSConfig = reloader.TLSConfig()
+	return nil
+}
+
+// serve serves server on listener, using TLS if configured.
+func serve(server *http.Server, listener net.Listener) error {
+	if server.TLSConfig != nil {
+		return server.ServeTLS(listener, "", "")
+	}
+
+	return server.Serve(listener)
 }
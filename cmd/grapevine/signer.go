@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/AlexGustafsson/grapevine/internal/listen"
+	"github.com/AlexGustafsson/grapevine/internal/signer"
+)
+
+// runSigner runs a signer process, holding keys on behalf of Grapevine so that
+// they're kept outside of its memory and disk. Topics use the keys through
+// URIs such as unix:///run/grapevine/signer.sock?key=name.
+func runSigner(config Config, args []string) error {
+	flags := flag.NewFlagSet("signer", flag.ExitOnError)
+	socket := flags.String("socket", "", "path of the Unix domain socket to listen on")
+	keys := make(map[string]crypto.Signer)
+	flags.Func("key", "key to serve, as name=path to a PEM-encoded P-256 key (may be repeated)", func(value string) error {
+		name, path, ok := strings.Cut(value, "=")
+		if !ok || name == "" || path == "" {
+			return fmt.Errorf("must be name=path")
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		privateKey, err := signer.ParsePEM(content)
+		if err != nil {
+			return fmt.Errorf("invalid key %s: %w", name, err)
+		}
+
+		keys[name] = privateKey
+		return nil
+	})
+	flags.Parse(args)
+
+	if *socket == "" {
+		return fmt.Errorf("a socket must be specified")
+	}
+
+	if len(keys) == 0 {
+		return fmt.Errorf("at least one key must be specified")
+	}
+
+	listener, err := listen.Listen(listen.UnixPrefix+*socket, 0600)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	slog.Info("Serving keys", slog.String("socket", *socket), slog.Int("keys", len(keys)))
+	return signer.Serve(listener, keys)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/AlexGustafsson/grapevine/internal/state"
+)
+
+// migrate migrates the state to the current schema version. With -dry-run, the
+// changes that would be made are printed instead.
+func migrate(config Config, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print the changes that would be made, without making them")
+	flags.Parse(args)
+
+	backend, err := openBackend(config, state.BackendKind(config.StorageBackend))
+	if err != nil {
+		return fmt.Errorf("failed to open storage backend: %w", err)
+	}
+	defer backend.Close()
+
+	if !*dryRun {
+		return state.Migrate(config.BasePath, backend)
+	}
+
+	plan, err := state.PlanMigration(config.BasePath, backend)
+	if err != nil {
+		return err
+	}
+
+	if plan.Empty() {
+		fmt.Printf("State is up to date (schema version %d)\n", plan.FromVersion)
+		return nil
+	}
+
+	fmt.Printf("Schema version: %d -> %d\n", plan.FromVersion, plan.ToVersion)
+	for _, step := range plan.BackendSteps {
+		fmt.Printf("  migrate storage: %s\n", step)
+	}
+	for _, step := range plan.Steps {
+		fmt.Printf("  migrate: %s\n", step)
+	}
+	for _, topic := range plan.NewTopics {
+		fmt.Printf("  generate keys for new topic: %s\n", topic)
+	}
+	for _, topic := range plan.RestoredTopics {
+		fmt.Printf("  restore archived topic: %s\n", topic)
+	}
+	for _, topic := range plan.ArchivedTopics {
+		fmt.Printf("  archive removed topic: %s\n", topic)
+	}
+
+	return nil
+}
+
+// purgeTopics permanently deletes archived topics. Unless topics are specified,
+// topics archived longer than the archive retention are purged.
+func purgeTopics(config Config, args []string) error {
+	flags := flag.NewFlagSet("purge-topics", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s purge-topics [topic...]\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Grapevine must not be running.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	backend, err := openBackend(config, state.BackendKind(config.StorageBackend))
+	if err != nil {
+		return fmt.Errorf("failed to open storage backend: %w", err)
+	}
+	defer backend.Close()
+
+	if flags.NArg() > 0 {
+		for _, topic := range flags.Args() {
+			if err := state.PurgeTopic(backend, topic); err != nil {
+				return fmt.Errorf("failed to purge topic %s: %w", topic, err)
+			}
+		}
+
+		return nil
+	}
+
+	purged, err := state.PurgeArchivedTopics(backend, time.Now().Add(-config.ArchiveRetention))
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Purged archived topics", slog.Int("topics", len(purged)), slog.Duration("retention", config.ArchiveRetention))
+	return nil
+}
+
+// migrateStorage copies all state from one storage backend to another.
+func migrateStorage(config Config, args []string) error {
+	flags := flag.NewFlagSet("migrate-storage", flag.ExitOnError)
+	from := flags.String("from", string(state.BackendJSON), "backend to migrate from")
+	to := flags.String("to", string(state.BackendSQLite), "backend to migrate to")
+	force := flags.Bool("force", false, "migrate even if the destination backend is not empty")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s migrate-storage [-from backend] [-to backend] [-force]\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Grapevine must not be running.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *from == *to {
+		return fmt.Errorf("cannot migrate a backend to itself")
+	}
+
+	src, err := openBackend(config, state.BackendKind(*from))
+	if err != nil {
+		return fmt.Errorf("failed to open source backend: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := openBackend(config, state.BackendKind(*to))
+	if err != nil {
+		return fmt.Errorf("failed to open destination backend: %w", err)
+	}
+
+	topics, err := dst.Topics()
+	if err != nil {
+		dst.Close()
+		return err
+	}
+
+	if len(topics) > 0 && !*force {
+		dst.Close()
+		return fmt.Errorf("destination backend is not empty, use -force to migrate anyway")
+	}
+
+	slog.Info("Migrating storage", slog.String("from", *from), slog.String("to", *to))
+	if err := state.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	slog.Info("Migrated storage, set GRAPEVINE_STORAGE_BACKEND to use it", slog.String("backend", *to))
+	return nil
+}
@@ -4,17 +4,45 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
 
+	"github.com/AlexGustafsson/grapevine/internal/queue"
 	"github.com/AlexGustafsson/grapevine/internal/state"
 	"github.com/AlexGustafsson/grapevine/internal/webpush"
 )
 
 var (
-	ErrTopicNotFound        = errors.New("topic not found")
+	ErrTopicNotFound = errors.New("topic not found")
+	ErrTopicExists   = errors.New("topic already exists")
+	// ErrTopicInConfig is returned when modifying a topic configured in
+	// config.json, rather than through the API.
+	ErrTopicInConfig        = errors.New("topic is configured in config.json")
 	ErrSubscriptionNotFound = errors.New("subscription not found")
+	ErrSubscriptionExpired  = errors.New("subscription expired")
+	// ErrKeyRetired is returned when pushing to a subscription made with a
+	// topic key that has since been retired.
+	ErrKeyRetired = errors.New("key of subscription was retired")
+	// ErrExternalKey is returned when replacing the key of a topic whose key is
+	// held by a key provider.
+	ErrExternalKey = errors.New("topic's key is held by a key provider")
 )
 
+// ValidationError is returned when a request is invalid.
+type ValidationError struct {
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
 type Urgency string
 
 const (
@@ -24,43 +52,397 @@ const (
 	UrgencyHigh    Urgency = "high"
 )
 
-type Notification struct {
-	TTL     int
-	Urgency Urgency
-	Title   string
-	Body    string
+// DefaultTTL is the TTL in seconds used for notifications when neither the
+// notification nor the topic specifies one.
+const DefaultTTL = 3600
+
+// DefaultConcurrency is the default number of subscriptions pushed to
+// concurrently.
+const DefaultConcurrency = 8
+
+// DefaultExpiryWarning is the default time before a subscription expires that
+// it's considered to expire soon.
+const DefaultExpiryWarning = 7 * 24 * time.Hour
+
+// DefaultKeyGracePeriod is the default time a rotated key remains valid for
+// subscriptions made with it.
+const DefaultKeyGracePeriod = state.DefaultKeyGracePeriod
+
+type PushStatus string
+
+const (
+	PushStatusDelivered PushStatus = "delivered"
+	// PushStatusQueued is used when a push failed temporarily and the push
+	// message was queued to be retried.
+	PushStatusQueued PushStatus = "queued"
+	// PushStatusGone is used when the push service reported that the
+	// subscription no longer exists. The subscription is removed.
+	PushStatusGone PushStatus = "gone"
+	// PushStatusExpired is used when the subscription's expiration time has
+	// passed. The subscription is removed without pushing to it.
+	PushStatusExpired PushStatus = "expired"
+	// PushStatusRetired is used when the subscription was made with a key that
+	// has been retired. The subscription is removed without pushing to it.
+	PushStatusRetired PushStatus = "retired"
+	PushStatusFailed  PushStatus = "failed"
+)
+
+// PushResult is the result of pushing a notification to a single
+// subscription.
+type PushResult struct {
+	SubscriptionID string
+	Status         PushStatus
+	// StatusCode is the status code returned by the push service, if any.
+	StatusCode int
+	// Response is the response body returned by the push service, if any.
+	Response string
+	Error    error
+	Latency  time.Duration
+}
+
+// SubscriptionMetadata is metadata of a subscription, provided when
+// subscribing.
+type SubscriptionMetadata struct {
+	UserAgent string
+	Label     string
+	// ApplicationServerKey is the topic's public key the subscription was made
+	// with. Defaults to the topic's current key.
+	ApplicationServerKey string
+}
+
+// SubscriptionInfo describes a subscription.
+type SubscriptionInfo struct {
+	ID      string
+	Service webpush.Service
+	SubscriptionMetadata
+	Created       time.Time
+	Updated       time.Time
+	LastDelivered *time.Time
+	// Failures is the number of consecutive failed deliveries.
+	Failures int
+	// ExpirationTime is the time the push service expires the subscription,
+	// if any.
+	ExpirationTime *time.Time
+	// ExpiresSoon is true if the subscription expires within the configured
+	// expiry warning, after which it should be renewed.
+	ExpiresSoon bool
+	// KeyID is the id of the topic's key the subscription was made with.
+	KeyID string
+	// KeyChanged is true if the topic's key has been rotated since the
+	// subscription was made, after which it should be renewed using the
+	// topic's current key.
+	KeyChanged bool
+}
+
+// TopicConfig is the configuration of a topic managed through the API.
+type TopicConfig struct {
+	Name      string
+	ShortName string
+	Presets   state.NotificationPresets
+}
+
+// KeyImport is a VAPID key pair exported by another Web Push server.
+type KeyImport struct {
+	// PrivateKey is the private key, raw and base64url encoded or PEM-encoded.
+	// See [state.ParsePrivateKey].
+	PrivateKey string
+	// PublicKey is the base64url encoded public key, if known. It's verified to
+	// belong to the private key.
+	PublicKey string
+}
+
+// TopicInfo describes a topic.
+type TopicInfo struct {
+	Topic string
+	TopicConfig
+	// Source is where the topic is configured.
+	Source state.TopicSource
+	// ApplicationServerKey is the topic's public VAPID key.
+	ApplicationServerKey string
+	// KeyID is the id of the topic's current key.
+	KeyID string
+	// KeyURI is the URI of the topic's key if it's held by a key provider.
+	KeyURI string
+	// PreviousKeys are the ids of the topic's rotated keys, still valid for
+	// existing subscriptions, and when they're retired.
+	PreviousKeys map[string]time.Time
 }
 
 type API interface {
-	Subscribe(context.Context, string, string, webpush.Subscription) error
+	ListTopics(context.Context) ([]TopicInfo, error)
+	GetTopic(context.Context, string) (TopicInfo, error)
+	CreateTopic(context.Context, string, TopicConfig) (TopicInfo, error)
+	UpdateTopic(context.Context, string, TopicConfig) (TopicInfo, error)
+	DeleteTopic(context.Context, string) error
+	RotateKey(context.Context, string, time.Duration) (TopicInfo, error)
+	ImportKey(context.Context, string, KeyImport, time.Duration) (TopicInfo, error)
+
+	Subscribe(context.Context, string, string, webpush.Subscription, SubscriptionMetadata) error
 	GetSubsription(context.Context, string, string) (webpush.Subscription, error)
+	GetSubscriptionInfo(context.Context, string, string) (SubscriptionInfo, error)
+	ListSubscriptions(context.Context, string) ([]SubscriptionInfo, error)
 	Unsubscribe(context.Context, string, string) error
+	ImportSubscriptions(context.Context, string, io.Reader) (*state.SubscriptionImportResult, error)
 
-	Push(context.Context, string, *Notification) error
+	Push(context.Context, string, *Notification) ([]PushResult, error)
+
+	ExportState(context.Context, io.Writer) error
+	ImportState(context.Context, io.Reader, state.ImportMode) error
 }
 
 var _ API = (*WebPushAPI)(nil)
 
 type WebPushAPI struct {
 	Store *state.Store
+	// Queue is used to retry push messages that failed temporarily. If nil,
+	// failed push messages are not retried.
+	Queue *queue.Queue
+	// Concurrency is the maximum number of subscriptions pushed to
+	// concurrently. Defaults to [DefaultConcurrency].
+	Concurrency int
+	// ExpiryWarning is the time before a subscription expires that it's
+	// considered to expire soon. Defaults to [DefaultExpiryWarning].
+	ExpiryWarning time.Duration
+	// BackupPassphrase, if set, encrypts exported state and decrypts imported
+	// state.
+	BackupPassphrase string
+	// KeyGracePeriod is the time a rotated key remains valid for subscriptions
+	// made with it. Defaults to [DefaultKeyGracePeriod].
+	KeyGracePeriod time.Duration
+}
+
+// ListTopics implements API.
+func (w *WebPushAPI) ListTopics(ctx context.Context) ([]TopicInfo, error) {
+	clients := w.Store.Clients()
+
+	infos := make([]TopicInfo, 0, len(clients))
+	for _, client := range clients {
+		infos = append(infos, topicInfo(&client))
+	}
+
+	return infos, nil
+}
+
+// GetTopic implements API.
+func (w *WebPushAPI) GetTopic(ctx context.Context, topic string) (TopicInfo, error) {
+	client, ok := w.Store.Client(topic)
+	if !ok {
+		return TopicInfo{}, ErrTopicNotFound
+	}
+
+	return topicInfo(&client), nil
+}
+
+// CreateTopic implements API.
+func (w *WebPushAPI) CreateTopic(ctx context.Context, topic string, config TopicConfig) (TopicInfo, error) {
+	if err := state.ValidateTopicName(topic); err != nil {
+		return TopicInfo{}, &ValidationError{Message: err.Error()}
+	}
+
+	stateTopic, err := config.topic()
+	if err != nil {
+		return TopicInfo{}, err
+	}
+
+	client, err := w.Store.CreateTopic(topic, stateTopic)
+	if err == state.ErrTopicExists {
+		return TopicInfo{}, ErrTopicExists
+	} else if err != nil {
+		return TopicInfo{}, err
+	}
+
+	return topicInfo(&client), nil
+}
+
+// UpdateTopic implements API.
+func (w *WebPushAPI) UpdateTopic(ctx context.Context, topic string, config TopicConfig) (TopicInfo, error) {
+	stateTopic, err := config.topic()
+	if err != nil {
+		return TopicInfo{}, err
+	}
+
+	client, err := w.Store.UpdateTopic(topic, stateTopic)
+	switch err {
+	case nil:
+		return topicInfo(&client), nil
+	case state.ErrTopicNotFound:
+		return TopicInfo{}, ErrTopicNotFound
+	case state.ErrTopicInConfig:
+		return TopicInfo{}, ErrTopicInConfig
+	default:
+		return TopicInfo{}, err
+	}
+}
+
+// DeleteTopic implements API.
+func (w *WebPushAPI) DeleteTopic(ctx context.Context, topic string) error {
+	err := w.Store.DeleteTopic(topic)
+	switch err {
+	case state.ErrTopicNotFound:
+		return ErrTopicNotFound
+	case state.ErrTopicInConfig:
+		return ErrTopicInConfig
+	default:
+		return err
+	}
+}
+
+// RotateKey implements API. A zero grace period uses the configured grace
+// period.
+func (w *WebPushAPI) RotateKey(ctx context.Context, topic string, gracePeriod time.Duration) (TopicInfo, error) {
+	if gracePeriod < 0 {
+		return TopicInfo{}, &ValidationError{Message: "grace period must not be negative"}
+	} else if gracePeriod == 0 {
+		gracePeriod = w.keyGracePeriod()
+	}
+
+	client, err := w.Store.RotateKey(topic, gracePeriod)
+	switch err {
+	case nil:
+		return topicInfo(&client), nil
+	case state.ErrTopicNotFound:
+		return TopicInfo{}, ErrTopicNotFound
+	case state.ErrExternalKey:
+		return TopicInfo{}, ErrExternalKey
+	default:
+		return TopicInfo{}, err
+	}
+}
+
+// ImportKey implements API. A zero grace period uses the configured grace
+// period.
+func (w *WebPushAPI) ImportKey(ctx context.Context, topic string, key KeyImport, gracePeriod time.Duration) (TopicInfo, error) {
+	if gracePeriod < 0 {
+		return TopicInfo{}, &ValidationError{Message: "grace period must not be negative"}
+	} else if gracePeriod == 0 {
+		gracePeriod = w.keyGracePeriod()
+	}
+
+	privateKey, err := state.ParsePrivateKey(key.PrivateKey)
+	if err != nil {
+		return TopicInfo{}, &ValidationError{Message: fmt.Sprintf("invalid privateKey: %s", err)}
+	}
+
+	if key.PublicKey != "" {
+		if err := state.CheckPublicKey(privateKey, key.PublicKey); err != nil {
+			return TopicInfo{}, &ValidationError{Message: fmt.Sprintf("invalid publicKey: %s", err)}
+		}
+	}
+
+	client, err := w.Store.ImportKey(topic, privateKey, gracePeriod)
+	switch err {
+	case nil:
+		return topicInfo(&client), nil
+	case state.ErrTopicNotFound:
+		return TopicInfo{}, ErrTopicNotFound
+	case state.ErrExternalKey:
+		return TopicInfo{}, ErrExternalKey
+	default:
+		return TopicInfo{}, err
+	}
+}
+
+// keyGracePeriod returns the configured grace period of rotated keys.
+func (w *WebPushAPI) keyGracePeriod() time.Duration {
+	if w.KeyGracePeriod <= 0 {
+		return DefaultKeyGracePeriod
+	}
+
+	return w.KeyGracePeriod
+}
+
+// topic returns the config as a validated topic.
+func (c TopicConfig) topic() (state.Topic, error) {
+	if c.Name == "" {
+		return state.Topic{}, &ValidationError{Message: "name is required"}
+	}
+
+	topic := state.Topic{
+		Name:      c.Name,
+		ShortName: c.ShortName,
+		Presets:   c.Presets,
+	}
+
+	if err := topic.Validate(); err != nil {
+		return state.Topic{}, &ValidationError{Message: err.Error()}
+	}
+
+	return topic, nil
+}
+
+// topicInfo describes the topic of a client.
+func topicInfo(client *state.Client) TopicInfo {
+	return TopicInfo{
+		Topic: client.Topic(),
+		TopicConfig: TopicConfig{
+			Name:      client.Name(),
+			ShortName: client.ShortName(),
+			Presets:   client.Presets(),
+		},
+		Source:               client.Source(),
+		ApplicationServerKey: client.ApplicationServerKey(),
+		KeyID:                client.KeyID(),
+		KeyURI:               client.KeyURI(),
+		PreviousKeys:         client.PreviousKeys(),
+	}
+}
+
+// ExportState implements API.
+func (w *WebPushAPI) ExportState(ctx context.Context, writer io.Writer) error {
+	return w.Store.Export(writer, state.ExportOptions{Passphrase: w.BackupPassphrase})
+}
+
+// ImportState implements API.
+func (w *WebPushAPI) ImportState(ctx context.Context, reader io.Reader, mode state.ImportMode) error {
+	if mode != state.ImportMerge && mode != state.ImportReplace {
+		return &ValidationError{Message: fmt.Sprintf("invalid mode %q - must be one of merge or replace", mode)}
+	}
+
+	err := w.Store.Import(reader, state.ImportOptions{Mode: mode, Passphrase: w.BackupPassphrase})
+
+	// NOTE: Errors reading the archive, such as it being too large, are returned
+	// as is
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return err
+	}
+
+	for _, userErr := range []error{state.ErrInvalidArchive, state.ErrPassphraseRequired, state.ErrInvalidPassphrase, state.ErrImportConflict, state.ErrUnsupportedSchemaVersion} {
+		if errors.Is(err, userErr) {
+			return &ValidationError{Message: err.Error()}
+		}
+	}
+
+	return err
 }
 
 // Subscribe implements API.
-func (w *WebPushAPI) Subscribe(ctx context.Context, topic string, id string, subscription webpush.Subscription) error {
-	err := w.Store.AddSubscription(topic, id, subscription)
+func (w *WebPushAPI) Subscribe(ctx context.Context, topic string, id string, subscription webpush.Subscription, metadata SubscriptionMetadata) error {
+	client, ok := w.Store.Client(topic)
+	if !ok {
+		return ErrTopicNotFound
+	}
+
+	keyID := client.KeyID()
+	if metadata.ApplicationServerKey != "" {
+		keyID, ok = client.KeyIDOf(metadata.ApplicationServerKey)
+		if !ok {
+			return &ValidationError{Message: "applicationServerKey is not a key of the topic - it may have been retired"}
+		}
+	}
+
+	err := w.Store.AddSubscription(topic, id, state.Subscription{
+		Subscription: subscription,
+		UserAgent:    metadata.UserAgent,
+		Label:        metadata.Label,
+		KeyID:        keyID,
+	})
 	if err == state.ErrTopicNotFound {
 		return ErrTopicNotFound
 	} else if err != nil {
 		return err
 	}
 
-	// Could be debounced queue
-	go func() {
-		if err := w.Store.Save(w.Store.BasePath()); err != nil {
-			slog.Error("Failed to save store", slog.Any("error", err))
-		}
-	}()
-
 	return nil
 }
 
@@ -69,14 +451,92 @@ func (w *WebPushAPI) GetSubsription(ctx context.Context, topic string, id string
 	subscription, err := w.Store.GetSubscription(topic, id)
 	switch err {
 	case state.ErrSubscriptionNotFound:
-		return subscription, ErrSubscriptionNotFound
+		return subscription.Subscription, ErrSubscriptionNotFound
+	case state.ErrTopicNotFound:
+		return subscription.Subscription, ErrTopicNotFound
+	default:
+		return subscription.Subscription, err
+	}
+}
+
+// GetSubscriptionInfo implements API.
+func (w *WebPushAPI) GetSubscriptionInfo(ctx context.Context, topic string, id string) (SubscriptionInfo, error) {
+	client, ok := w.Store.Client(topic)
+	if !ok {
+		return SubscriptionInfo{}, ErrTopicNotFound
+	}
+
+	subscription, err := w.Store.GetSubscription(topic, id)
+	switch err {
+	case nil:
+		return w.subscriptionInfo(&client, id, subscription, time.Now()), nil
+	case state.ErrSubscriptionNotFound:
+		return SubscriptionInfo{}, ErrSubscriptionNotFound
 	case state.ErrTopicNotFound:
-		return subscription, ErrTopicNotFound
+		return SubscriptionInfo{}, ErrTopicNotFound
 	default:
-		return subscription, err
+		return SubscriptionInfo{}, err
 	}
 }
 
+// subscriptionInfo describes a subscription of the client's topic at the
+// specified time.
+func (w *WebPushAPI) subscriptionInfo(client *state.Client, id string, subscription state.Subscription, now time.Time) SubscriptionInfo {
+	expiryWarning := w.ExpiryWarning
+	if expiryWarning <= 0 {
+		expiryWarning = DefaultExpiryWarning
+	}
+
+	info := SubscriptionInfo{
+		ID:      id,
+		Service: webpush.ServiceFromEndpoint(subscription.Endpoint),
+		SubscriptionMetadata: SubscriptionMetadata{
+			UserAgent: subscription.UserAgent,
+			Label:     subscription.Label,
+		},
+		Created:       subscription.Created,
+		Updated:       subscription.Updated,
+		LastDelivered: subscription.LastDelivered,
+		Failures:      subscription.Failures,
+		ExpiresSoon:   subscription.ExpiresWithin(now, expiryWarning),
+		KeyID:         subscription.KeyID,
+		KeyChanged:    subscription.KeyID != "" && subscription.KeyID != client.KeyID(),
+	}
+
+	if subscription.ExpirationTime != nil {
+		info.ExpirationTime = &subscription.ExpirationTime.Time
+	}
+
+	if applicationServerKey, ok := client.ApplicationServerKeyOf(subscription.KeyID); ok {
+		info.ApplicationServerKey = applicationServerKey
+	}
+
+	return info
+}
+
+// ListSubscriptions implements API.
+func (w *WebPushAPI) ListSubscriptions(ctx context.Context, topic string) ([]SubscriptionInfo, error) {
+	client, ok := w.Store.Client(topic)
+	if !ok {
+		return nil, ErrTopicNotFound
+	}
+
+	subscriptions, err := w.Store.GetSubscriptions(topic)
+	if err == state.ErrTopicNotFound {
+		return nil, ErrTopicNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	infos := make([]SubscriptionInfo, 0, len(subscriptions))
+	for _, id := range slices.Sorted(maps.Keys(subscriptions)) {
+		infos = append(infos, w.subscriptionInfo(&client, id, subscriptions[id], now))
+	}
+
+	return infos, nil
+}
+
 // Unsubscribe implements API.
 func (w *WebPushAPI) Unsubscribe(ctx context.Context, topic string, id string) error {
 	err := w.Store.DeleteSubscription(topic, id)
@@ -88,79 +548,348 @@ func (w *WebPushAPI) Unsubscribe(ctx context.Context, topic string, id string) e
 		return err
 	}
 
-	// Could be debounced queue
-	go func() {
-		if err := w.Store.Save(w.Store.BasePath()); err != nil {
-			slog.Error("Failed to save store", slog.Any("error", err))
-		}
-	}()
-
 	return nil
 }
 
+// ImportSubscriptions implements API.
+func (w *WebPushAPI) ImportSubscriptions(ctx context.Context, topic string, reader io.Reader) (*state.SubscriptionImportResult, error) {
+	if _, ok := w.Store.Client(topic); !ok {
+		return nil, ErrTopicNotFound
+	}
+
+	subscriptions, err := state.ParseSubscriptions(reader)
+
+	// NOTE: Errors reading the body, such as it being too large, are returned
+	// as is
+	var maxBytesErr *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &maxBytesErr) {
+		return nil, err
+	} else if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, &ValidationError{Message: err.Error()}
+	} else if err != nil {
+		return nil, err
+	}
+
+	result, err := w.Store.ImportSubscriptions(topic, subscriptions)
+	if err == state.ErrTopicNotFound {
+		return nil, ErrTopicNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
 // Push implements API.
-func (w *WebPushAPI) Push(ctx context.Context, topic string, notification *Notification) error {
+func (w *WebPushAPI) Push(ctx context.Context, topic string, notification *Notification) ([]PushResult, error) {
 	client, ok := w.Store.Client(topic)
 	if !ok {
-		return ErrTopicNotFound
+		return nil, ErrTopicNotFound
+	}
+
+	notification, err := notification.resolve(&client)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := notification.Validate(); err != nil {
+		return nil, err
+	}
+
+	options, err := pushOptions(&client, notification)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := json.Marshal(notification.Message())
+	if err != nil {
+		return nil, err
+	}
+
+	// SEE: https://www.rfc-editor.org/rfc/rfc8291.html#section-4
+	if len(content) > 3993 {
+		return nil, &ValidationError{Message: "notification is too large - cannot exceed 3993B when encoded"}
 	}
 
 	subscriptions, err := w.Store.GetSubscriptions(topic)
 	if err == state.ErrTopicNotFound {
-		return ErrTopicNotFound
+		return nil, ErrTopicNotFound
 	} else if err != nil {
-		return err
+		return nil, err
 	}
 
 	if len(subscriptions) == 0 {
 		slog.Warn("Got event for topic without subscriptions", slog.String("topic", topic))
-		return nil
+		return []PushResult{}, nil
 	}
 
-	pushErrors := make([]error, 0)
+	// Subscriptions are pushed to using the key they were made with. Keys
+	// which can't be used, such as retired keys, fail their subscriptions
+	webPushClients := make(map[string]webpush.Client)
+	webPushClientErrors := make(map[string]error)
 	for _, subscription := range subscriptions {
-		target, err := subscription.PushTarget()
-		if err != nil {
-			return err
+		if _, ok := webPushClients[subscription.KeyID]; !ok {
+			webPushClients[subscription.KeyID], webPushClientErrors[subscription.KeyID] = client.WebPushClientFor(subscription.KeyID)
 		}
+	}
+
+	ids := slices.Sorted(maps.Keys(subscriptions))
+	results := make([]PushResult, len(ids))
+
+	concurrency := w.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+
+	// Fan out to a bounded number of workers. Each worker writes to its own
+	// index of results, so no further synchronization is required
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for range min(concurrency, len(ids)) {
+		wg.Go(func() {
+			for i := range indices {
+				subscription := subscriptions[ids[i]]
+				results[i] = w.push(ctx, webPushClients[subscription.KeyID], webPushClientErrors[subscription.KeyID], topic, ids[i], subscription, content, options)
+			}
+		})
+	}
+
+	for i := range ids {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	return results, nil
+}
+
+// pushOptions validates the notification's TTL and urgency and resolves them
+// using the topic's defaults.
+func pushOptions(client *state.Client, notification *Notification) (*webpush.PushOptions, error) {
+	maxTTL, hasMaxTTL := client.MaxTTL()
 
-		t := true
-		message := webpush.DeclerativePushMessage{
-			WebPush: 8030,
-			Notification: webpush.DeclerativePushNotification{
-				Title:              notification.Title,
-				Navigate:           "https://example.com", // TODO: Get from subscription - must match
-				Body:               notification.Body,
-				RequireInteraction: &t,
-				// TODO: Unknown if actions work
-				// Actions: []webpush.DeclerativePushNotificationAction{
-				// 	{
-				// 		Action:   "Test",
-				// 		Title:    "Test T",
-				// 		Navigate: "https://example.com/action",
-				// 	},
-				// },
-			},
-			// TODO: AppBadge works
-			// AppBadge: 1,
+	ttl := DefaultTTL
+	if notification.TTL != nil {
+		ttl = *notification.TTL
+		if ttl < 0 {
+			return nil, &ValidationError{Message: "ttl must not be negative"}
 		}
 
-		content, err := json.Marshal(&message)
-		if err != nil {
-			return err
+		if hasMaxTTL && ttl > maxTTL {
+			return nil, &ValidationError{Message: fmt.Sprintf("ttl must not exceed %d seconds for topic %s", maxTTL, client.Topic())}
+		}
+	} else {
+		if defaultTTL, ok := client.DefaultTTL(); ok {
+			ttl = defaultTTL
 		}
 
-		options := &webpush.PushOptions{
-			TTL:         3600, // TODO
-			Urgency:     webpush.Urgency(notification.Urgency),
-			ContentType: "application/notification+json",
+		// NOTE: Defaults are clamped rather than rejected, as the sender didn't
+		// ask for them
+		if hasMaxTTL {
+			ttl = min(ttl, maxTTL)
 		}
+	}
+
+	urgency := webpush.Urgency(notification.Urgency)
+	if urgency == "" {
+		urgency = client.DefaultUrgency()
+	}
 
-		err = client.WebPushClient().Push(ctx, target, content, options)
-		if err != nil {
-			pushErrors = append(pushErrors, err)
+	if urgency != "" && !urgency.Valid() {
+		return nil, &ValidationError{Message: fmt.Sprintf("invalid urgency %q - must be one of very-low, low, normal or high", urgency)}
+	}
+
+	return &webpush.PushOptions{
+		TTL:         int64(ttl),
+		Urgency:     urgency,
+		ContentType: "application/notification+json",
+	}, nil
+}
+
+// push pushes content to a single subscription. clientErr is the error
+// returned when creating the client of the subscription's key, such as
+// [state.ErrKeyRetired], in which case the subscription isn't pushed to.
+func (w *WebPushAPI) push(ctx context.Context, client webpush.Client, clientErr error, topic string, id string, subscription state.Subscription, content []byte, options *webpush.PushOptions) (result PushResult) {
+	result.SubscriptionID = id
+
+	start := time.Now()
+	defer func() {
+		result.Latency = time.Since(start)
+	}()
+
+	if subscription.Expired(start) {
+		result.Status = PushStatusExpired
+		result.Error = ErrSubscriptionExpired
+		w.prune(topic, id, "expired")
+		return result
+	}
+
+	if clientErr == state.ErrKeyRetired {
+		result.Status = PushStatusRetired
+		result.Error = ErrKeyRetired
+		w.prune(topic, id, "key retired")
+		return result
+	} else if clientErr != nil {
+		slog.Error("Failed to use key of subscription", slog.String("subscription", id), slog.Any("error", clientErr))
+		result.Status = PushStatusFailed
+		result.Error = clientErr
+		return result
+	}
+
+	target, err := subscription.PushTarget()
+	if err != nil {
+		result.Status = PushStatusFailed
+		result.Error = err
+		return result
+	}
+
+	response, err := client.Push(ctx, target, content, options)
+	if response != nil {
+		result.StatusCode = response.StatusCode
+		result.Response = response.Body
+	}
+	if errors.Is(err, webpush.ErrSubscriptionGone) {
+		result.Status = PushStatusGone
+		result.Error = err
+		w.prune(topic, id, "reported gone by push service")
+		return result
+	} else if err != nil {
+		slog.Warn("Failed to push to subscription", slog.String("subscription", id), slog.Any("error", err))
+		result.Status = PushStatusFailed
+		result.Error = err
+		w.recordDelivery(topic, id, false)
+
+		if w.Queue != nil && options.TTL > 0 && isTemporary(err) {
+			now := time.Now()
+			delivery := &queue.Delivery{
+				Topic:          topic,
+				SubscriptionID: id,
+				Content:        content,
+				ContentType:    options.ContentType,
+				Urgency:        string(options.Urgency),
+				PushTopic:      options.Topic,
+				Created:        now,
+				Expires:        now.Add(time.Duration(options.TTL) * time.Second),
+				Attempts:       1,
+			}
+
+			if after := retryAfter(err); after > 0 {
+				delivery.NextAttempt = now.Add(after)
+			}
+
+			if err := w.Queue.Enqueue(delivery); err != nil {
+				slog.Error("Failed to queue push message", slog.String("subscription", id), slog.Any("error", err))
+			} else {
+				result.Status = PushStatusQueued
+			}
 		}
+
+		return result
+	}
+
+	result.Status = PushStatusDelivered
+	w.recordDelivery(topic, id, true)
+	return result
+}
+
+// Deliver delivers a queued push message. It implements [queue.Handler].
+func (w *WebPushAPI) Deliver(ctx context.Context, delivery *queue.Delivery) error {
+	client, ok := w.Store.Client(delivery.Topic)
+	if !ok {
+		return ErrTopicNotFound
+	}
+
+	subscription, err := w.Store.GetSubscription(delivery.Topic, delivery.SubscriptionID)
+	if err == state.ErrTopicNotFound {
+		return ErrTopicNotFound
+	} else if err == state.ErrSubscriptionNotFound {
+		return ErrSubscriptionNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if subscription.Expired(time.Now()) {
+		w.prune(delivery.Topic, delivery.SubscriptionID, "expired")
+		return ErrSubscriptionExpired
+	}
+
+	webPushClient, err := client.WebPushClientFor(subscription.KeyID)
+	if err == state.ErrKeyRetired {
+		w.prune(delivery.Topic, delivery.SubscriptionID, "key retired")
+		return ErrKeyRetired
+	} else if err != nil {
+		return err
+	}
+
+	target, err := subscription.PushTarget()
+	if err != nil {
+		return err
+	}
+
+	options := &webpush.PushOptions{
+		TTL:         delivery.TTL(time.Now()),
+		ContentType: delivery.ContentType,
+		Urgency:     webpush.Urgency(delivery.Urgency),
+		Topic:       delivery.PushTopic,
+	}
+
+	_, err = webPushClient.Push(ctx, target, delivery.Content, options)
+	if errors.Is(err, webpush.ErrSubscriptionGone) {
+		w.prune(delivery.Topic, delivery.SubscriptionID, "reported gone by push service")
+		return err
+	}
+
+	w.recordDelivery(delivery.Topic, delivery.SubscriptionID, err == nil)
+	if err != nil && isTemporary(err) {
+		return &queue.RetryError{Err: err, After: retryAfter(err)}
+	}
+
+	return err
+}
+
+// recordDelivery records the outcome of a push in the subscription's
+// metadata.
+func (w *WebPushAPI) recordDelivery(topic string, id string, delivered bool) {
+	err := w.Store.RecordDelivery(topic, id, delivered)
+	if err == state.ErrSubscriptionNotFound {
+		// Removed while pushing
+		return
+	} else if err != nil {
+		slog.Error("Failed to record delivery", slog.String("topic", topic), slog.String("subscription", id), slog.Any("error", err))
+	}
+}
+
+// prune removes a subscription that can no longer be pushed to, for the
+// specified reason.
+func (w *WebPushAPI) prune(topic string, id string, reason string) {
+	err := w.Store.DeleteSubscription(topic, id)
+	if err == state.ErrSubscriptionNotFound {
+		// Already removed, such as by a concurrent push
+		return
+	} else if err != nil {
+		slog.Error("Failed to remove gone subscription", slog.String("topic", topic), slog.String("subscription", id), slog.Any("error", err))
+		return
+	}
+
+	slog.Info("Removed subscription", slog.String("topic", topic), slog.String("subscription", id), slog.String("reason", reason))
+}
+
+// isTemporary returns whether or not a push error is temporary and the push may
+// be retried.
+func isTemporary(err error) bool {
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
+
+// retryAfter returns the duration a push service asked to wait before
+// retrying, if any.
+func retryAfter(err error) time.Duration {
+	var pushErr *webpush.PushError
+	if errors.As(err, &pushErr) {
+		return pushErr.RetryAfter
 	}
 
-	return errors.Join(pushErrors...)
+	return 0
 }
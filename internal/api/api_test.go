@@ -0,0 +1,144 @@
+package api
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexGustafsson/grapevine/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestAPI returns an API backed by a store with the topics of config.
+func newTestAPI(t *testing.T, config state.ConfigFile, options state.Options) *WebPushAPI {
+	basePath := t.TempDir()
+
+	content, err := json.Marshal(&config)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(basePath, "config.json"), content, 0600))
+
+	backend, err := state.OpenJSONBackend(basePath, nil)
+	require.NoError(t, err)
+	require.NoError(t, state.Migrate(basePath, backend))
+
+	store, err := state.Load(basePath, backend, options)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	return &WebPushAPI{Store: store}
+}
+
+// testSubscription returns the JSON of a subscription to endpoint, expiring at
+// expirationTime unless it's zero, along with the subscription's id.
+func testSubscription(t *testing.T, endpoint string, expirationTime time.Time) (string, string) {
+	userAgentKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	subscription := map[string]any{
+		"endpoint": endpoint,
+		"keys": map[string]string{
+			"p256dh": base64.RawURLEncoding.EncodeToString(userAgentKey.PublicKey().Bytes()),
+			"auth":   base64.RawURLEncoding.EncodeToString(make([]byte, 16)),
+		},
+	}
+
+	if !expirationTime.IsZero() {
+		subscription["expirationTime"] = expirationTime.UnixMilli()
+	}
+
+	content, err := json.Marshal(subscription)
+	require.NoError(t, err)
+
+	return string(content), state.SubscriptionID(endpoint)
+}
+
+// serve returns the response of handler to a request.
+func serve(handler http.Handler, method string, path string, body string) *httptest.ResponseRecorder {
+	var request *http.Request
+	if body == "" {
+		request = httptest.NewRequest(method, path, nil)
+	} else {
+		request = httptest.NewRequest(method, path, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestNotificationResolveNavigate(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Topic    state.Topic
+		Options  state.Options
+		Navigate string
+		Expected string
+	}{
+		{
+			Name:     "explicit",
+			Topic:    state.Topic{Name: "Default", ShortName: "Default", BaseURL: "https://example.com/app/"},
+			Options:  state.Options{PublicURL: "https://push.example.com"},
+			Navigate: "https://example.com/page",
+			Expected: "https://example.com/page",
+		},
+		{
+			Name:     "base URL",
+			Topic:    state.Topic{Name: "Default", ShortName: "Default", BaseURL: "https://example.com/app/"},
+			Options:  state.Options{PublicURL: "https://push.example.com"},
+			Expected: "https://example.com/app/",
+		},
+		{
+			Name:     "public URL",
+			Topic:    state.Topic{Name: "Default", ShortName: "Default"},
+			Options:  state.Options{PublicURL: "https://push.example.com/grapevine"},
+			Expected: "https://push.example.com/grapevine/topics/default",
+		},
+		{
+			Name:     "topic public URL",
+			Topic:    state.Topic{Name: "Default", ShortName: "Default", PublicURL: "https://alerts.example.com"},
+			Options:  state.Options{PublicURL: "https://push.example.com"},
+			Expected: "https://alerts.example.com/topics/default",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			testCase.Options.VAPIDSubject = "mailto:push@example.com"
+			api := newTestAPI(t, state.ConfigFile{Topics: map[string]state.Topic{"default": testCase.Topic}}, testCase.Options)
+
+			client, ok := api.Store.Client("default")
+			require.True(t, ok)
+
+			notification := &Notification{Title: "Hello", Navigate: testCase.Navigate}
+			resolved, err := notification.resolve(&client)
+			require.NoError(t, err)
+			assert.Equal(t, testCase.Expected, resolved.Navigate)
+		})
+	}
+}
+
+func TestPushTitleAndBody(t *testing.T) {
+	topics := map[string]state.Topic{"default": {Name: "Default", ShortName: "Default"}}
+
+	// The navigate URL defaults to the topic's subscribe page
+	api := newTestAPI(t, state.ConfigFile{Topics: topics}, state.Options{PublicURL: "https://push.example.com", VAPIDSubject: "mailto:push@example.com"})
+	res := serve(NewPrivateServer(api), http.MethodPost, "/api/v1/notifications/default", `{"title":"Hello","body":"World"}`)
+	assert.Equal(t, http.StatusCreated, res.Code)
+	assert.JSONEq(t, `[]`, res.Body.String())
+
+	// Without a URL to default to, navigate is required
+	api = newTestAPI(t, state.ConfigFile{Topics: topics}, state.Options{VAPIDSubject: "mailto:push@example.com"})
+	res = serve(NewPrivateServer(api), http.MethodPost, "/api/v1/notifications/default", `{"title":"Hello","body":"World"}`)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	assert.Contains(t, res.Body.String(), "navigate is required")
+}
@@ -2,25 +2,459 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"net/http"
+	"slices"
+	"time"
+
+	"github.com/AlexGustafsson/grapevine/internal/state"
+	"github.com/AlexGustafsson/grapevine/internal/webpush"
 )
 
+// MaxImportSize is the maximum size of an imported archive.
+const MaxImportSize = 256 << 20
+
+// MaxSubscriptionImportSize is the maximum size of imported subscriptions.
+const MaxSubscriptionImportSize = 64 << 20
+
 type PrivateServer struct {
 	api API
 	mux *http.ServeMux
 }
 
 type NotificationRequest struct {
-	TTL     int     `json:"ttl"`
-	Urgency Urgency `json:"urgency"`
-	Title   string  `json:"title"`
-	Body    string  `json:"body"`
+	TTL                *int                        `json:"ttl,omitempty"`
+	Urgency            Urgency                     `json:"urgency,omitempty"`
+	Title              string                      `json:"title"`
+	Navigate           string                      `json:"navigate,omitempty"`
+	Language           string                      `json:"lang,omitempty"`
+	Direction          string                      `json:"dir,omitempty"`
+	Body               string                      `json:"body,omitempty"`
+	Tag                string                      `json:"tag,omitempty"`
+	Image              string                      `json:"image,omitempty"`
+	Icon               string                      `json:"icon,omitempty"`
+	Badge              string                      `json:"badge,omitempty"`
+	Vibrate            []int                       `json:"vibrate,omitempty"`
+	Timestamp          uint64                      `json:"timestamp,omitempty"`
+	Renotify           *bool                       `json:"renotify,omitempty"`
+	Silent             *bool                       `json:"silent,omitempty"`
+	RequireInteraction *bool                       `json:"requireInteraction,omitempty"`
+	Data               json.RawMessage             `json:"data,omitempty"`
+	Actions            []NotificationActionRequest `json:"actions,omitempty"`
+	AppBadge           *uint64                     `json:"appBadge,omitempty"`
+	Mutable            *bool                       `json:"mutable,omitempty"`
+}
+
+type NotificationActionRequest struct {
+	Action   string `json:"action"`
+	Title    string `json:"title"`
+	Navigate string `json:"navigate"`
+	Icon     string `json:"icon,omitempty"`
+}
+
+type NotificationResult struct {
+	SubscriptionID string     `json:"subscriptionId"`
+	Status         PushStatus `json:"status"`
+	StatusCode     int        `json:"statusCode,omitempty"`
+	Response       string     `json:"response,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	// Reason is the normalized reason of a push service error, if any.
+	Reason    webpush.Reason   `json:"reason,omitempty"`
+	Category  webpush.Category `json:"category,omitempty"`
+	Fix       string           `json:"fix,omitempty"`
+	LatencyMS int64            `json:"latencyMs"`
+}
+
+type SubscriptionResponse struct {
+	ID            string          `json:"id"`
+	Service       webpush.Service `json:"service"`
+	UserAgent     string          `json:"userAgent,omitempty"`
+	Label         string          `json:"label,omitempty"`
+	Created       *time.Time      `json:"created,omitempty"`
+	Updated       *time.Time      `json:"updated,omitempty"`
+	LastDelivered *time.Time      `json:"lastDelivered,omitempty"`
+	Failures      int             `json:"failures"`
+	// ExpirationTime is the time the push service expires the subscription,
+	// if any.
+	ExpirationTime *time.Time `json:"expirationTime,omitempty"`
+	ExpiresSoon    bool       `json:"expiresSoon"`
+	// KeyID is the id of the topic's key the subscription was made with.
+	KeyID string `json:"keyId,omitempty"`
+	// KeyChanged is true if the subscription was made with a rotated key.
+	KeyChanged bool `json:"keyChanged"`
+}
+
+// TopicRequest is the body of a request creating or updating a topic.
+type TopicRequest struct {
+	Name      string                    `json:"name"`
+	ShortName string                    `json:"shortName"`
+	Presets   state.NotificationPresets `json:"presets,omitzero"`
+}
+
+type TopicResponse struct {
+	Topic     string                    `json:"topic"`
+	Name      string                    `json:"name"`
+	ShortName string                    `json:"shortName"`
+	Presets   state.NotificationPresets `json:"presets,omitzero"`
+	// Source is where the topic is configured, either "config" or "api".
+	// Topics configured in config.json can't be modified through the API.
+	Source               state.TopicSource `json:"source"`
+	ApplicationServerKey string            `json:"applicationServerKey"`
+	KeyID                string            `json:"keyId"`
+	// KeyURI is the URI of the topic's key if it's held by a key provider,
+	// in which case it can't be rotated or imported.
+	KeyURI string `json:"keyUri,omitempty"`
+	// PreviousKeys are the topic's rotated keys, still valid for existing
+	// subscriptions until retired.
+	PreviousKeys []PreviousKeyResponse `json:"previousKeys"`
+}
+
+// KeyImportRequest is the body of a request importing a topic's key. It
+// matches the output of web-push generate-vapid-keys --json.
+type KeyImportRequest struct {
+	PrivateKey string `json:"privateKey"`
+	PublicKey  string `json:"publicKey,omitempty"`
+}
+
+type SubscriptionImportResponse struct {
+	Imported int                            `json:"imported"`
+	Rejected []RejectedSubscriptionResponse `json:"rejected"`
+}
+
+type RejectedSubscriptionResponse struct {
+	Index    int    `json:"index"`
+	Endpoint string `json:"endpoint"`
+	Reason   string `json:"reason"`
+}
+
+type PreviousKeyResponse struct {
+	KeyID    string    `json:"keyId"`
+	RetireAt time.Time `json:"retireAt"`
 }
 
 func NewPrivateServer(api API) *PrivateServer {
 	mux := http.NewServeMux()
 
+	mux.HandleFunc("GET /api/v1/topics", func(w http.ResponseWriter, r *http.Request) {
+		topics, err := api.ListTopics(r.Context())
+		if err != nil {
+			slog.Error("Failed to list topics", slog.Any("error", err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		response := make([]TopicResponse, 0, len(topics))
+		for _, topic := range topics {
+			response = append(response, topicResponse(topic))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&response); err != nil {
+			slog.Error("Failed to encode response", slog.Any("error", err))
+		}
+	})
+
+	mux.HandleFunc("GET /api/v1/topics/{topic}", func(w http.ResponseWriter, r *http.Request) {
+		topic, err := api.GetTopic(r.Context(), r.PathValue("topic"))
+		if err == ErrTopicNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if err != nil {
+			slog.Error("Failed to get topic", slog.Any("error", err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		response := topicResponse(topic)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&response); err != nil {
+			slog.Error("Failed to encode response", slog.Any("error", err))
+		}
+	})
+
+	mux.HandleFunc("POST /api/v1/topics/{topic}", func(w http.ResponseWriter, r *http.Request) {
+		var request TopicRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		topic, err := api.CreateTopic(r.Context(), r.PathValue("topic"), TopicConfig{
+			Name:      request.Name,
+			ShortName: request.ShortName,
+			Presets:   request.Presets,
+		})
+		var validationErr *ValidationError
+		if err == ErrTopicExists {
+			http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+			return
+		} else if errors.As(err, &validationErr) {
+			http.Error(w, validationErr.Message, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			slog.Error("Failed to create topic", slog.Any("error", err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		response := topicResponse(topic)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(&response); err != nil {
+			slog.Error("Failed to encode response", slog.Any("error", err))
+		}
+	})
+
+	mux.HandleFunc("PUT /api/v1/topics/{topic}", func(w http.ResponseWriter, r *http.Request) {
+		var request TopicRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		topic, err := api.UpdateTopic(r.Context(), r.PathValue("topic"), TopicConfig{
+			Name:      request.Name,
+			ShortName: request.ShortName,
+			Presets:   request.Presets,
+		})
+		var validationErr *ValidationError
+		if err == ErrTopicNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if err == ErrTopicInConfig {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if errors.As(err, &validationErr) {
+			http.Error(w, validationErr.Message, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			slog.Error("Failed to update topic", slog.Any("error", err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		response := topicResponse(topic)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&response); err != nil {
+			slog.Error("Failed to encode response", slog.Any("error", err))
+		}
+	})
+
+	mux.HandleFunc("DELETE /api/v1/topics/{topic}", func(w http.ResponseWriter, r *http.Request) {
+		err := api.DeleteTopic(r.Context(), r.PathValue("topic"))
+		if err == ErrTopicNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if err == ErrTopicInConfig {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			slog.Error("Failed to delete topic", slog.Any("error", err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("POST /api/v1/topics/{topic}/rotate-key", func(w http.ResponseWriter, r *http.Request) {
+		gracePeriod, err := parseGracePeriod(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		topic, err := api.RotateKey(r.Context(), r.PathValue("topic"), gracePeriod)
+		var validationErr *ValidationError
+		if err == ErrTopicNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if err == ErrExternalKey {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if errors.As(err, &validationErr) {
+			http.Error(w, validationErr.Message, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			slog.Error("Failed to rotate key", slog.Any("error", err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		response := topicResponse(topic)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&response); err != nil {
+			slog.Error("Failed to encode response", slog.Any("error", err))
+		}
+	})
+
+	mux.HandleFunc("PUT /api/v1/topics/{topic}/key", func(w http.ResponseWriter, r *http.Request) {
+		gracePeriod, err := parseGracePeriod(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var request KeyImportRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		topic, err := api.ImportKey(r.Context(), r.PathValue("topic"), KeyImport{
+			PrivateKey: request.PrivateKey,
+			PublicKey:  request.PublicKey,
+		}, gracePeriod)
+		var validationErr *ValidationError
+		if err == ErrTopicNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if err == ErrExternalKey {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if errors.As(err, &validationErr) {
+			http.Error(w, validationErr.Message, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			slog.Error("Failed to import key", slog.Any("error", err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		response := topicResponse(topic)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&response); err != nil {
+			slog.Error("Failed to encode response", slog.Any("error", err))
+		}
+	})
+
+	mux.HandleFunc("POST /api/v1/subscriptions/{topic}/import", func(w http.ResponseWriter, r *http.Request) {
+		result, err := api.ImportSubscriptions(r.Context(), r.PathValue("topic"), http.MaxBytesReader(w, r.Body, MaxSubscriptionImportSize))
+		var validationErr *ValidationError
+		var maxBytesErr *http.MaxBytesError
+		if err == ErrTopicNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if errors.As(err, &maxBytesErr) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		} else if errors.As(err, &validationErr) {
+			http.Error(w, validationErr.Message, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			slog.Error("Failed to import subscriptions", slog.Any("error", err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		response := SubscriptionImportResponse{
+			Imported: result.Imported,
+			Rejected: make([]RejectedSubscriptionResponse, 0, len(result.Rejected)),
+		}
+
+		for _, rejected := range result.Rejected {
+			response.Rejected = append(response.Rejected, RejectedSubscriptionResponse{
+				Index:    rejected.Index,
+				Endpoint: rejected.Endpoint,
+				Reason:   rejected.Reason,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&response); err != nil {
+			slog.Error("Failed to encode response", slog.Any("error", err))
+		}
+	})
+
+	mux.HandleFunc("GET /api/v1/subscriptions/{topic}", func(w http.ResponseWriter, r *http.Request) {
+		topic := r.PathValue("topic")
+
+		subscriptions, err := api.ListSubscriptions(r.Context(), topic)
+		if err == ErrTopicNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if err != nil {
+			slog.Error("Failed to list subscriptions", slog.Any("error", err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		response := make([]SubscriptionResponse, 0, len(subscriptions))
+		for _, subscription := range subscriptions {
+			subscriptionResponse := SubscriptionResponse{
+				ID:             subscription.ID,
+				Service:        subscription.Service,
+				UserAgent:      subscription.UserAgent,
+				Label:          subscription.Label,
+				LastDelivered:  subscription.LastDelivered,
+				Failures:       subscription.Failures,
+				ExpirationTime: subscription.ExpirationTime,
+				ExpiresSoon:    subscription.ExpiresSoon,
+				KeyID:          subscription.KeyID,
+				KeyChanged:     subscription.KeyChanged,
+			}
+
+			if !subscription.Created.IsZero() {
+				subscriptionResponse.Created = &subscription.Created
+			}
+
+			if !subscription.Updated.IsZero() {
+				subscriptionResponse.Updated = &subscription.Updated
+			}
+
+			response = append(response, subscriptionResponse)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&response); err != nil {
+			slog.Error("Failed to encode response", slog.Any("error", err))
+		}
+	})
+
+	mux.HandleFunc("GET /api/v1/state/export", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="grapevine-%s.tar.gz"`, time.Now().UTC().Format("20060102T150405Z")))
+
+		writer := &countingWriter{writer: w}
+		if err := api.ExportState(r.Context(), writer); err != nil {
+			slog.Error("Failed to export state", slog.Any("error", err))
+			// NOTE: The status can only be changed before the archive is streamed
+			if writer.written == 0 {
+				w.Header().Del("Content-Disposition")
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+	})
+
+	mux.HandleFunc("POST /api/v1/state/import", func(w http.ResponseWriter, r *http.Request) {
+		mode := state.ImportMode(r.URL.Query().Get("mode"))
+		if mode == "" {
+			mode = state.ImportMerge
+		}
+
+		err := api.ImportState(r.Context(), http.MaxBytesReader(w, r.Body, MaxImportSize), mode)
+		var validationErr *ValidationError
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		} else if errors.As(err, &validationErr) {
+			http.Error(w, validationErr.Message, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			slog.Error("Failed to import state", slog.Any("error", err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
 	mux.HandleFunc("POST /api/v1/notifications/{topic}", func(w http.ResponseWriter, r *http.Request) {
 		topic := r.PathValue("topic")
 
@@ -30,22 +464,80 @@ func NewPrivateServer(api API) *PrivateServer {
 			return
 		}
 
-		err := api.Push(r.Context(), topic, &Notification{
-			TTL:     request.TTL,
-			Urgency: request.Urgency,
-			Title:   request.Title,
-			Body:    request.Body,
-		})
+		notification := &Notification{
+			TTL:                request.TTL,
+			Urgency:            request.Urgency,
+			Title:              request.Title,
+			Navigate:           request.Navigate,
+			Language:           request.Language,
+			Direction:          request.Direction,
+			Body:               request.Body,
+			Tag:                request.Tag,
+			Image:              request.Image,
+			Icon:               request.Icon,
+			Badge:              request.Badge,
+			Vibrate:            request.Vibrate,
+			Timestamp:          request.Timestamp,
+			Renotify:           request.Renotify,
+			Silent:             request.Silent,
+			RequireInteraction: request.RequireInteraction,
+			Data:               request.Data,
+			AppBadge:           request.AppBadge,
+			Mutable:            request.Mutable,
+		}
+
+		for _, action := range request.Actions {
+			notification.Actions = append(notification.Actions, NotificationAction{
+				Action:   action.Action,
+				Title:    action.Title,
+				Navigate: action.Navigate,
+				Icon:     action.Icon,
+			})
+		}
+
+		results, err := api.Push(r.Context(), topic, notification)
+		var validationErr *ValidationError
 		if err == ErrTopicNotFound {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
+		} else if errors.As(err, &validationErr) {
+			http.Error(w, validationErr.Message, http.StatusBadRequest)
+			return
 		} else if err != nil {
 			slog.Error("Failed to publish notification", slog.Any("error", err))
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 
+		response := make([]NotificationResult, 0, len(results))
+		for _, result := range results {
+			notificationResult := NotificationResult{
+				SubscriptionID: result.SubscriptionID,
+				Status:         result.Status,
+				StatusCode:     result.StatusCode,
+				Response:       result.Response,
+				LatencyMS:      result.Latency.Milliseconds(),
+			}
+
+			if result.Error != nil {
+				notificationResult.Error = result.Error.Error()
+			}
+
+			var pushErr *webpush.PushError
+			if errors.As(result.Error, &pushErr) {
+				notificationResult.Reason = pushErr.Reason
+				notificationResult.Category = pushErr.Category()
+				notificationResult.Fix = pushErr.Fix()
+			}
+
+			response = append(response, notificationResult)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(&response); err != nil {
+			slog.Error("Failed to encode response", slog.Any("error", err))
+		}
 	})
 
 	return &PrivateServer{
@@ -54,6 +546,57 @@ func NewPrivateServer(api API) *PrivateServer {
 	}
 }
 
+// countingWriter counts the bytes written to writer.
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// parseGracePeriod returns the grace period of rotated keys specified by the
+// gracePeriod query parameter, or zero if not specified.
+func parseGracePeriod(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("gracePeriod")
+	if value == "" {
+		return 0, nil
+	}
+
+	gracePeriod, err := time.ParseDuration(value)
+	if err != nil || gracePeriod <= 0 {
+		return 0, fmt.Errorf("invalid gracePeriod - must be a positive duration, such as 720h")
+	}
+
+	return gracePeriod, nil
+}
+
+// topicResponse returns the response describing a topic.
+func topicResponse(topic TopicInfo) TopicResponse {
+	previousKeys := make([]PreviousKeyResponse, 0, len(topic.PreviousKeys))
+	for _, keyID := range slices.Sorted(maps.Keys(topic.PreviousKeys)) {
+		previousKeys = append(previousKeys, PreviousKeyResponse{
+			KeyID:    keyID,
+			RetireAt: topic.PreviousKeys[keyID],
+		})
+	}
+
+	return TopicResponse{
+		Topic:                topic.Topic,
+		Name:                 topic.Name,
+		ShortName:            topic.ShortName,
+		Presets:              topic.Presets,
+		Source:               topic.Source,
+		ApplicationServerKey: topic.ApplicationServerKey,
+		KeyID:                topic.KeyID,
+		KeyURI:               topic.KeyURI,
+		PreviousKeys:         previousKeys,
+	}
+}
+
 func (s *PrivateServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.mux.ServeHTTP(w, r)
 }
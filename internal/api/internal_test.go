@@ -0,0 +1,405 @@
+package api
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AlexGustafsson/grapevine/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testConfig is the config of APIs in tests.
+var testConfig = state.ConfigFile{
+	Topics: map[string]state.Topic{
+		"default": {Name: "Default", ShortName: "Default"},
+	},
+}
+
+// testAPIOptions are the options of APIs' stores in tests.
+var testAPIOptions = state.Options{
+	PublicURL:    "https://push.example.com",
+	VAPIDSubject: "mailto:push@example.com",
+}
+
+func TestPrivateServerPushValidation(t *testing.T) {
+	api := newTestAPI(t, testConfig, testAPIOptions)
+	server := NewPrivateServer(api)
+
+	testCases := []struct {
+		Name     string
+		Topic    string
+		Body     string
+		Expected int
+	}{
+		{
+			Name:     "unknown topic",
+			Topic:    "unknown",
+			Body:     `{"title":"Hello"}`,
+			Expected: http.StatusNotFound,
+		},
+		{
+			Name:     "invalid JSON",
+			Topic:    "default",
+			Body:     `{"title":`,
+			Expected: http.StatusBadRequest,
+		},
+		{
+			Name:     "missing title",
+			Topic:    "default",
+			Body:     `{"body":"World"}`,
+			Expected: http.StatusBadRequest,
+		},
+		{
+			Name:     "invalid navigate",
+			Topic:    "default",
+			Body:     `{"title":"Hello","navigate":"javascript:alert(1)"}`,
+			Expected: http.StatusBadRequest,
+		},
+		{
+			Name:     "action without title",
+			Topic:    "default",
+			Body:     `{"title":"Hello","actions":[{"action":"open","navigate":"https://example.com"}]}`,
+			Expected: http.StatusBadRequest,
+		},
+		{
+			Name:     "valid",
+			Topic:    "default",
+			Body:     `{"title":"Hello","navigate":"https://example.com"}`,
+			Expected: http.StatusCreated,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			res := serve(server, http.MethodPost, "/api/v1/notifications/"+testCase.Topic, testCase.Body)
+			assert.Equal(t, testCase.Expected, res.Code, res.Body.String())
+		})
+	}
+}
+
+func TestPrivateServerPushResults(t *testing.T) {
+	api := newTestAPI(t, testConfig, testAPIOptions)
+	public := NewPublicServer(api)
+	private := NewPrivateServer(api)
+
+	// NOTE: Nothing listens on port 1, so pushing to the subscription fails
+	unreachable, unreachableID := testSubscription(t, "https://127.0.0.1:1/push/1", time.Time{})
+	expired, expiredID := testSubscription(t, "https://127.0.0.1:1/push/2", time.Now().Add(-time.Hour))
+
+	for _, subscription := range []struct{ id, body string }{{unreachableID, unreachable}, {expiredID, expired}} {
+		res := serve(public, http.MethodPost, "/api/v1/subscriptions/default/"+subscription.id, subscription.body)
+		require.Equal(t, http.StatusCreated, res.Code, res.Body.String())
+	}
+
+	res := serve(private, http.MethodPost, "/api/v1/notifications/default", `{"title":"Hello","body":"World"}`)
+	require.Equal(t, http.StatusCreated, res.Code, res.Body.String())
+	assert.Equal(t, "application/json", res.Header().Get("Content-Type"))
+
+	var results []NotificationResult
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &results))
+	require.Len(t, results, 2)
+
+	statuses := make(map[string]PushStatus)
+	for _, result := range results {
+		statuses[result.SubscriptionID] = result.Status
+		assert.NotEmpty(t, result.Error)
+	}
+
+	assert.Equal(t, map[string]PushStatus{
+		unreachableID: PushStatusFailed,
+		expiredID:     PushStatusExpired,
+	}, statuses)
+
+	// Expired subscriptions are removed
+	res = serve(private, http.MethodGet, "/api/v1/subscriptions/default", "")
+	require.Equal(t, http.StatusOK, res.Code)
+
+	var subscriptions []SubscriptionResponse
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &subscriptions))
+	require.Len(t, subscriptions, 1)
+	assert.Equal(t, unreachableID, subscriptions[0].ID)
+	assert.Equal(t, 1, subscriptions[0].Failures)
+}
+
+func TestPrivateServerPushOptions(t *testing.T) {
+	maxTTL := 60
+	api := newTestAPI(t, state.ConfigFile{
+		Topics: map[string]state.Topic{
+			"default": {Name: "Default", ShortName: "Default", MaxTTL: &maxTTL},
+		},
+	}, testAPIOptions)
+	server := NewPrivateServer(api)
+
+	testCases := []struct {
+		Name     string
+		Body     string
+		Expected int
+	}{
+		{
+			Name:     "negative ttl",
+			Body:     `{"title":"Hello","ttl":-1}`,
+			Expected: http.StatusBadRequest,
+		},
+		{
+			Name:     "ttl above max",
+			Body:     `{"title":"Hello","ttl":61}`,
+			Expected: http.StatusBadRequest,
+		},
+		{
+			Name:     "invalid urgency",
+			Body:     `{"title":"Hello","urgency":"urgent"}`,
+			Expected: http.StatusBadRequest,
+		},
+		{
+			Name:     "zero ttl",
+			Body:     `{"title":"Hello","ttl":0,"urgency":"high"}`,
+			Expected: http.StatusCreated,
+		},
+		{
+			Name:     "default ttl",
+			Body:     `{"title":"Hello"}`,
+			Expected: http.StatusCreated,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			res := serve(server, http.MethodPost, "/api/v1/notifications/default", testCase.Body)
+			assert.Equal(t, testCase.Expected, res.Code, res.Body.String())
+		})
+	}
+}
+
+func TestPrivateServerTopics(t *testing.T) {
+	api := newTestAPI(t, testConfig, testAPIOptions)
+	server := NewPrivateServer(api)
+
+	decode := func(t *testing.T, res *httptest.ResponseRecorder) TopicResponse {
+		var topic TopicResponse
+		require.NoError(t, json.Unmarshal(res.Body.Bytes(), &topic))
+		return topic
+	}
+
+	// Create
+	res := serve(server, http.MethodPost, "/api/v1/topics/alerts", `{"name":"Alerts","shortName":"Alerts"}`)
+	require.Equal(t, http.StatusCreated, res.Code, res.Body.String())
+	created := decode(t, res)
+	assert.Equal(t, "alerts", created.Topic)
+	assert.Equal(t, "Alerts", created.Name)
+	assert.Equal(t, state.TopicSourceAPI, created.Source)
+	assert.NotEmpty(t, created.ApplicationServerKey)
+	assert.NotEmpty(t, created.KeyID)
+	assert.NotNil(t, created.PreviousKeys)
+
+	res = serve(server, http.MethodPost, "/api/v1/topics/alerts", `{"name":"Alerts","shortName":"Alerts"}`)
+	assert.Equal(t, http.StatusConflict, res.Code)
+
+	res = serve(server, http.MethodPost, "/api/v1/topics/invalid", `{"shortName":"Invalid"}`)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	res = serve(server, http.MethodPost, "/api/v1/topics/invalid", `{"name":`)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	// Read
+	res = serve(server, http.MethodGet, "/api/v1/topics/alerts", "")
+	require.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, created, decode(t, res))
+
+	res = serve(server, http.MethodGet, "/api/v1/topics/unknown", "")
+	assert.Equal(t, http.StatusNotFound, res.Code)
+
+	res = serve(server, http.MethodGet, "/api/v1/topics", "")
+	require.Equal(t, http.StatusOK, res.Code)
+	var topics []TopicResponse
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &topics))
+	assert.Len(t, topics, 2)
+
+	// Update, keeping the key
+	res = serve(server, http.MethodPut, "/api/v1/topics/alerts", `{"name":"Alarms","shortName":"Alarms"}`)
+	require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+	updated := decode(t, res)
+	assert.Equal(t, "Alarms", updated.Name)
+	assert.Equal(t, created.KeyID, updated.KeyID)
+
+	res = serve(server, http.MethodPut, "/api/v1/topics/unknown", `{"name":"Unknown","shortName":"Unknown"}`)
+	assert.Equal(t, http.StatusNotFound, res.Code)
+
+	res = serve(server, http.MethodPut, "/api/v1/topics/alerts", `{"shortName":"Alarms"}`)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	// Topics configured in config.json can't be modified
+	res = serve(server, http.MethodPut, "/api/v1/topics/default", `{"name":"Default","shortName":"Default"}`)
+	assert.Equal(t, http.StatusConflict, res.Code)
+
+	res = serve(server, http.MethodDelete, "/api/v1/topics/default", "")
+	assert.Equal(t, http.StatusConflict, res.Code)
+
+	// Delete
+	res = serve(server, http.MethodDelete, "/api/v1/topics/alerts", "")
+	assert.Equal(t, http.StatusNoContent, res.Code)
+
+	res = serve(server, http.MethodDelete, "/api/v1/topics/alerts", "")
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
+
+func TestPrivateServerRotateKey(t *testing.T) {
+	api := newTestAPI(t, testConfig, testAPIOptions)
+	public := NewPublicServer(api)
+	private := NewPrivateServer(api)
+
+	res := serve(private, http.MethodGet, "/api/v1/topics/default", "")
+	require.Equal(t, http.StatusOK, res.Code)
+	var previous TopicResponse
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &previous))
+
+	subscription, id := testSubscription(t, "https://push.example.com/1", time.Time{})
+	res = serve(public, http.MethodPost, "/api/v1/subscriptions/default/"+id, subscription)
+	require.Equal(t, http.StatusCreated, res.Code, res.Body.String())
+
+	res = serve(private, http.MethodPost, "/api/v1/topics/default/rotate-key?gracePeriod=invalid", "")
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	res = serve(private, http.MethodPost, "/api/v1/topics/unknown/rotate-key", "")
+	assert.Equal(t, http.StatusNotFound, res.Code)
+
+	now := time.Now()
+	res = serve(private, http.MethodPost, "/api/v1/topics/default/rotate-key?gracePeriod=1h", "")
+	require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+
+	var rotated TopicResponse
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &rotated))
+	assert.NotEqual(t, previous.KeyID, rotated.KeyID)
+	assert.NotEqual(t, previous.ApplicationServerKey, rotated.ApplicationServerKey)
+	require.Len(t, rotated.PreviousKeys, 1)
+	assert.Equal(t, previous.KeyID, rotated.PreviousKeys[0].KeyID)
+	assert.WithinDuration(t, now.Add(time.Hour), rotated.PreviousKeys[0].RetireAt, time.Minute)
+
+	// Subscriptions made with the previous key are asked to renew
+	res = serve(public, http.MethodGet, "/api/v1/subscriptions/default/"+id, "")
+	require.Equal(t, http.StatusOK, res.Code)
+	var status SubscriptionStatusResponse
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &status))
+	assert.True(t, status.KeyChanged)
+	assert.Equal(t, rotated.ApplicationServerKey, status.ApplicationServerKey)
+
+	// Devices may still subscribe using the previous key, until it's retired
+	withKey := func(applicationServerKey string) string {
+		return subscription[:len(subscription)-1] + `,"applicationServerKey":"` + applicationServerKey + `"}`
+	}
+
+	res = serve(public, http.MethodPost, "/api/v1/subscriptions/default/"+id, withKey(previous.ApplicationServerKey))
+	assert.Equal(t, http.StatusCreated, res.Code, res.Body.String())
+
+	res = serve(public, http.MethodPost, "/api/v1/subscriptions/default/"+id, withKey("unknown"))
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	// Renewing the subscription using the current key clears the flag
+	res = serve(public, http.MethodPost, "/api/v1/subscriptions/default/"+id, withKey(rotated.ApplicationServerKey))
+	require.Equal(t, http.StatusCreated, res.Code, res.Body.String())
+
+	res = serve(public, http.MethodGet, "/api/v1/subscriptions/default/"+id, "")
+	require.Equal(t, http.StatusOK, res.Code)
+	assert.JSONEq(t, `{"expiresSoon":false,"keyChanged":false}`, res.Body.String())
+}
+
+func TestPrivateServerImportKey(t *testing.T) {
+	api := newTestAPI(t, testConfig, testAPIOptions)
+	server := NewPrivateServer(api)
+
+	privateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	otherKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	encode := base64.RawURLEncoding.EncodeToString
+
+	testCases := []struct {
+		Name     string
+		Topic    string
+		Body     string
+		Expected int
+	}{
+		{
+			Name:     "unknown topic",
+			Topic:    "unknown",
+			Body:     `{"privateKey":"` + encode(privateKey.Bytes()) + `"}`,
+			Expected: http.StatusNotFound,
+		},
+		{
+			Name:     "invalid private key",
+			Topic:    "default",
+			Body:     `{"privateKey":"invalid"}`,
+			Expected: http.StatusBadRequest,
+		},
+		{
+			Name:     "mismatched public key",
+			Topic:    "default",
+			Body:     `{"privateKey":"` + encode(privateKey.Bytes()) + `","publicKey":"` + encode(otherKey.PublicKey().Bytes()) + `"}`,
+			Expected: http.StatusBadRequest,
+		},
+		{
+			Name:     "valid",
+			Topic:    "default",
+			Body:     `{"privateKey":"` + encode(privateKey.Bytes()) + `","publicKey":"` + encode(privateKey.PublicKey().Bytes()) + `"}`,
+			Expected: http.StatusOK,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			res := serve(server, http.MethodPut, "/api/v1/topics/"+testCase.Topic+"/key", testCase.Body)
+			assert.Equal(t, testCase.Expected, res.Code, res.Body.String())
+		})
+	}
+
+	res := serve(server, http.MethodGet, "/api/v1/topics/default", "")
+	require.Equal(t, http.StatusOK, res.Code)
+
+	var topic TopicResponse
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &topic))
+	assert.Equal(t, encode(privateKey.PublicKey().Bytes()), topic.ApplicationServerKey)
+	assert.Len(t, topic.PreviousKeys, 1)
+}
+
+func TestPrivateServerImportSubscriptions(t *testing.T) {
+	api := newTestAPI(t, testConfig, testAPIOptions)
+	server := NewPrivateServer(api)
+
+	valid, validID := testSubscription(t, "https://push.example.com/1", time.Time{})
+	expired, _ := testSubscription(t, "https://push.example.com/2", time.Now().Add(-time.Hour))
+	body := "[" + valid + "," + expired + `,{"endpoint":"https://push.example.com/3"}]`
+
+	res := serve(server, http.MethodPost, "/api/v1/subscriptions/unknown/import", body)
+	assert.Equal(t, http.StatusNotFound, res.Code)
+
+	res = serve(server, http.MethodPost, "/api/v1/subscriptions/default/import", `{"endpoint":`)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	res = serve(server, http.MethodPost, "/api/v1/subscriptions/default/import", body)
+	require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+
+	var result SubscriptionImportResponse
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &result))
+	assert.Equal(t, 1, result.Imported)
+	require.Len(t, result.Rejected, 2)
+	assert.Equal(t, 1, result.Rejected[0].Index)
+	assert.Equal(t, "https://push.example.com/2", result.Rejected[0].Endpoint)
+	assert.Equal(t, 2, result.Rejected[1].Index)
+	assert.NotEmpty(t, result.Rejected[1].Reason)
+
+	res = serve(server, http.MethodGet, "/api/v1/subscriptions/default", "")
+	require.Equal(t, http.StatusOK, res.Code)
+
+	var subscriptions []SubscriptionResponse
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &subscriptions))
+	require.Len(t, subscriptions, 1)
+	assert.Equal(t, validID, subscriptions[0].ID)
+}
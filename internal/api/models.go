@@ -1,6 +1,8 @@
 package api
 
 import (
+	"time"
+
 	"github.com/AlexGustafsson/grapevine/internal/webpush"
 )
 
@@ -8,3 +10,26 @@ type SubscriptionRequest struct {
 	Topic        string               `json:"topic"`
 	Subscription webpush.Subscription `json:"subscription"`
 }
+
+// SubscribeRequest is the body of a subscribe request. It's the JSON
+// representation of a PushSubscription, optionally with a user-chosen label of
+// the device and the applicationServerKey the subscription was made with.
+type SubscribeRequest struct {
+	webpush.Subscription
+	Label                string `json:"label,omitempty"`
+	ApplicationServerKey string `json:"applicationServerKey,omitempty"`
+}
+
+// SubscriptionStatusResponse describes the expiry and key of a subscription,
+// allowing the PWA to renew it before it expires or once the topic's key has
+// been rotated.
+type SubscriptionStatusResponse struct {
+	ExpirationTime *time.Time `json:"expirationTime,omitempty"`
+	ExpiresSoon    bool       `json:"expiresSoon"`
+	// KeyChanged is true if the topic's key has been rotated since the
+	// subscription was made. The subscription should be renewed using
+	// ApplicationServerKey.
+	KeyChanged bool `json:"keyChanged"`
+	// ApplicationServerKey is the topic's current key, if KeyChanged.
+	ApplicationServerKey string `json:"applicationServerKey,omitempty"`
+}
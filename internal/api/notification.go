@@ -0,0 +1,303 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+
+	"github.com/AlexGustafsson/grapevine/internal/state"
+	"github.com/AlexGustafsson/grapevine/internal/webpush"
+)
+
+type Notification struct {
+	// TTL is the time in seconds the push service retains the notification if
+	// it cannot be delivered immediately. If nil, the topic's default is used.
+	TTL *int
+	// Urgency is the urgency of the notification. If empty, the topic's default
+	// is used.
+	Urgency Urgency
+
+	Title string
+	// Navigate is the URL opened when the notification is activated. Relative
+	// URLs, such as deep links, are resolved against the topic's base URL. If
+	// empty, the topic's base URL is used.
+	Navigate           string
+	Language           string
+	Direction          string
+	Body               string
+	Tag                string
+	Image              string
+	Icon               string
+	Badge              string
+	Vibrate            []int
+	Timestamp          uint64
+	Renotify           *bool
+	Silent             *bool
+	RequireInteraction *bool
+	Data               json.RawMessage
+	Actions            []NotificationAction
+
+	// AppBadge is the number to show as the app's badge. Zero clears the badge.
+	AppBadge *uint64
+	// Mutable signals whether or not a service worker may modify the
+	// notification before it's shown.
+	Mutable *bool
+}
+
+type NotificationAction struct {
+	Action   string
+	Title    string
+	Navigate string
+	Icon     string
+}
+
+// languageTagPattern loosely matches a BCP 47 language tag.
+var languageTagPattern = regexp.MustCompile(`^[a-zA-Z]{2,8}(-[a-zA-Z0-9]{1,8})*$`)
+
+// Validate returns a [ValidationError] if the notification is invalid.
+//
+// SEE: https://notifications.spec.whatwg.org/#create-a-notification.
+func (n *Notification) Validate() error {
+	if n.Title == "" {
+		return &ValidationError{Message: "title is required"}
+	}
+
+	if n.Navigate == "" {
+		return &ValidationError{Message: "navigate is required - the topic has no base URL and no public URL is configured to default to"}
+	}
+
+	if err := validateURL("navigate", n.Navigate, true); err != nil {
+		return err
+	}
+
+	if n.Language != "" && !languageTagPattern.MatchString(n.Language) {
+		return &ValidationError{Message: fmt.Sprintf("invalid lang %q - must be a BCP 47 language tag", n.Language)}
+	}
+
+	switch n.Direction {
+	case "", "auto", "ltr", "rtl":
+	default:
+		return &ValidationError{Message: fmt.Sprintf("invalid dir %q - must be one of auto, ltr or rtl", n.Direction)}
+	}
+
+	if err := validateURL("image", n.Image, false); err != nil {
+		return err
+	}
+
+	if err := validateURL("icon", n.Icon, false); err != nil {
+		return err
+	}
+
+	if err := validateURL("badge", n.Badge, false); err != nil {
+		return err
+	}
+
+	if n.Renotify != nil && *n.Renotify && n.Tag == "" {
+		return &ValidationError{Message: "renotify requires a tag"}
+	}
+
+	if n.Silent != nil && *n.Silent && len(n.Vibrate) > 0 {
+		return &ValidationError{Message: "vibrate cannot be used with silent"}
+	}
+
+	for _, duration := range n.Vibrate {
+		if duration < 0 {
+			return &ValidationError{Message: "vibrate durations must not be negative"}
+		}
+	}
+
+	if len(n.Data) > 0 && !json.Valid(n.Data) {
+		return &ValidationError{Message: "data must be valid JSON"}
+	}
+
+	for i, action := range n.Actions {
+		if action.Action == "" {
+			return &ValidationError{Message: fmt.Sprintf("actions[%d].action is required", i)}
+		}
+
+		if action.Title == "" {
+			return &ValidationError{Message: fmt.Sprintf("actions[%d].title is required", i)}
+		}
+
+		if err := validateURL(fmt.Sprintf("actions[%d].navigate", i), action.Navigate, true); err != nil {
+			return err
+		}
+
+		if err := validateURL(fmt.Sprintf("actions[%d].icon", i), action.Icon, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateURL returns a [ValidationError] if value is not an absolute HTTP(S)
+// URL.
+func validateURL(field string, value string, required bool) error {
+	if value == "" {
+		if required {
+			return &ValidationError{Message: fmt.Sprintf("%s is required", field)}
+		}
+
+		return nil
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return &ValidationError{Message: fmt.Sprintf("invalid %s %q - must be an absolute http(s) URL", field, value)}
+	}
+
+	return nil
+}
+
+// resolve returns a copy of the notification with the topic's presets applied
+// and relative URLs resolved against the topic's base URL.
+func (n *Notification) resolve(client *state.Client) (*Notification, error) {
+	resolved := *n
+	baseURL := client.BaseURL()
+	presets := client.Presets()
+
+	// NOTE: Declarative push messages require navigate. Default to the topic's
+	// base URL, or its subscribe page if Grapevine's public URL is known
+	if resolved.Navigate == "" {
+		if baseURL != nil {
+			resolved.Navigate = baseURL.String()
+		} else if publicURL := client.PublicURL(); publicURL != nil {
+			resolved.Navigate = publicURL.JoinPath("topics", client.Topic()).String()
+		}
+	}
+
+	if resolved.Icon == "" {
+		resolved.Icon = presets.Icon
+	}
+
+	if resolved.Badge == "" {
+		resolved.Badge = presets.Badge
+	}
+
+	if resolved.RequireInteraction == nil {
+		resolved.RequireInteraction = presets.RequireInteraction
+	}
+
+	if len(resolved.Actions) == 0 {
+		for _, action := range presets.Actions {
+			resolved.Actions = append(resolved.Actions, NotificationAction{
+				Action:   action.Action,
+				Title:    action.Title,
+				Navigate: action.Navigate,
+				Icon:     action.Icon,
+			})
+		}
+	} else {
+		resolved.Actions = slices.Clone(resolved.Actions)
+	}
+
+	if resolved.Tag == "" {
+		switch presets.TagStrategy {
+		case state.TagStrategyTopic:
+			resolved.Tag = client.Topic()
+		case state.TagStrategyTitle:
+			resolved.Tag = resolved.Title
+		}
+	}
+
+	var err error
+	resolved.Navigate, err = resolveURL("navigate", baseURL, resolved.Navigate)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved.Image, err = resolveURL("image", baseURL, resolved.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved.Icon, err = resolveURL("icon", baseURL, resolved.Icon)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved.Badge, err = resolveURL("badge", baseURL, resolved.Badge)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range resolved.Actions {
+		resolved.Actions[i].Navigate, err = resolveURL(fmt.Sprintf("actions[%d].navigate", i), baseURL, resolved.Actions[i].Navigate)
+		if err != nil {
+			return nil, err
+		}
+
+		resolved.Actions[i].Icon, err = resolveURL(fmt.Sprintf("actions[%d].icon", i), baseURL, resolved.Actions[i].Icon)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &resolved, nil
+}
+
+// resolveURL resolves a possibly relative URL, such as a deep link, against
+// baseURL.
+func resolveURL(field string, baseURL *url.URL, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", &ValidationError{Message: fmt.Sprintf("invalid %s %q", field, value)}
+	}
+
+	if u.IsAbs() {
+		return value, nil
+	}
+
+	if baseURL == nil {
+		return "", &ValidationError{Message: fmt.Sprintf("invalid %s %q - relative URLs require the topic to have a base URL", field, value)}
+	}
+
+	return baseURL.ResolveReference(u).String(), nil
+}
+
+// Message returns the notification as a declarative push message.
+func (n *Notification) Message() *webpush.DeclerativePushMessage {
+	message := &webpush.DeclerativePushMessage{
+		WebPush: 8030,
+		Notification: webpush.DeclerativePushNotification{
+			Title:              n.Title,
+			Navigate:           n.Navigate,
+			Language:           n.Language,
+			Direction:          n.Direction,
+			Body:               n.Body,
+			Tag:                n.Tag,
+			Image:              n.Image,
+			Icon:               n.Icon,
+			Badge:              n.Badge,
+			Vibrate:            n.Vibrate,
+			Timestamp:          n.Timestamp,
+			Renotify:           n.Renotify,
+			Silent:             n.Silent,
+			RequireInteraction: n.RequireInteraction,
+		},
+		AppBadge: n.AppBadge,
+		Mutable:  n.Mutable,
+	}
+
+	if len(n.Data) > 0 {
+		message.Notification.Data = n.Data
+	}
+
+	for _, action := range n.Actions {
+		message.Notification.Actions = append(message.Notification.Actions, webpush.DeclerativePushNotificationAction{
+			Action:   action.Action,
+			Title:    action.Title,
+			Navigate: action.Navigate,
+			Icon:     action.Icon,
+		})
+	}
+
+	return message
+}
@@ -1,13 +1,12 @@
 package api
 
 import (
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
 
-	"github.com/AlexGustafsson/grapevine/internal/webpush"
+	"github.com/AlexGustafsson/grapevine/internal/state"
 )
 
 type PublicServer struct {
@@ -24,8 +23,8 @@ func NewPublicServer(api API) *PublicServer {
 			return
 		}
 
-		var subscription webpush.Subscription
-		if err := json.NewDecoder(r.Body).Decode(&subscription); err != nil {
+		var request SubscribeRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
@@ -33,18 +32,28 @@ func NewPublicServer(api API) *PublicServer {
 		topic := r.PathValue("topic")
 		id := r.PathValue("id")
 
-		endpointDigest := sha256.Sum256([]byte(subscription.Endpoint))
-		expectedID := base64.RawURLEncoding.EncodeToString(endpointDigest[:])
+		if id != state.SubscriptionID(request.Endpoint) {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
 
-		if id != expectedID {
+		if len(request.Label) > 64 {
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
 
-		err := api.Subscribe(r.Context(), topic, id, subscription)
+		err := api.Subscribe(r.Context(), topic, id, request.Subscription, SubscriptionMetadata{
+			UserAgent:            r.UserAgent(),
+			Label:                request.Label,
+			ApplicationServerKey: request.ApplicationServerKey,
+		})
+		var validationErr *ValidationError
 		if err == ErrTopicNotFound {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
+		} else if errors.As(err, &validationErr) {
+			http.Error(w, validationErr.Message, http.StatusBadRequest)
+			return
 		} else if err != nil {
 			slog.Error("Failed to subscribe", slog.Any("error", err))
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -82,6 +91,49 @@ func NewPublicServer(api API) *PublicServer {
 		w.WriteHeader(http.StatusOK)
 	})
 
+	mux.HandleFunc("GET /api/v1/subscriptions/{topic}/{id}", func(w http.ResponseWriter, r *http.Request) {
+		topic := r.PathValue("topic")
+		id := r.PathValue("id")
+
+		info, err := api.GetSubscriptionInfo(r.Context(), topic, id)
+		if err == ErrTopicNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if err == ErrSubscriptionNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if err != nil {
+			slog.Error("Failed to get subscription", slog.Any("error", err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		response := SubscriptionStatusResponse{
+			ExpirationTime: info.ExpirationTime,
+			ExpiresSoon:    info.ExpiresSoon,
+			KeyChanged:     info.KeyChanged,
+		}
+
+		if info.KeyChanged {
+			topicInfo, err := api.GetTopic(r.Context(), topic)
+			if err == ErrTopicNotFound {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			} else if err != nil {
+				slog.Error("Failed to get topic", slog.Any("error", err))
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+
+			response.ApplicationServerKey = topicInfo.ApplicationServerKey
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&response); err != nil {
+			slog.Error("Failed to encode response", slog.Any("error", err))
+		}
+	})
+
 	mux.HandleFunc("DELETE /api/v1/subscriptions/{topic}/{id}", func(w http.ResponseWriter, r *http.Request) {
 		topic := r.PathValue("topic")
 		id := r.PathValue("id")
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublicServerSubscribe(t *testing.T) {
+	api := newTestAPI(t, testConfig, testAPIOptions)
+	server := NewPublicServer(api)
+
+	subscription, id := testSubscription(t, "https://push.example.com/1", time.Time{})
+
+	testCases := []struct {
+		Name     string
+		Path     string
+		Body     string
+		Expected int
+	}{
+		{
+			Name:     "unknown topic",
+			Path:     "/api/v1/subscriptions/unknown/" + id,
+			Body:     subscription,
+			Expected: http.StatusNotFound,
+		},
+		{
+			Name:     "invalid JSON",
+			Path:     "/api/v1/subscriptions/default/" + id,
+			Body:     `{"endpoint":`,
+			Expected: http.StatusBadRequest,
+		},
+		{
+			Name:     "mismatched id",
+			Path:     "/api/v1/subscriptions/default/other",
+			Body:     subscription,
+			Expected: http.StatusBadRequest,
+		},
+		{
+			Name:     "valid",
+			Path:     "/api/v1/subscriptions/default/" + id,
+			Body:     subscription,
+			Expected: http.StatusCreated,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			res := serve(server, http.MethodPost, testCase.Path, testCase.Body)
+			assert.Equal(t, testCase.Expected, res.Code, res.Body.String())
+		})
+	}
+
+	res := serve(server, http.MethodHead, "/api/v1/subscriptions/default/"+id, "")
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	res = serve(server, http.MethodDelete, "/api/v1/subscriptions/default/"+id, "")
+	assert.Equal(t, http.StatusNoContent, res.Code)
+
+	res = serve(server, http.MethodHead, "/api/v1/subscriptions/default/"+id, "")
+	assert.Equal(t, http.StatusNotFound, res.Code)
+
+	res = serve(server, http.MethodDelete, "/api/v1/subscriptions/default/"+id, "")
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
+
+func TestPublicServerSubscriptionStatus(t *testing.T) {
+	api := newTestAPI(t, testConfig, testAPIOptions)
+	server := NewPublicServer(api)
+
+	expirationTime := time.Now().Add(24 * time.Hour).Truncate(time.Millisecond)
+	expiring, expiringID := testSubscription(t, "https://push.example.com/1", expirationTime)
+	lasting, lastingID := testSubscription(t, "https://push.example.com/2", time.Time{})
+
+	for _, subscription := range []struct{ id, body string }{{expiringID, expiring}, {lastingID, lasting}} {
+		res := serve(server, http.MethodPost, "/api/v1/subscriptions/default/"+subscription.id, subscription.body)
+		require.Equal(t, http.StatusCreated, res.Code, res.Body.String())
+	}
+
+	res := serve(server, http.MethodGet, "/api/v1/subscriptions/default/"+expiringID, "")
+	require.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "application/json", res.Header().Get("Content-Type"))
+
+	var status SubscriptionStatusResponse
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &status))
+	require.NotNil(t, status.ExpirationTime)
+	assert.True(t, expirationTime.Equal(*status.ExpirationTime))
+	assert.True(t, status.ExpiresSoon)
+	assert.False(t, status.KeyChanged)
+
+	res = serve(server, http.MethodGet, "/api/v1/subscriptions/default/"+lastingID, "")
+	require.Equal(t, http.StatusOK, res.Code)
+	assert.JSONEq(t, `{"expiresSoon":false,"keyChanged":false}`, res.Body.String())
+
+	res = serve(server, http.MethodGet, "/api/v1/subscriptions/default/unknown", "")
+	assert.Equal(t, http.StatusNotFound, res.Code)
+
+	res = serve(server, http.MethodGet, "/api/v1/subscriptions/unknown/"+lastingID, "")
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
@@ -0,0 +1,231 @@
+// Package envelope implements envelope encryption of data at rest.
+//
+// Data is encrypted using AES-256-GCM with a random data encryption key, which
+// is in turn encrypted (wrapped) using a master key. Rotating the master key
+// therefore only requires re-wrapping data encryption keys, although
+// [Keyring.Seal] always generates a new one.
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Algorithm identifies sealed data.
+const Algorithm = "envelope-aes-256-gcm"
+
+// KeySize is the size of master keys in bytes.
+const KeySize = 32
+
+// PassphraseIterations is the number of PBKDF2 iterations used to derive a
+// master key from a passphrase.
+const PassphraseIterations = 600_000
+
+var (
+	ErrNotSealed  = errors.New("envelope: data is not sealed")
+	ErrUnknownKey = errors.New("envelope: data is sealed with an unknown master key")
+)
+
+// Key is a master key.
+type Key struct {
+	id  string
+	key []byte
+}
+
+// NewKey returns a master key. The key must be [KeySize] bytes.
+func NewKey(key []byte) (*Key, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("envelope: invalid key size %d, expected %d", len(key), KeySize)
+	}
+
+	// The id identifies the key used to seal data, without revealing the key
+	digest := sha256.Sum256(append([]byte("grapevine envelope key id\x00"), key...))
+
+	return &Key{
+		id:  hex.EncodeToString(digest[:8]),
+		key: key,
+	}, nil
+}
+
+// ParseKey parses a base64 encoded master key. Surrounding whitespace, such as
+// a trailing newline in a key file, is ignored.
+func ParseKey(value string) (*Key, error) {
+	value = strings.TrimSpace(value)
+
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		key, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+		if err != nil {
+			return nil, fmt.Errorf("envelope: invalid key encoding")
+		}
+	}
+
+	return NewKey(key)
+}
+
+// DeriveKey derives a master key from a passphrase using PBKDF2.
+func DeriveKey(passphrase string, salt []byte) (*Key, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("envelope: empty passphrase")
+	}
+
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, PassphraseIterations, KeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKey(key)
+}
+
+// ID returns an identifier of the key, which is safe to store and log.
+func (k *Key) ID() string {
+	return k.id
+}
+
+// Keyring seals data using its primary master key. Data sealed using any of
+// its keys can be opened, allowing master keys to be rotated.
+type Keyring struct {
+	primary *Key
+	keys    map[string]*Key
+}
+
+// NewKeyring returns a keyring sealing data using primary. Data sealed using
+// primary or any of the previous keys can be opened.
+func NewKeyring(primary *Key, previous ...*Key) *Keyring {
+	keys := map[string]*Key{
+		primary.id: primary,
+	}
+
+	for _, key := range previous {
+		if key != nil {
+			keys[key.id] = key
+		}
+	}
+
+	return &Keyring{
+		primary: primary,
+		keys:    keys,
+	}
+}
+
+// Primary returns the key used to seal data.
+func (k *Keyring) Primary() *Key {
+	return k.primary
+}
+
+// sealed is the encoded form of sealed data.
+type sealed struct {
+	Algorithm  string `json:"encryption"`
+	KeyID      string `json:"keyId"`
+	WrappedKey []byte `json:"wrappedKey"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// IsSealed returns true if data is sealed.
+func IsSealed(data []byte) bool {
+	var envelope sealed
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return false
+	}
+
+	return envelope.Algorithm == Algorithm
+}
+
+// Seal encrypts plaintext. The associated data is authenticated, but not
+// encrypted, and must be passed to [Keyring.Open]. It's typically used to bind
+// the sealed data to its purpose, such as a file name.
+func (k *Keyring) Seal(plaintext []byte, associatedData []byte) ([]byte, error) {
+	dataKey := make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := encrypt(dataKey, plaintext, associatedData)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := encrypt(k.primary.key, dataKey, []byte(k.primary.id))
+	if err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(&sealed{
+		Algorithm:  Algorithm,
+		KeyID:      k.primary.id,
+		WrappedKey: wrappedKey,
+		Ciphertext: ciphertext,
+	}, "", "  ")
+}
+
+// Open decrypts sealed data. Returns the plaintext and the id of the master key
+// the data was sealed with. Returns [ErrNotSealed] if data isn't sealed, or
+// [ErrUnknownKey] if it's sealed with a key not in the keyring.
+func (k *Keyring) Open(data []byte, associatedData []byte) ([]byte, string, error) {
+	var envelope sealed
+	if err := json.Unmarshal(data, &envelope); err != nil || envelope.Algorithm != Algorithm {
+		return nil, "", ErrNotSealed
+	}
+
+	key, ok := k.keys[envelope.KeyID]
+	if !ok {
+		return nil, "", ErrUnknownKey
+	}
+
+	dataKey, err := decrypt(key.key, envelope.WrappedKey, []byte(key.id))
+	if err != nil {
+		return nil, "", err
+	}
+
+	plaintext, err := decrypt(dataKey, envelope.Ciphertext, associatedData)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return plaintext, key.id, nil
+}
+
+// encrypt encrypts plaintext using AES-256-GCM, prefixing the ciphertext with
+// a random nonce.
+func encrypt(key []byte, plaintext []byte, associatedData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCMWithRandomNonce(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nil, nil, plaintext, associatedData), nil
+}
+
+// decrypt decrypts ciphertext produced by encrypt.
+func decrypt(key []byte, ciphertext []byte, associatedData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCMWithRandomNonce(block)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.Open(nil, nil, ciphertext, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("envelope: failed to decrypt: %w", err)
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,81 @@
+package envelope
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKey(t *testing.T, b byte) *Key {
+	key, err := NewKey(bytes.Repeat([]byte{b}, KeySize))
+	require.NoError(t, err)
+	return key
+}
+
+func TestSealOpen(t *testing.T) {
+	key := newTestKey(t, 1)
+	keyring := NewKeyring(key)
+
+	sealed, err := keyring.Seal([]byte("secret"), []byte("secrets.json"))
+	require.NoError(t, err)
+	assert.True(t, IsSealed(sealed))
+	assert.NotContains(t, string(sealed), "secret\"")
+
+	plaintext, keyID, err := keyring.Open(sealed, []byte("secrets.json"))
+	require.NoError(t, err)
+	assert.Equal(t, "secret", string(plaintext))
+	assert.Equal(t, key.ID(), keyID)
+
+	// The associated data must match
+	_, _, err = keyring.Open(sealed, []byte("subscriptions.json"))
+	assert.Error(t, err)
+}
+
+func TestOpenRotated(t *testing.T) {
+	previous := newTestKey(t, 1)
+	primary := newTestKey(t, 2)
+
+	sealed, err := NewKeyring(previous).Seal([]byte("secret"), nil)
+	require.NoError(t, err)
+
+	plaintext, keyID, err := NewKeyring(primary, previous).Open(sealed, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", string(plaintext))
+	assert.Equal(t, previous.ID(), keyID)
+
+	_, _, err = NewKeyring(primary).Open(sealed, nil)
+	assert.Equal(t, ErrUnknownKey, err)
+}
+
+func TestOpenNotSealed(t *testing.T) {
+	_, _, err := NewKeyring(newTestKey(t, 1)).Open([]byte(`{"clients":{}}`), nil)
+	assert.Equal(t, ErrNotSealed, err)
+	assert.False(t, IsSealed([]byte(`{"clients":{}}`)))
+}
+
+func TestParseKey(t *testing.T) {
+	testCases := []struct {
+		Name  string
+		Value string
+		Valid bool
+	}{
+		{Name: "standard", Value: "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=\n", Valid: true},
+		{Name: "url", Value: "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE", Valid: true},
+		{Name: "short", Value: "AQEBAQ==", Valid: false},
+		{Name: "invalid", Value: "not a key", Valid: false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			key, err := ParseKey(testCase.Value)
+			if testCase.Valid {
+				require.NoError(t, err)
+				assert.Equal(t, newTestKey(t, 1).ID(), key.ID())
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package listen
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UnixPrefix is the prefix of addresses of Unix domain sockets.
+const UnixPrefix = "unix:"
+
+// Listen listens on address. If address is prefixed with [UnixPrefix], such as
+// "unix:/run/grapevine/internal.sock", a Unix domain socket is created with
+// the permissions mode. Otherwise, address is a TCP address such as ":8080".
+func Listen(address string, mode fs.FileMode) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, UnixPrefix)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+
+	// A stale socket left behind by a previous process is replaced below
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("refusing to replace non-socket file %s", path)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// NOTE: The socket is created in a directory only accessible by this
+	// process and moved into place once its permissions are set, so that it's
+	// never accessible with the default permissions
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".listen-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tempPath := filepath.Join(dir, "socket")
+	listener, err := net.Listen("unix", tempPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// The socket is removed once closed below, at its final path
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tempPath, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &unixListener{Listener: listener, path: path}, nil
+}
+
+// unixListener is a listener of a Unix domain socket, which is removed once
+// the listener is closed.
+type unixListener struct {
+	net.Listener
+	path string
+	once sync.Once
+}
+
+// Close implements net.Listener.
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() {
+		os.Remove(l.path)
+	})
+	return err
+}
+
+// CertificateReloader serves a TLS certificate from files, reloading it when
+// the files change.
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	modTime     time.Time
+	lastCheck   time.Time
+}
+
+// certificateCheckInterval is the minimum interval between checking the
+// certificate files for changes.
+const certificateCheckInterval = 5 * time.Second
+
+// NewCertificateReloader loads the certificate and key from the specified
+// files.
+func NewCertificateReloader(certFile string, keyFile string) (*CertificateReloader, error) {
+	reloader := &CertificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+// GetCertificate implements [tls.Config.GetCertificate].
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if time.Since(r.lastCheck) >= certificateCheckInterval {
+		r.lastCheck = time.Now()
+		if modTime, err := r.latestModTime(); err == nil && !modTime.Equal(r.modTime) {
+			slog.Info("Reloading TLS certificate", slog.String("certFile", r.certFile))
+			if err := r.reloadLocked(); err != nil {
+				// Keep serving the previous certificate
+				slog.Error("Failed to reload TLS certificate", slog.Any("error", err))
+			}
+		}
+	}
+
+	return r.certificate, nil
+}
+
+// TLSConfig returns a TLS config serving the reloaded certificate.
+func (r *CertificateReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+}
+
+func (r *CertificateReloader) reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.reloadLocked()
+}
+
+func (r *CertificateReloader) reloadLocked() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.certificate = &certificate
+	r.modTime = modTime
+	r.lastCheck = time.Now()
+	return nil
+}
+
+// latestModTime returns the latest modification time of the certificate and
+// key files.
+func (r *CertificateReloader) latestModTime() (time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+
+	return certInfo.ModTime(), nil
+}
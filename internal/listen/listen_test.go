@@ -0,0 +1,172 @@
+package listen
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/fs"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenTCP(t *testing.T) {
+	listener, err := Listen("127.0.0.1:0", 0)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	assert.Equal(t, "tcp", listener.Addr().Network())
+}
+
+func TestListenUnix(t *testing.T) {
+	testCases := []struct {
+		Mode fs.FileMode
+	}{
+		{Mode: 0600},
+		{Mode: 0660},
+		{Mode: 0666},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Mode.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "grapevine.sock")
+
+			listener, err := Listen(UnixPrefix+path, testCase.Mode)
+			require.NoError(t, err)
+
+			info, err := os.Lstat(path)
+			require.NoError(t, err)
+			assert.Equal(t, fs.ModeSocket, info.Mode().Type())
+			assert.Equal(t, testCase.Mode, info.Mode().Perm())
+
+			// The socket is moved into place from a temporary directory
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Len(t, entries, 1)
+
+			accepted := make(chan error)
+			go func() {
+				conn, err := listener.Accept()
+				if err == nil {
+					conn.Close()
+				}
+				accepted <- err
+			}()
+
+			conn, err := net.Dial("unix", path)
+			require.NoError(t, err)
+			conn.Close()
+			assert.NoError(t, <-accepted)
+
+			// The socket is removed when closed
+			require.NoError(t, listener.Close())
+			assert.NoFileExists(t, path)
+		})
+	}
+}
+
+func TestListenUnixReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grapevine.sock")
+
+	// A socket left behind by a process that didn't exit cleanly
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	listener, err := Listen(UnixPrefix+path, 0600)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestListenUnixRefusesNonSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grapevine.sock")
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0600))
+
+	_, err := Listen(UnixPrefix+path, 0600)
+	assert.ErrorContains(t, err, "refusing to replace non-socket file")
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(content))
+}
+
+// writeCertificate writes a self-signed certificate for commonName and its key
+// to the specified files.
+func writeCertificate(t *testing.T, certFile string, keyFile string, commonName string) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	require.NoError(t, err)
+
+	key, err := x509.MarshalECPrivateKey(privateKey)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600))
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	writeCertificate(t, certFile, keyFile, "first")
+
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	require.NoError(t, err)
+
+	certificate, err := reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "first", certificate.Leaf.Subject.CommonName)
+
+	writeCertificate(t, certFile, keyFile, "second")
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	require.NoError(t, os.Chtimes(keyFile, later, later))
+
+	// The files are only checked once the check interval has passed
+	certificate, err = reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "first", certificate.Leaf.Subject.CommonName)
+
+	reloader.lastCheck = time.Time{}
+	certificate, err = reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "second", certificate.Leaf.Subject.CommonName)
+
+	// The previous certificate is kept if the files are invalid
+	require.NoError(t, os.WriteFile(keyFile, []byte("invalid"), 0600))
+	evenLater := later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(keyFile, evenLater, evenLater))
+
+	reloader.lastCheck = time.Time{}
+	certificate, err = reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "second", certificate.Leaf.Subject.CommonName)
+
+	_, err = NewCertificateReloader(certFile, keyFile)
+	assert.Error(t, err)
+}
@@ -0,0 +1,389 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AlexGustafsson/grapevine/internal/envelope"
+)
+
+const (
+	DefaultMinBackoff = 5 * time.Second
+	DefaultMaxBackoff = 1 * time.Hour
+)
+
+// Delivery is a push message awaiting delivery to a single subscription.
+type Delivery struct {
+	ID             string    `json:"id"`
+	Topic          string    `json:"topic"`
+	SubscriptionID string    `json:"subscriptionId"`
+	Content        []byte    `json:"content"`
+	ContentType    string    `json:"contentType,omitempty"`
+	Urgency        string    `json:"urgency,omitempty"`
+	PushTopic      string    `json:"pushTopic,omitempty"`
+	Created        time.Time `json:"created"`
+	// Expires is the time at which the message's TTL has passed and delivery is
+	// no longer attempted.
+	Expires     time.Time `json:"expires"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+}
+
+// TTL returns the remaining time to live of the delivery, in seconds.
+func (d *Delivery) TTL(now time.Time) int64 {
+	return max(int64(d.Expires.Sub(now)/time.Second), 0)
+}
+
+// RetryError is returned by a [Handler] to signal that a delivery failed, but
+// that retrying it may succeed. Any other error is considered permanent.
+type RetryError struct {
+	Err error
+	// After is the minimum duration to wait before retrying, if any.
+	After time.Duration
+}
+
+func (e *RetryError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// Handler delivers a push message.
+type Handler func(context.Context, *Delivery) error
+
+// Queue is a persistent queue of push messages to retry.
+// Each delivery is stored as a separate file in the queue's directory, allowing
+// the queue to survive restarts.
+type Queue struct {
+	// MinBackoff is the backoff used after the first failed retry. Defaults to
+	// [DefaultMinBackoff].
+	MinBackoff time.Duration
+	// MaxBackoff is the maximum backoff between retries. Defaults to
+	// [DefaultMaxBackoff].
+	MaxBackoff time.Duration
+
+	mutex      sync.Mutex
+	path       string
+	keyring    *envelope.Keyring
+	deliveries map[string]*Delivery
+	wake       chan struct{}
+}
+
+// Open opens the queue stored in path, creating it if it does not exist.
+// If keyring is set, deliveries are encrypted at rest. Deliveries in plaintext
+// or sealed with a previous master key are immediately resealed using the
+// primary master key.
+func Open(path string, keyring *envelope.Keyring) (*Queue, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		path:       path,
+		keyring:    keyring,
+		deliveries: make(map[string]*Delivery),
+		wake:       make(chan struct{}, 1),
+	}
+
+	reseal := make([]*Delivery, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		delivery, resealDelivery, err := q.read(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		q.deliveries[delivery.ID] = delivery
+		if resealDelivery {
+			reseal = append(reseal, delivery)
+		}
+	}
+
+	if len(reseal) > 0 {
+		slog.Info("Encrypting delivery queue using the primary master key", slog.String("keyId", keyring.Primary().ID()), slog.Int("deliveries", len(reseal)))
+		for _, delivery := range reseal {
+			if err := q.write(delivery); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return q, nil
+}
+
+// Len returns the number of queued deliveries.
+func (q *Queue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.deliveries)
+}
+
+// Enqueue persists a delivery to be attempted at its next attempt time.
+// If the delivery has no id, a random id is assigned. If the delivery has no
+// next attempt time, it is scheduled using the queue's backoff.
+func (q *Queue) Enqueue(delivery *Delivery) error {
+	if delivery.ID == "" {
+		delivery.ID = rand.Text()
+	}
+
+	if delivery.NextAttempt.IsZero() {
+		delivery.NextAttempt = time.Now().Add(q.backoff(delivery.Attempts))
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if err := q.write(delivery); err != nil {
+		return err
+	}
+
+	q.deliveries[delivery.ID] = delivery
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Run attempts deliveries as they become due, using handler, until ctx is
+// cancelled. Once cancelled, Run returns after any in-flight attempt is done.
+func (q *Queue) Run(ctx context.Context, handler Handler) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-q.wake:
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		for _, delivery := range q.due(now) {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			// Let in-flight attempts complete when ctx is cancelled, so that
+			// shutting down drains rather than aborts deliveries
+			q.attempt(context.WithoutCancel(ctx), handler, delivery)
+		}
+
+		timer.Reset(q.untilNext(time.Now()))
+	}
+}
+
+// due returns all deliveries that should be attempted at now.
+func (q *Queue) due(now time.Time) []*Delivery {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	due := make([]*Delivery, 0)
+	for _, delivery := range q.deliveries {
+		if !delivery.NextAttempt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+
+	return due
+}
+
+// untilNext returns the duration until the next delivery is due.
+func (q *Queue) untilNext(now time.Time) time.Duration {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// Wake up periodically even if the queue is empty, as a safeguard
+	next := q.maxBackoff()
+	for _, delivery := range q.deliveries {
+		next = min(next, delivery.NextAttempt.Sub(now))
+	}
+
+	return max(next, 0)
+}
+
+func (q *Queue) attempt(ctx context.Context, handler Handler, delivery *Delivery) {
+	log := slog.With(slog.String("delivery", delivery.ID), slog.String("topic", delivery.Topic), slog.String("subscription", delivery.SubscriptionID))
+
+	now := time.Now()
+	if !now.Before(delivery.Expires) {
+		log.Warn("Dropping expired delivery", slog.Int("attempts", delivery.Attempts))
+		q.remove(delivery)
+		return
+	}
+
+	err := handler(ctx, delivery)
+	delivery.Attempts++
+	if err == nil {
+		log.Info("Delivered queued push message", slog.Int("attempts", delivery.Attempts))
+		q.remove(delivery)
+		return
+	}
+
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) {
+		log.Error("Failed to deliver queued push message, giving up", slog.Any("error", err), slog.Int("attempts", delivery.Attempts))
+		q.remove(delivery)
+		return
+	}
+
+	delay := max(q.backoff(delivery.Attempts), retryErr.After)
+	now = time.Now()
+	if !now.Add(delay).Before(delivery.Expires) {
+		log.Error("Failed to deliver queued push message before it expired, giving up", slog.Any("error", err), slog.Int("attempts", delivery.Attempts))
+		q.remove(delivery)
+		return
+	}
+
+	log.Warn("Failed to deliver queued push message, retrying", slog.Any("error", err), slog.Int("attempts", delivery.Attempts), slog.Duration("delay", delay))
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	delivery.NextAttempt = now.Add(delay)
+	if err := q.write(delivery); err != nil {
+		log.Error("Failed to persist delivery", slog.Any("error", err))
+	}
+}
+
+// backoff returns an exponential backoff with jitter for the given number of
+// attempts.
+func (q *Queue) backoff(attempts int) time.Duration {
+	backoff := q.maxBackoff()
+	if attempts < 20 {
+		backoff = min(q.minBackoff()<<max(attempts-1, 0), backoff)
+	}
+
+	// Equal jitter: wait at least half the backoff
+	return backoff/2 + mathrand.N(backoff/2+1)
+}
+
+func (q *Queue) minBackoff() time.Duration {
+	if q.MinBackoff > 0 {
+		return q.MinBackoff
+	}
+
+	return DefaultMinBackoff
+}
+
+func (q *Queue) maxBackoff() time.Duration {
+	if q.MaxBackoff > 0 {
+		return q.MaxBackoff
+	}
+
+	return DefaultMaxBackoff
+}
+
+func (q *Queue) remove(delivery *Delivery) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	delete(q.deliveries, delivery.ID)
+	err := os.Remove(q.filePath(delivery.ID))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Failed to remove delivery", slog.String("delivery", delivery.ID), slog.Any("error", err))
+	}
+}
+
+func (q *Queue) filePath(id string) string {
+	return filepath.Join(q.path, id+".json")
+}
+
+// read reads the delivery stored in the file name, opening it using the
+// keyring if it's sealed. Returns true if the delivery should be resealed
+// using the primary master key, as it's in plaintext or sealed using a
+// previous master key.
+func (q *Queue) read(name string) (*Delivery, bool, error) {
+	content, err := os.ReadFile(filepath.Join(q.path, name))
+	if err != nil {
+		return nil, false, err
+	}
+
+	reseal := false
+	if envelope.IsSealed(content) {
+		if q.keyring == nil {
+			return nil, false, fmt.Errorf("delivery %s is encrypted, but no master key is configured", name)
+		}
+
+		var keyID string
+		content, keyID, err = q.keyring.Open(content, []byte(name))
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to decrypt delivery %s: %w", name, err)
+		}
+
+		reseal = keyID != q.keyring.Primary().ID()
+	} else if q.keyring != nil {
+		reseal = true
+	}
+
+	var delivery Delivery
+	if err := json.Unmarshal(content, &delivery); err != nil {
+		return nil, false, fmt.Errorf("invalid delivery %s: %w", name, err)
+	}
+
+	return &delivery, reseal, nil
+}
+
+// write persists a delivery, sealing it using the keyring if configured. The
+// delivery is written to a temporary file which is then renamed, so that a
+// delivery is never partially written.
+func (q *Queue) write(delivery *Delivery) error {
+	content, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	path := q.filePath(delivery.ID)
+	if q.keyring != nil {
+		content, err = q.keyring.Seal(content, []byte(filepath.Base(path)))
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := os.CreateTemp(q.path, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
@@ -0,0 +1,179 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AlexGustafsson/grapevine/internal/envelope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueuePersistence(t *testing.T) {
+	path := t.TempDir()
+
+	queue, err := Open(path, nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+	err = queue.Enqueue(&Delivery{
+		Topic:          "default",
+		SubscriptionID: "subscription",
+		Content:        []byte("content"),
+		Created:        now,
+		Expires:        now.Add(time.Hour),
+		NextAttempt:    now.Add(time.Minute),
+	})
+	require.NoError(t, err)
+
+	reopened, err := Open(path, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, reopened.Len())
+
+	for _, delivery := range reopened.deliveries {
+		assert.Equal(t, "default", delivery.Topic)
+		assert.Equal(t, "subscription", delivery.SubscriptionID)
+		assert.Equal(t, []byte("content"), delivery.Content)
+	}
+}
+
+func TestQueueEncryption(t *testing.T) {
+	path := t.TempDir()
+
+	previousKey, err := envelope.NewKey(bytes.Repeat([]byte{1}, envelope.KeySize))
+	require.NoError(t, err)
+
+	primaryKey, err := envelope.NewKey(bytes.Repeat([]byte{2}, envelope.KeySize))
+	require.NoError(t, err)
+
+	assertSealedWith := func(t *testing.T, key *envelope.Key) {
+		entries, err := os.ReadDir(path)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+
+		data, err := os.ReadFile(filepath.Join(path, entries[0].Name()))
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "subscription")
+
+		_, keyID, err := envelope.NewKeyring(key).Open(data, []byte(entries[0].Name()))
+		require.NoError(t, err)
+		assert.Equal(t, key.ID(), keyID)
+	}
+
+	// Write a plaintext delivery
+	queue, err := Open(path, nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+	err = queue.Enqueue(&Delivery{
+		Topic:          "default",
+		SubscriptionID: "subscription",
+		Content:        []byte("content"),
+		Created:        now,
+		Expires:        now.Add(time.Hour),
+		NextAttempt:    now.Add(time.Minute),
+	})
+	require.NoError(t, err)
+
+	// Plaintext deliveries are transparently encrypted
+	_, err = Open(path, envelope.NewKeyring(previousKey))
+	require.NoError(t, err)
+	assertSealedWith(t, previousKey)
+
+	_, err = Open(path, nil)
+	assert.Error(t, err)
+
+	// Rotating the master key re-encrypts the deliveries
+	_, err = Open(path, envelope.NewKeyring(primaryKey, previousKey))
+	require.NoError(t, err)
+	assertSealedWith(t, primaryKey)
+
+	reopened, err := Open(path, envelope.NewKeyring(primaryKey))
+	require.NoError(t, err)
+	require.Equal(t, 1, reopened.Len())
+
+	for _, delivery := range reopened.deliveries {
+		assert.Equal(t, "subscription", delivery.SubscriptionID)
+		assert.Equal(t, []byte("content"), delivery.Content)
+	}
+}
+func TestQueueRun(t *testing.T) {
+	queue, err := Open(t.TempDir(), nil)
+	require.NoError(t, err)
+
+	queue.MinBackoff = time.Millisecond
+	queue.MaxBackoff = time.Millisecond
+
+	now := time.Now()
+	require.NoError(t, queue.Enqueue(&Delivery{
+		Created:     now,
+		Expires:     now.Add(time.Hour),
+		NextAttempt: now,
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	attempts := 0
+	queue.Run(ctx, func(ctx context.Context, d *Delivery) error {
+		attempts++
+		if attempts < 3 {
+			return &RetryError{Err: errors.New("temporary")}
+		}
+
+		cancel()
+		return nil
+	})
+
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, 0, queue.Len())
+}
+
+func TestQueueRunPermanentError(t *testing.T) {
+	queue, err := Open(t.TempDir(), nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+	require.NoError(t, queue.Enqueue(&Delivery{
+		Created:     now,
+		Expires:     now.Add(time.Hour),
+		NextAttempt: now,
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	queue.Run(ctx, func(ctx context.Context, d *Delivery) error {
+		cancel()
+		return errors.New("permanent")
+	})
+
+	assert.Equal(t, 0, queue.Len())
+}
+
+func TestQueueRunExpired(t *testing.T) {
+	queue, err := Open(t.TempDir(), nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+	require.NoError(t, queue.Enqueue(&Delivery{
+		Created:     now.Add(-2 * time.Hour),
+		Expires:     now.Add(-time.Hour),
+		NextAttempt: now,
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	queue.Run(ctx, func(ctx context.Context, d *Delivery) error {
+		t.Fatal("expired delivery was attempted")
+		return nil
+	})
+
+	assert.Equal(t, 0, queue.Len())
+}
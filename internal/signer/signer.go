@@ -0,0 +1,186 @@
+// Package signer provides VAPID signing keys, which may be kept outside of
+// Grapevine's memory and disk.
+//
+// Keys are referred to by URIs, whose scheme selects the [Provider] opening
+// them:
+//
+//   - file:///etc/grapevine/key.pem reads a PEM-encoded key from a file.
+//   - unix:///run/signer.sock?key=name uses a key held by an external signer
+//     process, listening on a Unix domain socket. See [Serve].
+//
+// No PKCS#11 provider is included. Keys in a PKCS#11 token, such as an HSM,
+// are used through an out-of-tree signer process that holds the key in the
+// token and implements the protocol of [SocketRequest] and [SocketResponse],
+// referred to by a unix:// URI. Other providers may be added using [Register].
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+)
+
+// Provider opens signing keys.
+type Provider interface {
+	// Open opens the key referred to by uri. The returned signer must produce
+	// ASN.1 DER encoded ECDSA signatures, like [ecdsa.PrivateKey.Sign].
+	Open(uri *url.URL) (crypto.Signer, error)
+}
+
+// ProviderFunc is a function implementing [Provider].
+type ProviderFunc func(uri *url.URL) (crypto.Signer, error)
+
+// Open implements Provider.
+func (f ProviderFunc) Open(uri *url.URL) (crypto.Signer, error) {
+	return f(uri)
+}
+
+var (
+	providersMutex sync.RWMutex
+	providers      = map[string]Provider{
+		"file": ProviderFunc(openFile),
+		"unix": ProviderFunc(openSocket),
+	}
+)
+
+// Register registers the provider of keys with URIs of the specified scheme,
+// replacing any provider already registered for it.
+func Register(scheme string, provider Provider) {
+	providersMutex.Lock()
+	defer providersMutex.Unlock()
+
+	providers[scheme] = provider
+}
+
+// provider returns the provider of keys with URIs of the specified scheme.
+func provider(scheme string) (Provider, bool) {
+	providersMutex.RLock()
+	defer providersMutex.RUnlock()
+
+	provider, ok := providers[scheme]
+	return provider, ok
+}
+
+// schemes returns the sorted schemes of the registered providers.
+func schemes() []string {
+	providersMutex.RLock()
+	defer providersMutex.RUnlock()
+
+	schemes := make([]string, 0, len(providers))
+	for scheme := range providers {
+		schemes = append(schemes, scheme)
+	}
+	slices.Sort(schemes)
+
+	return schemes
+}
+
+// ParseURI parses the URI of a key. Returns an error unless a provider is
+// registered for its scheme.
+func ParseURI(value string) (*url.URL, error) {
+	uri, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := provider(uri.Scheme); !ok {
+		return nil, fmt.Errorf("unsupported key URI %q - scheme must be one of %v - other keys, such as PKCS#11 keys, require a signer process behind a unix:// URI", value, schemes())
+	}
+
+	return uri, nil
+}
+
+// Open opens the key referred to by a URI.
+func Open(value string) (crypto.Signer, error) {
+	uri, err := ParseURI(value)
+	if err != nil {
+		return nil, err
+	}
+
+	provider, _ := provider(uri.Scheme)
+	return provider.Open(uri)
+}
+
+// openFile opens a PEM-encoded key stored in a file, referred to by a URI
+// such as file:///etc/grapevine/key.pem or file:key.pem.
+func openFile(uri *url.URL) (crypto.Signer, error) {
+	path := uri.Path
+	if uri.Opaque != "" {
+		path = uri.Opaque
+	}
+
+	if path == "" {
+		return nil, fmt.Errorf("invalid key URI %q - missing path", uri)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePEM(content)
+}
+
+// ParsePEM parses a PEM-encoded P-256 private key. Supported formats are:
+//
+//   - PKCS#8 (PRIVATE KEY).
+//   - SEC 1 (EC PRIVATE KEY), as written by OpenSSL. A preceding EC PARAMETERS
+//     block is ignored.
+//   - The raw key in a PRIVATE KEY block, as stored by Grapevine.
+func ParsePEM(data []byte) (*ecdsa.PrivateKey, error) {
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, fmt.Errorf("invalid PEM - no private key found")
+		}
+
+		switch block.Type {
+		case "EC PARAMETERS":
+			continue
+		case "EC PRIVATE KEY":
+			privateKey, err := x509.ParseECPrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SEC 1 key: %w", err)
+			}
+
+			return checkCurve(privateKey)
+		case "PRIVATE KEY":
+			// Grapevine stores the raw key in PEM blocks of this type
+			if len(block.Bytes) == 32 {
+				return ecdsa.ParseRawPrivateKey(elliptic.P256(), block.Bytes)
+			}
+
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid PKCS#8 key: %w", err)
+			}
+
+			privateKey, ok := key.(*ecdsa.PrivateKey)
+			if !ok {
+				return nil, fmt.Errorf("unsupported key type %T - must be an ECDSA key", key)
+			}
+
+			return checkCurve(privateKey)
+		default:
+			return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+		}
+	}
+}
+
+// checkCurve returns an error if privateKey isn't on the P-256 curve.
+func checkCurve(privateKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, error) {
+	if privateKey.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("unsupported curve %s - must be P-256", privateKey.Curve.Params().Name)
+	}
+
+	return privateKey, nil
+}
@@ -0,0 +1,78 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenFile(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	sec1, err := x509.MarshalECPrivateKey(privateKey)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}), 0600))
+
+	key, err := Open("file://" + path)
+	require.NoError(t, err)
+	assert.True(t, privateKey.PublicKey.Equal(key.Public()))
+
+	_, err = Open("file://" + filepath.Join(t.TempDir(), "missing.pem"))
+	assert.Error(t, err)
+
+	_, err = Open("pkcs11:token=grapevine")
+	assert.Error(t, err)
+}
+
+func TestOpenSocket(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "signer.sock")
+	listener, err := net.Listen("unix", path)
+	require.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		done <- Serve(listener, map[string]crypto.Signer{"default": privateKey})
+	}()
+
+	key, err := Open("unix://" + path + "?key=default")
+	require.NoError(t, err)
+	assert.True(t, privateKey.PublicKey.Equal(key.Public()))
+
+	digest := sha256.Sum256([]byte("message"))
+	signature, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	assert.True(t, ecdsa.VerifyASN1(&privateKey.PublicKey, digest[:], signature))
+
+	_, err = key.Sign(rand.Reader, digest[:16], crypto.SHA256)
+	assert.Error(t, err)
+
+	_, err = Open("unix://" + path + "?key=other")
+	assert.ErrorContains(t, err, "key not found")
+
+	_, err = Open("unix://" + path)
+	assert.Error(t, err)
+
+	require.NoError(t, listener.Close())
+	assert.NoError(t, <-done)
+
+	// The signer process is unavailable
+	_, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.Error(t, err)
+}
@@ -0,0 +1,230 @@
+package signer
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"time"
+)
+
+// SocketTimeout is the maximum time to wait for a signer process to respond.
+const SocketTimeout = 5 * time.Second
+
+// SocketRequest is a request to a signer process. Requests and responses are
+// exchanged as newline-delimited JSON over a Unix domain socket.
+//
+// The "publicKey" method returns the public key of the requested key. The
+// "sign" method signs a SHA-256 digest using the requested key.
+type SocketRequest struct {
+	Method string `json:"method"`
+	// Key is the name of the key to use.
+	Key string `json:"key"`
+	// Digest is the base64url encoded digest to sign.
+	Digest string `json:"digest,omitempty"`
+}
+
+// SocketResponse is a response of a signer process.
+type SocketResponse struct {
+	// PublicKey is the base64url encoded uncompressed public key, returned by
+	// the "publicKey" method.
+	PublicKey string `json:"publicKey,omitempty"`
+	// Signature is the base64url encoded ASN.1 DER signature, returned by the
+	// "sign" method.
+	Signature string `json:"signature,omitempty"`
+	// Error describes why the request failed, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// socketSigner signs using a key held by a signer process.
+type socketSigner struct {
+	path      string
+	key       string
+	publicKey *ecdsa.PublicKey
+}
+
+// openSocket opens a key held by a signer process, referred to by a URI such
+// as unix:///run/signer.sock?key=name.
+func openSocket(uri *url.URL) (crypto.Signer, error) {
+	if uri.Path == "" {
+		return nil, fmt.Errorf("invalid key URI %q - missing socket path", uri)
+	}
+
+	key := uri.Query().Get("key")
+	if key == "" {
+		return nil, fmt.Errorf("invalid key URI %q - missing key", uri)
+	}
+
+	signer := &socketSigner{
+		path: uri.Path,
+		key:  key,
+	}
+
+	// NOTE: The public key is fetched once, as crypto.Signer can't return
+	// errors from Public
+	response, err := signer.request(SocketRequest{Method: "publicKey", Key: key})
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(response.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key of key %s: %w", key, err)
+	}
+
+	signer.publicKey, err = ecdsa.ParseUncompressedPublicKey(elliptic.P256(), raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key of key %s: %w", key, err)
+	}
+
+	return signer, nil
+}
+
+// Public implements crypto.Signer.
+func (s *socketSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign implements crypto.Signer.
+func (s *socketSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 || len(digest) != 32 {
+		return nil, fmt.Errorf("unsupported digest - must be SHA-256")
+	}
+
+	response, err := s.request(SocketRequest{
+		Method: "sign",
+		Key:    s.key,
+		Digest: base64.RawURLEncoding.EncodeToString(digest),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(response.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+
+	// Don't send push messages that push services would reject
+	if !ecdsa.VerifyASN1(s.publicKey, digest, signature) {
+		return nil, fmt.Errorf("invalid signature of key %s", s.key)
+	}
+
+	return signature, nil
+}
+
+// request sends a request to the signer process.
+func (s *socketSigner) request(request SocketRequest) (*SocketResponse, error) {
+	conn, err := net.DialTimeout("unix", s.path, SocketTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to signer: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(SocketTimeout)); err != nil {
+		return nil, err
+	}
+
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return nil, fmt.Errorf("failed to send request to signer: %w", err)
+	}
+
+	var response SocketResponse
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to read response of signer: %w", err)
+	}
+
+	if response.Error != "" {
+		return nil, fmt.Errorf("signer failed: %s", response.Error)
+	}
+
+	return &response, nil
+}
+
+// Serve serves requests for keys on listener, acting as a signer process. It
+// returns when listener is closed. Keys are referred to by name and must be
+// P-256 keys.
+func Serve(listener net.Listener, keys map[string]crypto.Signer) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		go serveConn(conn, keys)
+	}
+}
+
+// serveConn serves requests of a connection until it's closed.
+func serveConn(conn net.Conn, keys map[string]crypto.Signer) {
+	defer conn.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(conn))
+	encoder := json.NewEncoder(conn)
+	for {
+		var request SocketRequest
+		if err := decoder.Decode(&request); err == io.EOF {
+			return
+		} else if err != nil {
+			encoder.Encode(SocketResponse{Error: "invalid request"})
+			return
+		}
+
+		response := handleRequest(request, keys)
+		if response.Error != "" {
+			slog.Warn("Rejected signer request", slog.String("method", request.Method), slog.String("key", request.Key), slog.String("error", response.Error))
+		}
+
+		if err := encoder.Encode(response); err != nil {
+			return
+		}
+	}
+}
+
+// handleRequest handles a request of a signer process.
+func handleRequest(request SocketRequest, keys map[string]crypto.Signer) SocketResponse {
+	key, ok := keys[request.Key]
+	if !ok {
+		return SocketResponse{Error: "key not found"}
+	}
+
+	switch request.Method {
+	case "publicKey":
+		publicKey, ok := key.Public().(*ecdsa.PublicKey)
+		if !ok {
+			return SocketResponse{Error: "unsupported key"}
+		}
+
+		raw, err := publicKey.Bytes()
+		if err != nil {
+			return SocketResponse{Error: "unsupported key"}
+		}
+
+		return SocketResponse{PublicKey: base64.RawURLEncoding.EncodeToString(raw)}
+	case "sign":
+		digest, err := base64.RawURLEncoding.DecodeString(request.Digest)
+		if err != nil || len(digest) != 32 {
+			return SocketResponse{Error: "invalid digest - must be a base64url encoded SHA-256 digest"}
+		}
+
+		signature, err := key.Sign(rand.Reader, digest, crypto.SHA256)
+		if err != nil {
+			return SocketResponse{Error: "failed to sign"}
+		}
+
+		return SocketResponse{Signature: base64.RawURLEncoding.EncodeToString(signature)}
+	default:
+		return SocketResponse{Error: fmt.Sprintf("unsupported method %q", request.Method)}
+	}
+}
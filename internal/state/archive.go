@@ -0,0 +1,59 @@
+package state
+
+import (
+	"errors"
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+)
+
+var ErrTopicNotArchived = errors.New("topic not archived")
+
+// PurgeTopic permanently deletes an archived topic along with its key and
+// subscriptions. Returns [ErrTopicNotArchived] if the topic isn't archived.
+func PurgeTopic(backend Backend, topic string) error {
+	archivedTopics, err := backend.ArchivedTopics()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := archivedTopics[topic]; !ok {
+		return ErrTopicNotArchived
+	}
+
+	if err := backend.DeletePrivateKey(topic); err != nil && err != ErrKeyNotFound {
+		return err
+	}
+
+	if err := backend.DeleteTopic(topic); err != nil {
+		return err
+	}
+
+	slog.Info("Purged archived topic", slog.String("topic", topic))
+	return nil
+}
+
+// PurgeArchivedTopics purges all topics archived before the specified time.
+// Returns the purged topics.
+func PurgeArchivedTopics(backend Backend, before time.Time) ([]string, error) {
+	archivedTopics, err := backend.ArchivedTopics()
+	if err != nil {
+		return nil, err
+	}
+
+	purged := make([]string, 0)
+	for _, topic := range slices.Sorted(maps.Keys(archivedTopics)) {
+		if !archivedTopics[topic].Before(before) {
+			continue
+		}
+
+		if err := PurgeTopic(backend, topic); err != nil {
+			return purged, err
+		}
+
+		purged = append(purged, topic)
+	}
+
+	return purged, nil
+}
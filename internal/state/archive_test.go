@@ -0,0 +1,79 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AlexGustafsson/grapevine/internal/webpush"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveAndRestoreTopic(t *testing.T) {
+	basePath := t.TempDir()
+	writeTestConfig(t, basePath, "default", "other")
+
+	backend, err := OpenJSONBackend(basePath, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, Migrate(basePath, backend))
+	require.NoError(t, backend.AddSubscription("other", "1", Subscription{Subscription: webpush.Subscription{Endpoint: "https://push.example.com/1"}}))
+
+	privateKey, err := backend.PrivateKey("other")
+	require.NoError(t, err)
+
+	// Removing the topic archives it
+	writeTestConfig(t, basePath, "default")
+	require.NoError(t, Migrate(basePath, backend))
+
+	archivedTopics, err := backend.ArchivedTopics()
+	require.NoError(t, err)
+	assert.Contains(t, archivedTopics, "other")
+
+	store, err := Load(basePath, backend, testOptions)
+	require.NoError(t, err)
+	_, ok := store.Client("other")
+	assert.False(t, ok)
+
+	// Re-adding the topic restores its key and subscriptions
+	writeTestConfig(t, basePath, "default", "other")
+	require.NoError(t, Migrate(basePath, backend))
+
+	archivedTopics, err = backend.ArchivedTopics()
+	require.NoError(t, err)
+	assert.Empty(t, archivedTopics)
+
+	restoredPrivateKey, err := backend.PrivateKey("other")
+	require.NoError(t, err)
+	assert.Equal(t, privateKey, restoredPrivateKey)
+
+	_, err = backend.GetSubscription("other", "1")
+	assert.NoError(t, err)
+}
+
+func TestPurgeArchivedTopics(t *testing.T) {
+	backend, err := OpenSQLiteBackend(t.TempDir())
+	require.NoError(t, err)
+	defer backend.Close()
+
+	now := time.Now()
+	for topic, archivedAt := range map[string]time.Time{"old": now.Add(-48 * time.Hour), "new": now} {
+		require.NoError(t, backend.CreateTopic(topic))
+		require.NoError(t, backend.SetPrivateKey(topic, "key"))
+		require.NoError(t, backend.ArchiveTopic(topic, archivedAt))
+	}
+	require.NoError(t, backend.CreateTopic("active"))
+
+	assert.Equal(t, ErrTopicNotArchived, PurgeTopic(backend, "active"))
+
+	purged, err := PurgeArchivedTopics(backend, now.Add(-24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old"}, purged)
+
+	topics, err := backend.Topics()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"active", "new"}, topics)
+
+	_, err = backend.PrivateKey("old")
+	assert.Equal(t, ErrKeyNotFound, err)
+}
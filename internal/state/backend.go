@@ -0,0 +1,231 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/AlexGustafsson/grapevine/internal/envelope"
+)
+
+var ErrKeyNotFound = errors.New("key not found")
+
+// Backend persists topics, keys, subscriptions and metadata.
+// Implementations must be safe for concurrent use.
+type Backend interface {
+	// Topics returns the ids of all topics.
+	Topics() ([]string, error)
+	// CreateTopic creates a topic. It's a no-op if the topic already exists.
+	CreateTopic(topic string) error
+	// DeleteTopic deletes a topic and its subscriptions. Returns
+	// [ErrTopicNotFound] if the topic doesn't exist.
+	DeleteTopic(topic string) error
+	// ArchiveTopic marks a topic as archived at the specified time. Returns
+	// [ErrTopicNotFound] if the topic doesn't exist.
+	ArchiveTopic(topic string, archivedAt time.Time) error
+	// RestoreTopic unmarks an archived topic. It's a no-op if the topic isn't
+	// archived. Returns [ErrTopicNotFound] if the topic doesn't exist.
+	RestoreTopic(topic string) error
+	// ArchivedTopics returns the archived topics and when they were archived.
+	ArchivedTopics() (map[string]time.Time, error)
+
+	// TopicConfigs returns the configuration of topics created at runtime,
+	// rather than in config.json.
+	TopicConfigs() (map[string]Topic, error)
+	// SetTopicConfig sets the configuration of a topic created at runtime.
+	// Returns [ErrTopicNotFound] if the topic doesn't exist.
+	SetTopicConfig(topic string, config Topic) error
+	// DeleteTopicConfig deletes the configuration of a topic created at
+	// runtime. Returns [ErrTopicNotFound] if the topic has no configuration.
+	DeleteTopicConfig(topic string) error
+
+	// PrivateKeys returns the PEM-encoded private keys of all topics.
+	PrivateKeys() (map[string]string, error)
+	// PrivateKey returns the PEM-encoded private key of a topic. Returns
+	// [ErrKeyNotFound] if the topic has no key.
+	PrivateKey(topic string) (string, error)
+	// SetPrivateKey sets the PEM-encoded private key of a topic.
+	SetPrivateKey(topic string, privateKey string) error
+	// DeletePrivateKey deletes the private key of a topic. Returns
+	// [ErrKeyNotFound] if the topic has no key.
+	DeletePrivateKey(topic string) error
+	// PreviousKeys returns the rotated keys of a topic, keyed by their id.
+	// Returns [ErrTopicNotFound] if the topic doesn't exist.
+	PreviousKeys(topic string) (map[string]PreviousKey, error)
+	// SetPreviousKey adds or replaces a rotated key of a topic. Returns
+	// [ErrTopicNotFound] if the topic doesn't exist.
+	SetPreviousKey(topic string, keyID string, key PreviousKey) error
+	// DeletePreviousKey deletes a rotated key of a topic. Returns
+	// [ErrKeyNotFound] if the topic has no such key.
+	DeletePreviousKey(topic string, keyID string) error
+
+	// AddSubscription adds or replaces a subscription. Returns
+	// [ErrTopicNotFound] if the topic doesn't exist.
+	AddSubscription(topic string, id string, subscription Subscription) error
+	// MergeSubscription adds a subscription, or updates an existing one in a
+	// single atomic step, keeping its creation time, its label unless a new one
+	// is specified and its delivery metadata. See [mergeSubscription]. Returns
+	// [ErrTopicNotFound] if the topic doesn't exist.
+	MergeSubscription(topic string, id string, subscription Subscription) error
+	// GetSubscription returns a subscription. Returns [ErrTopicNotFound] or
+	// [ErrSubscriptionNotFound] if the topic or subscription doesn't exist.
+	GetSubscription(topic string, id string) (Subscription, error)
+	// DeleteSubscription deletes a subscription. Returns [ErrTopicNotFound] or
+	// [ErrSubscriptionNotFound] if the topic or subscription doesn't exist.
+	DeleteSubscription(topic string, id string) error
+	// GetSubscriptions returns all subscriptions of a topic, keyed by their id.
+	// Returns [ErrTopicNotFound] if the topic doesn't exist.
+	GetSubscriptions(topic string) (map[string]Subscription, error)
+	// RecordDelivery records the outcome of a delivery to a subscription,
+	// updating its last delivery time or consecutive failure count. Returns
+	// [ErrTopicNotFound] or [ErrSubscriptionNotFound] if the topic or
+	// subscription doesn't exist.
+	RecordDelivery(topic string, id string, delivered bool, at time.Time) error
+
+	// Metadata returns all metadata.
+	Metadata() (map[string]string, error)
+	// GetMetadata returns a metadata value, and whether or not it exists.
+	GetMetadata(key string) (string, bool, error)
+	// SetMetadata sets a metadata value.
+	SetMetadata(key string, value string) error
+
+	// Backup writes a consistent copy of the backend's state to the existing
+	// directory dir, in the backend's own format.
+	Backup(dir string) error
+
+	// Close closes the backend, persisting any pending changes.
+	Close() error
+}
+
+type BackendKind string
+
+const (
+	// BackendJSON stores state in JSON files. It keeps all state in memory and
+	// rewrites the files when modified. Suitable for small installations.
+	BackendJSON BackendKind = "json"
+	// BackendSQLite stores state in an embedded SQLite database.
+	BackendSQLite BackendKind = "sqlite"
+)
+
+// BackendOptions are options for opening a backend.
+type BackendOptions struct {
+	// Keyring, if set, encrypts secrets and subscriptions at rest. Only
+	// supported by [BackendJSON], as [BackendSQLite] would store keys and
+	// subscriptions in plaintext columns.
+	Keyring *envelope.Keyring
+	// ReadOnly opens the backend for reading only, such as when exporting the
+	// state of a running Grapevine server. Modifications are never saved.
+	ReadOnly bool
+}
+
+// OpenBackend opens the backend of the specified kind, stored in basePath.
+func OpenBackend(kind BackendKind, basePath string, options BackendOptions) (Backend, error) {
+	switch kind {
+	case BackendJSON:
+		return openJSONBackend(basePath, options.Keyring, options.ReadOnly)
+	case BackendSQLite:
+		if options.Keyring != nil {
+			return nil, fmt.Errorf("encryption at rest is not supported by the %s backend - use the %s backend or don't configure a master key", kind, BackendJSON)
+		}
+		return openSQLiteBackend(basePath, options.ReadOnly)
+	default:
+		return nil, fmt.Errorf("unsupported backend %q", kind)
+	}
+}
+
+// Copy copies all topics, archived topics, topic configurations, keys,
+// rotated keys, subscriptions and metadata from src to dst.
+// Existing state in dst is overwritten, but not removed.
+func Copy(dst Backend, src Backend) error {
+	if err := checkBackendSchema(src); err != nil {
+		return err
+	}
+
+	if err := checkBackendSchema(dst); err != nil {
+		return err
+	}
+
+	topics, err := src.Topics()
+	if err != nil {
+		return err
+	}
+
+	slices.Sort(topics)
+	for _, topic := range topics {
+		if err := dst.CreateTopic(topic); err != nil {
+			return err
+		}
+
+		subscriptions, err := src.GetSubscriptions(topic)
+		if err != nil {
+			return err
+		}
+
+		for id, subscription := range subscriptions {
+			if err := dst.AddSubscription(topic, id, subscription); err != nil {
+				return err
+			}
+		}
+
+		previousKeys, err := src.PreviousKeys(topic)
+		if err != nil {
+			return err
+		}
+
+		for keyID, key := range previousKeys {
+			if err := dst.SetPreviousKey(topic, keyID, key); err != nil {
+				return err
+			}
+		}
+
+		slog.Info("Copied topic", slog.String("topic", topic), slog.Int("subscriptions", len(subscriptions)))
+	}
+
+	archivedTopics, err := src.ArchivedTopics()
+	if err != nil {
+		return err
+	}
+
+	for topic, archivedAt := range archivedTopics {
+		if err := dst.ArchiveTopic(topic, archivedAt); err != nil {
+			return err
+		}
+	}
+
+	topicConfigs, err := src.TopicConfigs()
+	if err != nil {
+		return err
+	}
+
+	for topic, config := range topicConfigs {
+		if err := dst.SetTopicConfig(topic, config); err != nil {
+			return err
+		}
+	}
+
+	privateKeys, err := src.PrivateKeys()
+	if err != nil {
+		return err
+	}
+
+	for topic, privateKey := range privateKeys {
+		if err := dst.SetPrivateKey(topic, privateKey); err != nil {
+			return err
+		}
+	}
+
+	metadata, err := src.Metadata()
+	if err != nil {
+		return err
+	}
+
+	for key, value := range metadata {
+		if err := dst.SetMetadata(key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
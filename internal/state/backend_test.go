@@ -0,0 +1,295 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AlexGustafsson/grapevine/internal/webpush"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackends(t *testing.T) {
+	testCases := []struct {
+		Kind BackendKind
+	}{
+		{Kind: BackendJSON},
+		{Kind: BackendSQLite},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(string(testCase.Kind), func(t *testing.T) {
+			basePath := t.TempDir()
+
+			backend, err := OpenBackend(testCase.Kind, basePath, BackendOptions{})
+			require.NoError(t, err)
+
+			require.NoError(t, backend.CreateTopic("default"))
+			// Creating an existing topic is a no-op
+			require.NoError(t, backend.CreateTopic("default"))
+
+			topics, err := backend.Topics()
+			require.NoError(t, err)
+			assert.Equal(t, []string{"default"}, topics)
+
+			_, err = backend.PrivateKey("default")
+			assert.Equal(t, ErrKeyNotFound, err)
+
+			require.NoError(t, backend.SetPrivateKey("default", "key"))
+			privateKey, err := backend.PrivateKey("default")
+			require.NoError(t, err)
+			assert.Equal(t, "key", privateKey)
+
+			// NOTE: Times are stored with millisecond precision
+			now := time.UnixMilli(time.Now().UnixMilli())
+			subscription := Subscription{
+				Subscription: webpush.Subscription{
+					Endpoint:       "https://push.example.com/1",
+					ExpirationTime: &webpush.Timestamp{Time: now},
+				},
+				Created:   now,
+				Updated:   now,
+				UserAgent: "Mozilla/5.0",
+				Label:     "Phone",
+			}
+			subscription.Keys.Auth = "auth"
+			subscription.Keys.P256DH = "p256dh"
+			subscription.KeyID = "0123456789abcdef"
+
+			assert.Equal(t, ErrTopicNotFound, backend.AddSubscription("other", "1", subscription))
+			require.NoError(t, backend.AddSubscription("default", "1", subscription))
+
+			actual, err := backend.GetSubscription("default", "1")
+			require.NoError(t, err)
+			assert.Equal(t, normalizeSubscription(subscription), normalizeSubscription(actual))
+
+			require.NoError(t, backend.RecordDelivery("default", "1", false, now))
+			require.NoError(t, backend.RecordDelivery("default", "1", false, now))
+			actual, err = backend.GetSubscription("default", "1")
+			require.NoError(t, err)
+			assert.Equal(t, 2, actual.Failures)
+			assert.Nil(t, actual.LastDelivered)
+
+			require.NoError(t, backend.RecordDelivery("default", "1", true, now))
+			actual, err = backend.GetSubscription("default", "1")
+			require.NoError(t, err)
+			assert.Equal(t, 0, actual.Failures)
+			assert.True(t, now.Equal(*actual.LastDelivered))
+
+			assert.Equal(t, ErrSubscriptionNotFound, backend.RecordDelivery("default", "2", true, now))
+
+			// Merging keeps the creation time, label and delivery metadata
+			later := now.Add(time.Hour)
+			merged := subscription
+			merged.Keys.Auth = "auth2"
+			merged.Created = later
+			merged.Updated = later
+			merged.Label = ""
+			assert.Equal(t, ErrTopicNotFound, backend.MergeSubscription("other", "1", merged))
+			require.NoError(t, backend.MergeSubscription("default", "1", merged))
+			actual, err = backend.GetSubscription("default", "1")
+			require.NoError(t, err)
+			assert.Equal(t, "auth2", actual.Keys.Auth)
+			assert.True(t, now.Equal(actual.Created))
+			assert.True(t, later.Equal(actual.Updated))
+			assert.Equal(t, "Phone", actual.Label)
+			assert.True(t, now.Equal(*actual.LastDelivered))
+
+			merged.Label = "Tablet"
+			require.NoError(t, backend.MergeSubscription("default", "1", merged))
+			actual, err = backend.GetSubscription("default", "1")
+			require.NoError(t, err)
+			assert.Equal(t, "Tablet", actual.Label)
+
+			subscriptions, err := backend.GetSubscriptions("default")
+			require.NoError(t, err)
+			assert.Len(t, subscriptions, 1)
+
+			_, err = backend.GetSubscription("default", "2")
+			assert.Equal(t, ErrSubscriptionNotFound, err)
+
+			assert.Equal(t, ErrTopicNotFound, backend.SetTopicConfig("other", Topic{Name: "Other"}))
+			require.NoError(t, backend.SetTopicConfig("default", Topic{Name: "Default"}))
+			topicConfigs, err := backend.TopicConfigs()
+			require.NoError(t, err)
+			assert.Equal(t, map[string]Topic{"default": {Name: "Default"}}, topicConfigs)
+
+			previousKey := PreviousKey{PrivateKey: "previous", RetireAt: now}
+			assert.Equal(t, ErrTopicNotFound, backend.SetPreviousKey("other", "1", previousKey))
+			require.NoError(t, backend.SetPreviousKey("default", "1", previousKey))
+			previousKeys, err := backend.PreviousKeys("default")
+			require.NoError(t, err)
+			require.Len(t, previousKeys, 1)
+			assert.Equal(t, "previous", previousKeys["1"].PrivateKey)
+			assert.True(t, now.Equal(previousKeys["1"].RetireAt))
+
+			require.NoError(t, backend.SetMetadata("key", "value"))
+			value, ok, err := backend.GetMetadata("key")
+			require.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, "value", value)
+
+			// State is persisted when closed
+			require.NoError(t, backend.Close())
+			backend, err = OpenBackend(testCase.Kind, basePath, BackendOptions{})
+			require.NoError(t, err)
+			defer backend.Close()
+
+			_, err = backend.GetSubscription("default", "1")
+			require.NoError(t, err)
+
+			require.NoError(t, backend.DeleteSubscription("default", "1"))
+			assert.Equal(t, ErrSubscriptionNotFound, backend.DeleteSubscription("default", "1"))
+
+			require.NoError(t, backend.DeleteTopicConfig("default"))
+			assert.Equal(t, ErrTopicNotFound, backend.DeleteTopicConfig("default"))
+
+			previousKeys, err = backend.PreviousKeys("default")
+			require.NoError(t, err)
+			assert.Len(t, previousKeys, 1)
+
+			require.NoError(t, backend.DeletePreviousKey("default", "1"))
+			assert.Equal(t, ErrKeyNotFound, backend.DeletePreviousKey("default", "1"))
+
+			require.NoError(t, backend.AddSubscription("default", "1", subscription))
+			require.NoError(t, backend.DeleteTopic("default"))
+			_, err = backend.GetSubscriptions("default")
+			assert.Equal(t, ErrTopicNotFound, err)
+
+			require.NoError(t, backend.DeletePrivateKey("default"))
+			assert.Equal(t, ErrKeyNotFound, backend.DeletePrivateKey("default"))
+		})
+	}
+}
+
+// normalizeSubscription returns subscription with all times in UTC, allowing
+// subscriptions to be compared regardless of how their times were decoded.
+func normalizeSubscription(subscription Subscription) Subscription {
+	if subscription.ExpirationTime != nil {
+		subscription.ExpirationTime = &webpush.Timestamp{Time: subscription.ExpirationTime.UTC()}
+	}
+
+	if subscription.LastDelivered != nil {
+		lastDelivered := subscription.LastDelivered.UTC()
+		subscription.LastDelivered = &lastDelivered
+	}
+
+	subscription.Created = subscription.Created.UTC()
+	subscription.Updated = subscription.Updated.UTC()
+	return subscription
+}
+
+func TestCopy(t *testing.T) {
+	src, err := OpenJSONBackend(t.TempDir(), nil)
+	require.NoError(t, err)
+
+	require.NoError(t, src.CreateTopic("default"))
+	require.NoError(t, src.SetPrivateKey("default", "key"))
+	require.NoError(t, src.SetPreviousKey("default", "1", PreviousKey{PrivateKey: "previous"}))
+	require.NoError(t, src.AddSubscription("default", "1", Subscription{Subscription: webpush.Subscription{Endpoint: "https://push.example.com/1"}}))
+	require.NoError(t, src.SetMetadata("key", "value"))
+
+	dst, err := OpenSQLiteBackend(t.TempDir())
+	require.NoError(t, err)
+	defer dst.Close()
+
+	require.NoError(t, Copy(dst, src))
+
+	subscription, err := dst.GetSubscription("default", "1")
+	require.NoError(t, err)
+	assert.Equal(t, "https://push.example.com/1", subscription.Endpoint)
+
+	privateKey, err := dst.PrivateKey("default")
+	require.NoError(t, err)
+	assert.Equal(t, "key", privateKey)
+
+	previousKeys, err := dst.PreviousKeys("default")
+	require.NoError(t, err)
+	assert.Equal(t, "previous", previousKeys["1"].PrivateKey)
+
+	metadata, err := dst.Metadata()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"key": "value"}, metadata)
+}
+
+func TestSQLiteReadsDuringWrite(t *testing.T) {
+	backend, err := OpenSQLiteBackend(t.TempDir())
+	require.NoError(t, err)
+	defer backend.Close()
+
+	require.NoError(t, backend.CreateTopic("default"))
+	require.NoError(t, backend.SetPreviousKey("default", "1", PreviousKey{PrivateKey: "previous"}))
+	require.NoError(t, backend.AddSubscription("default", "1", Subscription{Subscription: webpush.Subscription{Endpoint: "https://push.example.com/1"}}))
+
+	// Hold the write lock
+	tx, err := backend.db.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	// Reads don't wait for the write lock
+	_, err = backend.GetSubscription("default", "1")
+	assert.NoError(t, err)
+
+	subscriptions, err := backend.GetSubscriptions("default")
+	assert.NoError(t, err)
+	assert.Len(t, subscriptions, 1)
+
+	previousKeys, err := backend.PreviousKeys("default")
+	assert.NoError(t, err)
+	assert.Len(t, previousKeys, 1)
+}
+
+func TestOpenBackendReadOnly(t *testing.T) {
+	for _, kind := range []BackendKind{BackendJSON, BackendSQLite} {
+		t.Run(string(kind), func(t *testing.T) {
+			basePath := t.TempDir()
+
+			backend, err := OpenBackend(kind, basePath, BackendOptions{})
+			require.NoError(t, err)
+			require.NoError(t, backend.CreateTopic("default"))
+			require.NoError(t, backend.SetPrivateKey("default", "key"))
+			require.NoError(t, backend.Close())
+
+			readOnly, err := OpenBackend(kind, basePath, BackendOptions{ReadOnly: true})
+			require.NoError(t, err)
+
+			privateKey, err := readOnly.PrivateKey("default")
+			require.NoError(t, err)
+			assert.Equal(t, "key", privateKey)
+
+			// Modifications are never saved
+			readOnly.SetPrivateKey("default", "other")
+			require.NoError(t, readOnly.Close())
+
+			backend, err = OpenBackend(kind, basePath, BackendOptions{})
+			require.NoError(t, err)
+			defer backend.Close()
+
+			privateKey, err = backend.PrivateKey("default")
+			require.NoError(t, err)
+			assert.Equal(t, "key", privateKey)
+		})
+	}
+}
+
+func TestJSONBackendLock(t *testing.T) {
+	basePath := t.TempDir()
+
+	backend, err := OpenJSONBackend(basePath, nil)
+	require.NoError(t, err)
+
+	// The state is only opened by a single process at a time
+	_, err = OpenJSONBackend(basePath, nil)
+	assert.Equal(t, ErrStateLocked, err)
+
+	// But may be read while opened
+	readOnly, err := OpenBackend(BackendJSON, basePath, BackendOptions{ReadOnly: true})
+	require.NoError(t, err)
+	require.NoError(t, readOnly.Close())
+
+	require.NoError(t, backend.Close())
+
+	backend, err = OpenJSONBackend(basePath, nil)
+	require.NoError(t, err)
+	require.NoError(t, backend.Close())
+}
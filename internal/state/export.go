@@ -0,0 +1,678 @@
+package state
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/AlexGustafsson/grapevine/internal/envelope"
+)
+
+// ArchiveVersion is the version of the archive format written by [Export].
+const ArchiveVersion = 1
+
+// maxArchiveEntrySize is the maximum size of a file in an archive.
+const maxArchiveEntrySize = 256 << 20
+
+var (
+	// ErrPassphraseRequired is returned when importing an encrypted archive
+	// without a passphrase.
+	ErrPassphraseRequired = errors.New("archive is encrypted, but no passphrase was specified")
+	// ErrInvalidPassphrase is returned when importing an encrypted archive using
+	// the wrong passphrase.
+	ErrInvalidPassphrase = errors.New("invalid passphrase")
+	ErrInvalidArchive    = errors.New("invalid archive")
+	// ErrImportConflict is returned when merging an archive with topics that
+	// can't be merged with the existing topics.
+	ErrImportConflict = errors.New("import conflict")
+)
+
+// ArchiveManifest describes an archive written by [Export].
+type ArchiveManifest struct {
+	Version       int       `json:"version"`
+	SchemaVersion int       `json:"schemaVersion"`
+	Created       time.Time `json:"created"`
+	// Encryption is the algorithm state.json is encrypted with, if any.
+	Encryption string `json:"encryption,omitempty"`
+	// Salt is the salt used to derive the encryption key from the passphrase.
+	Salt []byte `json:"salt,omitempty"`
+}
+
+// Snapshot is a portable snapshot of a backend's state, independent of the
+// kind of backend.
+type Snapshot struct {
+	Topics   map[string]SnapshotTopic `json:"topics"`
+	Metadata map[string]string        `json:"metadata"`
+}
+
+// SnapshotTopic is the state of a single topic.
+type SnapshotTopic struct {
+	PrivateKey string `json:"privateKey,omitempty"`
+	// PreviousKeys are the rotated keys of the topic, keyed by their id.
+	PreviousKeys map[string]PreviousKey `json:"previousKeys,omitempty"`
+	// Config is the configuration of a topic created at runtime.
+	Config *Topic `json:"config,omitempty"`
+	// ArchivedAt is the time the topic was archived, if archived.
+	ArchivedAt    *time.Time              `json:"archivedAt,omitempty"`
+	Subscriptions map[string]Subscription `json:"subscriptions"`
+}
+
+// ExportOptions are options for [Export].
+type ExportOptions struct {
+	// Passphrase, if set, encrypts the keys and subscriptions of the archive.
+	Passphrase string
+}
+
+// Export writes a consistent snapshot of config.json and the backend's state,
+// including keys and subscriptions, to w as a gzipped tar archive. The archive
+// can be imported using [Import], into any kind of backend.
+func Export(w io.Writer, basePath string, backend Backend, options ExportOptions) error {
+	snapshot, err := snapshotBackend(basePath, backend)
+	if err != nil {
+		return fmt.Errorf("failed to snapshot state: %w", err)
+	}
+
+	config, err := os.ReadFile(filepath.Join(basePath, "config.json"))
+	if err != nil {
+		return err
+	}
+
+	schemaVersion, err := strconv.Atoi(snapshot.Metadata[schemaVersionKey])
+	if err != nil && snapshot.Metadata[schemaVersionKey] != "" {
+		return fmt.Errorf("invalid schema version: %w", err)
+	}
+
+	manifest := ArchiveManifest{
+		Version:       ArchiveVersion,
+		SchemaVersion: schemaVersion,
+		Created:       time.Now().UTC(),
+	}
+
+	state, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if options.Passphrase != "" {
+		manifest.Encryption = envelope.Algorithm
+		manifest.Salt = make([]byte, 16)
+		if _, err := rand.Read(manifest.Salt); err != nil {
+			return err
+		}
+
+		keyring, err := archiveKeyring(options.Passphrase, manifest.Salt)
+		if err != nil {
+			return err
+		}
+
+		state, err = keyring.Seal(state, []byte("state.json"))
+		if err != nil {
+			return err
+		}
+	}
+
+	manifestJSON, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	files := []struct {
+		Name    string
+		Content []byte
+	}{
+		// NOTE: The manifest is written first, so that it can be validated before
+		// reading the rest of the archive
+		{Name: "manifest.json", Content: manifestJSON},
+		{Name: "config.json", Content: config},
+		{Name: "state.json", Content: state},
+	}
+
+	for _, file := range files {
+		err := tarWriter.WriteHeader(&tar.Header{
+			Name:    file.Name,
+			Mode:    0600,
+			Size:    int64(len(file.Content)),
+			ModTime: manifest.Created,
+		})
+		if err != nil {
+			return err
+		}
+
+		if _, err := tarWriter.Write(file.Content); err != nil {
+			return err
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+
+	return gzipWriter.Close()
+}
+
+// snapshotBackend returns a consistent snapshot of the backend's state. The
+// backend is backed up to a temporary directory, from which the snapshot is
+// read, as reading the backend directly could observe concurrent
+// modifications.
+func snapshotBackend(basePath string, backend Backend) (*Snapshot, error) {
+	backup, closeBackup, err := openBackup(basePath, backend)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBackup()
+
+	// NOTE: The backup is migrated, so that backends that have yet to be
+	// migrated can be exported
+	if migrator, ok := backup.(schemaMigrator); ok {
+		if err := migrator.migrateSchema(); err != nil {
+			return nil, err
+		}
+	}
+
+	return readSnapshot(backup)
+}
+
+// openBackup backs up the backend to a new temporary directory in basePath
+// and opens the backup. The returned function closes the backup and removes
+// the directory.
+func openBackup(basePath string, backend Backend) (Backend, func(), error) {
+	// NOTE: The directory is created in basePath rather than in the system's
+	// temporary directory, as the backup may contain unencrypted keys
+	dir, err := os.MkdirTemp(basePath, ".backup-*")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := backend.Backup(dir); err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+
+	var backup Backend
+	switch backend := backend.(type) {
+	case *JSONBackend:
+		backup, err = OpenJSONBackend(dir, backend.keyring)
+	case *SQLiteBackend:
+		backup, err = OpenSQLiteBackend(dir)
+	default:
+		err = fmt.Errorf("unsupported backend %T", backend)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+
+	return backup, func() {
+		backup.Close()
+		os.RemoveAll(dir)
+	}, nil
+}
+
+// readSnapshot reads a snapshot of the backend's state.
+func readSnapshot(backend Backend) (*Snapshot, error) {
+	topics, err := backend.Topics()
+	if err != nil {
+		return nil, err
+	}
+
+	archivedTopics, err := backend.ArchivedTopics()
+	if err != nil {
+		return nil, err
+	}
+
+	topicConfigs, err := backend.TopicConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	privateKeys, err := backend.PrivateKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := backend.Metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{
+		Topics:   make(map[string]SnapshotTopic),
+		Metadata: metadata,
+	}
+
+	for _, topic := range topics {
+		subscriptions, err := backend.GetSubscriptions(topic)
+		if err != nil {
+			return nil, err
+		}
+
+		previousKeys, err := backend.PreviousKeys(topic)
+		if err != nil {
+			return nil, err
+		}
+
+		snapshotTopic := SnapshotTopic{
+			PrivateKey:    privateKeys[topic],
+			Subscriptions: subscriptions,
+		}
+
+		if len(previousKeys) > 0 {
+			snapshotTopic.PreviousKeys = previousKeys
+		}
+
+		if config, ok := topicConfigs[topic]; ok {
+			snapshotTopic.Config = &config
+		}
+
+		if archivedAt, ok := archivedTopics[topic]; ok {
+			snapshotTopic.ArchivedAt = &archivedAt
+		}
+
+		snapshot.Topics[topic] = snapshotTopic
+	}
+
+	// NOTE: Topics removed before archival was introduced have keys, but no
+	// topic
+	for topic, privateKey := range privateKeys {
+		if _, ok := snapshot.Topics[topic]; !ok {
+			snapshot.Topics[topic] = SnapshotTopic{
+				PrivateKey:    privateKey,
+				Subscriptions: make(map[string]Subscription),
+			}
+		}
+	}
+
+	return snapshot, nil
+}
+
+// ImportMode determines how imported state is combined with existing state.
+type ImportMode string
+
+const (
+	// ImportMerge adds the imported topics and subscriptions to the existing
+	// state. Imported subscriptions replace existing subscriptions with the same
+	// id. Topics in both states must have the same key.
+	ImportMerge ImportMode = "merge"
+	// ImportReplace replaces the existing state and config.json with the
+	// imported state.
+	ImportReplace ImportMode = "replace"
+)
+
+// ImportOptions are options for [Import].
+type ImportOptions struct {
+	Mode ImportMode
+	// Passphrase is the passphrase the archive was encrypted with, if any.
+	Passphrase string
+}
+
+// saveHolder is implemented by backends saving modifications in the
+// background, such as [JSONBackend].
+type saveHolder interface {
+	// holdSaves prevents the backend from being saved until the returned
+	// function is called.
+	holdSaves() (release func())
+}
+
+// Import imports an archive written by [Export]. The existing state is backed
+// up to the backups directory before being modified. The imported state is
+// migrated to [SchemaVersion] and reconciled with config.json. See [Migrate].
+func Import(r io.Reader, basePath string, backend Backend, options ImportOptions) error {
+	if options.Mode != ImportMerge && options.Mode != ImportReplace {
+		return fmt.Errorf("unsupported import mode %q", options.Mode)
+	}
+
+	manifest, config, snapshot, err := readArchive(r, options.Passphrase)
+	if err != nil {
+		return err
+	}
+
+	return importArchive(basePath, backend, manifest, config, snapshot, options.Mode)
+}
+
+// importArchive imports an archive read by [readArchive]. See [Import].
+func importArchive(basePath string, backend Backend, manifest *ArchiveManifest, config *ConfigFile, snapshot *Snapshot, mode ImportMode) error {
+	var currentConfig ConfigFile
+	if err := readJSON(filepath.Join(basePath, "config.json"), &currentConfig); err != nil {
+		return err
+	}
+
+	if mode == ImportMerge {
+		if err := checkMergeConflicts(backend, snapshot); err != nil {
+			return err
+		}
+	}
+
+	plan, err := PlanMigration(basePath, backend)
+	if err != nil {
+		return err
+	}
+
+	if !plan.empty {
+		path, err := backup(basePath, backend, plan.FromVersion)
+		if err != nil {
+			return fmt.Errorf("failed to back up state: %w", err)
+		}
+
+		slog.Info("Backed up state before importing", slog.String("path", path))
+	}
+
+	if err := migrateBackendSchema(backend, plan); err != nil {
+		return err
+	}
+
+	// NOTE: Partially imported state is never saved in the background
+	if holder, ok := backend.(saveHolder); ok {
+		release := holder.holdSaves()
+		defer release()
+	}
+
+	configModified := false
+	switch mode {
+	case ImportReplace:
+		if err := clearBackend(backend); err != nil {
+			return err
+		}
+
+		for key, value := range snapshot.Metadata {
+			if err := backend.SetMetadata(key, value); err != nil {
+				return err
+			}
+		}
+
+		// NOTE: The imported state is migrated below
+		if err := backend.SetMetadata(schemaVersionKey, strconv.Itoa(manifest.SchemaVersion)); err != nil {
+			return err
+		}
+
+		currentConfig = *config
+		configModified = true
+	case ImportMerge:
+		// Add topics missing from config.json
+		for topic, topicConfig := range config.Topics {
+			if _, ok := currentConfig.Topics[topic]; !ok {
+				if currentConfig.Topics == nil {
+					currentConfig.Topics = make(map[string]Topic)
+				}
+				currentConfig.Topics[topic] = topicConfig
+				configModified = true
+			}
+		}
+	}
+
+	if err := importSnapshot(backend, snapshot, &currentConfig); err != nil {
+		return err
+	}
+
+	if configModified {
+		if err := writeJSON(filepath.Join(basePath, "config.json"), &currentConfig); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Imported state", slog.String("mode", string(mode)), slog.Int("topics", len(snapshot.Topics)))
+	return Migrate(basePath, backend)
+}
+
+// Export writes a consistent snapshot of the store's state to w. See [Export].
+func (s *Store) Export(w io.Writer, options ExportOptions) error {
+	return Export(w, s.basePath, s.backend, options)
+}
+
+// Import imports an archive written by [Export] and reloads the store. See
+// [Import]. The archive is read before the store is locked. Other operations
+// on the store then wait until the archive is applied, so that they never
+// observe partially imported state.
+func (s *Store) Import(r io.Reader, options ImportOptions) error {
+	if options.Mode != ImportMerge && options.Mode != ImportReplace {
+		return fmt.Errorf("unsupported import mode %q", options.Mode)
+	}
+
+	// NOTE: The archive is read and validated before the store is locked, so
+	// that a slow upload doesn't block the store
+	manifest, config, snapshot, err := readArchive(r, options.Passphrase)
+	if err != nil {
+		return err
+	}
+
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	importErr := importArchive(s.basePath, s.backend, manifest, config, snapshot, options.Mode)
+
+	// NOTE: The state may have been partially imported on failure
+	if err := s.reloadStoreLocked(); err != nil {
+		return errors.Join(importErr, err)
+	}
+
+	return importErr
+}
+
+// readArchive reads an archive written by [Export].
+func readArchive(r io.Reader, passphrase string) (*ArchiveManifest, *ConfigFile, *Snapshot, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+	}
+	defer gzipReader.Close()
+
+	files := make(map[string][]byte)
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, nil, fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+		}
+
+		if header.Size > maxArchiveEntrySize {
+			return nil, nil, nil, fmt.Errorf("%w: %s is too large", ErrInvalidArchive, header.Name)
+		}
+
+		content, err := io.ReadAll(tarReader)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+		}
+
+		files[header.Name] = content
+	}
+
+	for _, name := range []string{"manifest.json", "config.json", "state.json"} {
+		if _, ok := files[name]; !ok {
+			return nil, nil, nil, fmt.Errorf("%w: missing %s", ErrInvalidArchive, name)
+		}
+	}
+
+	var manifest ArchiveManifest
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: invalid manifest: %w", ErrInvalidArchive, err)
+	}
+
+	if manifest.Version != ArchiveVersion {
+		return nil, nil, nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidArchive, manifest.Version)
+	}
+
+	if manifest.SchemaVersion > SchemaVersion {
+		return nil, nil, nil, fmt.Errorf("%w: archive has version %d, but only versions up to %d are supported, upgrade Grapevine", ErrUnsupportedSchemaVersion, manifest.SchemaVersion, SchemaVersion)
+	}
+
+	var config ConfigFile
+	if err := json.Unmarshal(files["config.json"], &config); err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: invalid config.json: %w", ErrInvalidArchive, err)
+	}
+
+	state := files["state.json"]
+	if manifest.Encryption != "" {
+		if manifest.Encryption != envelope.Algorithm {
+			return nil, nil, nil, fmt.Errorf("%w: unsupported encryption %q", ErrInvalidArchive, manifest.Encryption)
+		}
+
+		if passphrase == "" {
+			return nil, nil, nil, ErrPassphraseRequired
+		}
+
+		keyring, err := archiveKeyring(passphrase, manifest.Salt)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		state, _, err = keyring.Open(state, []byte("state.json"))
+		if err == envelope.ErrUnknownKey {
+			return nil, nil, nil, ErrInvalidPassphrase
+		} else if err != nil {
+			return nil, nil, nil, fmt.Errorf("%w: failed to decrypt state.json: %w", ErrInvalidArchive, err)
+		}
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(state, &snapshot); err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: invalid state.json: %w", ErrInvalidArchive, err)
+	}
+
+	return &manifest, &config, &snapshot, nil
+}
+
+// archiveKeyring returns the keyring encrypting archives using passphrase.
+func archiveKeyring(passphrase string, salt []byte) (*envelope.Keyring, error) {
+	key, err := envelope.DeriveKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return envelope.NewKeyring(key), nil
+}
+
+// checkMergeConflicts returns an error if any topic exists with different keys
+// in the backend and the snapshot, as subscriptions are bound to the key.
+func checkMergeConflicts(backend Backend, snapshot *Snapshot) error {
+	privateKeys, err := backend.PrivateKeys()
+	if err != nil {
+		return err
+	}
+
+	for _, topic := range slices.Sorted(maps.Keys(snapshot.Topics)) {
+		privateKey, ok := privateKeys[topic]
+		if ok && snapshot.Topics[topic].PrivateKey != "" && privateKey != snapshot.Topics[topic].PrivateKey {
+			return fmt.Errorf("%w: topic %s has a different key than the imported topic, import it using the replace mode or purge it first", ErrImportConflict, topic)
+		}
+	}
+
+	return nil
+}
+
+// clearBackend deletes all topics and keys of the backend.
+func clearBackend(backend Backend) error {
+	topics, err := backend.Topics()
+	if err != nil {
+		return err
+	}
+
+	for _, topic := range topics {
+		if err := backend.DeleteTopic(topic); err != nil {
+			return err
+		}
+	}
+
+	privateKeys, err := backend.PrivateKeys()
+	if err != nil {
+		return err
+	}
+
+	for topic := range privateKeys {
+		if err := backend.DeletePrivateKey(topic); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// importSnapshot adds the snapshot's topics, keys, rotated keys and
+// subscriptions to the backend. Topics in config are never archived or
+// configured as created at runtime.
+func importSnapshot(backend Backend, snapshot *Snapshot, config *ConfigFile) error {
+	existingTopics, err := backend.Topics()
+	if err != nil {
+		return err
+	}
+
+	for _, topic := range slices.Sorted(maps.Keys(snapshot.Topics)) {
+		snapshotTopic := snapshot.Topics[topic]
+		_, inConfig := config.Topics[topic]
+		exists := slices.Contains(existingTopics, topic)
+
+		if err := backend.CreateTopic(topic); err != nil {
+			return err
+		}
+
+		// NOTE: Subscriptions exported before keys could be rotated were made
+		// with the topic's only key
+		var currentKeyID string
+		if snapshotTopic.PrivateKey != "" {
+			privateKey, err := parsePrivateKey(snapshotTopic.PrivateKey)
+			if err != nil {
+				return fmt.Errorf("%w: invalid key of topic %s: %w", ErrInvalidArchive, topic, err)
+			}
+			currentKeyID, err = keyID(&privateKey.PublicKey)
+			if err != nil {
+				return fmt.Errorf("%w: invalid key of topic %s: %w", ErrInvalidArchive, topic, err)
+			}
+
+			if err := backend.SetPrivateKey(topic, snapshotTopic.PrivateKey); err != nil {
+				return err
+			}
+		}
+
+		for keyID, key := range snapshotTopic.PreviousKeys {
+			if err := backend.SetPreviousKey(topic, keyID, key); err != nil {
+				return err
+			}
+		}
+
+		if snapshotTopic.Config != nil && !inConfig {
+			if err := backend.SetTopicConfig(topic, *snapshotTopic.Config); err != nil {
+				return err
+			}
+		}
+
+		// Don't archive topics that are in use
+		if snapshotTopic.ArchivedAt != nil && !inConfig && !exists {
+			if err := backend.ArchiveTopic(topic, *snapshotTopic.ArchivedAt); err != nil {
+				return err
+			}
+		} else if snapshotTopic.ArchivedAt == nil {
+			if err := backend.RestoreTopic(topic); err != nil {
+				return err
+			}
+		}
+
+		for id, subscription := range snapshotTopic.Subscriptions {
+			if subscription.KeyID == "" {
+				subscription.KeyID = currentKeyID
+			}
+
+			if err := backend.AddSubscription(topic, id, subscription); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
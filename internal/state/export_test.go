@@ -0,0 +1,179 @@
+package state
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AlexGustafsson/grapevine/internal/webpush"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	store := newTestStore(t)
+
+	_, err := store.CreateTopic("alerts", Topic{Name: "Alerts"})
+	require.NoError(t, err)
+	require.NoError(t, store.AddSubscription("default", "1", Subscription{Subscription: webpush.Subscription{Endpoint: "https://push.example.com/1"}}))
+
+	var archive bytes.Buffer
+	require.NoError(t, store.Export(&archive, ExportOptions{Passphrase: "passphrase"}))
+
+	basePath := t.TempDir()
+	writeTestConfig(t, basePath, "other")
+
+	backend, err := OpenSQLiteBackend(basePath)
+	require.NoError(t, err)
+	defer backend.Close()
+	require.NoError(t, Migrate(basePath, backend))
+
+	err = Import(bytes.NewReader(archive.Bytes()), basePath, backend, ImportOptions{Mode: ImportReplace})
+	assert.Equal(t, ErrPassphraseRequired, err)
+
+	err = Import(bytes.NewReader(archive.Bytes()), basePath, backend, ImportOptions{Mode: ImportReplace, Passphrase: "wrong"})
+	assert.Equal(t, ErrInvalidPassphrase, err)
+
+	require.NoError(t, Import(bytes.NewReader(archive.Bytes()), basePath, backend, ImportOptions{Mode: ImportReplace, Passphrase: "passphrase"}))
+
+	imported, err := Load(basePath, backend, testOptions)
+	require.NoError(t, err)
+
+	// Keys are kept, so that existing subscriptions keep working
+	for _, topic := range []string{"default", "alerts"} {
+		expected, ok := store.Client(topic)
+		require.True(t, ok)
+
+		actual, ok := imported.Client(topic)
+		require.True(t, ok)
+		assert.Equal(t, expected.ApplicationServerKey(), actual.ApplicationServerKey())
+		assert.Equal(t, expected.Source(), actual.Source())
+	}
+
+	_, err = imported.GetSubscription("default", "1")
+	assert.NoError(t, err)
+
+	// The replaced topic is gone
+	_, ok := imported.Client("other")
+	assert.False(t, ok)
+
+	// Topics with different keys can't be merged
+	other := newTestStore(t)
+	err = other.Import(bytes.NewReader(archive.Bytes()), ImportOptions{Mode: ImportMerge, Passphrase: "passphrase"})
+	assert.ErrorContains(t, err, "different key")
+}
+
+// pausingBackend pauses the first time a topic is deleted, until resumed.
+type pausingBackend struct {
+	Backend
+	once   sync.Once
+	paused chan struct{}
+	resume chan struct{}
+}
+
+func (b *pausingBackend) DeleteTopic(topic string) error {
+	err := b.Backend.DeleteTopic(topic)
+	b.once.Do(func() {
+		close(b.paused)
+		<-b.resume
+	})
+	return err
+}
+
+func TestStoreImportConcurrently(t *testing.T) {
+	basePath := t.TempDir()
+	writeTestConfig(t, basePath, "default")
+
+	jsonBackend, err := OpenJSONBackend(basePath, nil)
+	require.NoError(t, err)
+	require.NoError(t, Migrate(basePath, jsonBackend))
+
+	backend := &pausingBackend{
+		Backend: jsonBackend,
+		paused:  make(chan struct{}),
+		resume:  make(chan struct{}),
+	}
+
+	store, err := Load(basePath, backend, testOptions)
+	require.NoError(t, err)
+	require.NoError(t, store.AddSubscription("default", "1", Subscription{Subscription: webpush.Subscription{Endpoint: "https://push.example.com/1"}}))
+
+	var archive bytes.Buffer
+	require.NoError(t, Export(&archive, basePath, jsonBackend, ExportOptions{}))
+
+	imported := make(chan error)
+	go func() {
+		imported <- store.Import(bytes.NewReader(archive.Bytes()), ImportOptions{Mode: ImportReplace})
+	}()
+	<-backend.paused
+
+	// The topic has been deleted, but isn't observed until the import is done
+	read := make(chan error)
+	var subscriptions map[string]Subscription
+	go func() {
+		var err error
+		subscriptions, err = store.GetSubscriptions("default")
+		read <- err
+	}()
+
+	select {
+	case err := <-read:
+		t.Fatalf("observed partially imported state: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(backend.resume)
+	require.NoError(t, <-imported)
+	require.NoError(t, <-read)
+	assert.Contains(t, subscriptions, "1")
+}
+
+// readingReader signals when it's first read from.
+type readingReader struct {
+	io.Reader
+	reading chan struct{}
+	once    sync.Once
+}
+
+// Read implements io.Reader.
+func (r *readingReader) Read(p []byte) (int, error) {
+	r.once.Do(func() { close(r.reading) })
+	return r.Reader.Read(p)
+}
+
+func TestStoreImportReadsArchiveUnlocked(t *testing.T) {
+	store := newTestStore(t)
+	require.NoError(t, store.AddSubscription("default", "1", Subscription{Subscription: webpush.Subscription{Endpoint: "https://push.example.com/1"}}))
+
+	var archive bytes.Buffer
+	require.NoError(t, store.Export(&archive, ExportOptions{}))
+
+	// A slow upload
+	r, w := io.Pipe()
+	upload := &readingReader{Reader: r, reading: make(chan struct{})}
+	imported := make(chan error)
+	go func() {
+		imported <- store.Import(upload, ImportOptions{Mode: ImportMerge})
+	}()
+	<-upload.reading
+
+	read := make(chan error)
+	go func() {
+		_, err := store.GetSubscriptions("default")
+		read <- err
+	}()
+
+	select {
+	case err := <-read:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("store was locked while the archive was uploaded")
+	}
+
+	_, err := w.Write(archive.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, <-imported)
+}
@@ -0,0 +1,281 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/AlexGustafsson/grapevine/internal/signer"
+	"github.com/AlexGustafsson/grapevine/internal/webpush"
+)
+
+// ErrKeyMismatch is returned when an imported public key doesn't belong to the
+// imported private key.
+var ErrKeyMismatch = errors.New("public key doesn't match private key")
+
+// ParsePrivateKey parses a VAPID private key exported by another Web Push
+// server. Supported formats are:
+//
+//   - The raw base64url encoded private key, as used by web-push and
+//     pywebpush. Standard base64 and padding are also accepted.
+//   - A PEM-encoded PKCS#8 key (PRIVATE KEY).
+//   - A PEM-encoded SEC 1 key (EC PRIVATE KEY), as written by OpenSSL.
+//   - A PEM-encoded key as stored by Grapevine.
+//
+// The key must be on the P-256 curve.
+func ParsePrivateKey(data string) (*ecdsa.PrivateKey, error) {
+	data = strings.TrimSpace(data)
+
+	if !strings.HasPrefix(data, "-----BEGIN") {
+		raw, err := decodeBase64URL(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key - must be PEM or base64url encoded: %w", err)
+		}
+
+		return parseRawPrivateKey(raw)
+	}
+
+	return signer.ParsePEM([]byte(data))
+}
+
+// CheckPublicKey returns [ErrKeyMismatch] if the base64url encoded public key
+// doesn't belong to privateKey. Allows verifying that both halves of an
+// exported key pair were imported.
+func CheckPublicKey(privateKey *ecdsa.PrivateKey, publicKey string) error {
+	raw, err := decodeBase64URL(publicKey)
+	if err != nil {
+		return fmt.Errorf("invalid public key - must be base64url encoded: %w", err)
+	}
+
+	expected, err := publicKeyBytes(&privateKey.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(raw, expected) {
+		return ErrKeyMismatch
+	}
+
+	return nil
+}
+
+// parseRawPrivateKey parses a raw P-256 private key.
+func parseRawPrivateKey(raw []byte) (*ecdsa.PrivateKey, error) {
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("invalid key - must be 32 bytes, got %d", len(raw))
+	}
+
+	return ecdsa.ParseRawPrivateKey(elliptic.P256(), raw)
+}
+
+// decodeBase64URL decodes base64url, with or without padding. Standard base64
+// is also accepted, as other tools may use it.
+func decodeBase64URL(value string) ([]byte, error) {
+	value = strings.TrimRight(strings.TrimSpace(value), "=")
+	value = strings.NewReplacer("+", "-", "/", "_").Replace(value)
+	return base64.RawURLEncoding.DecodeString(value)
+}
+
+// SubscriptionID returns the id of a subscription, derived from its endpoint.
+func SubscriptionID(endpoint string) string {
+	digest := sha256.Sum256([]byte(endpoint))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// ImportedSubscription is a subscription exported by another Web Push server.
+// In JSON, it's either a PushSubscription or an object holding one in its
+// subscription field, as stored by web-push and pywebpush based servers. The
+// object may hold a label of the device.
+type ImportedSubscription struct {
+	webpush.Subscription
+	Label string
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *ImportedSubscription) UnmarshalJSON(data []byte) error {
+	var value struct {
+		webpush.Subscription
+		Label string `json:"label"`
+		// Wrapped is used by servers storing subscriptions alongside metadata
+		Wrapped *webpush.Subscription `json:"subscription"`
+	}
+
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	s.Subscription = value.Subscription
+	if value.Wrapped != nil {
+		s.Subscription = *value.Wrapped
+	}
+	s.Label = value.Label
+
+	return nil
+}
+
+// ParseSubscriptions parses subscriptions exported by another Web Push server,
+// either as a JSON array or as newline-delimited JSON.
+func ParseSubscriptions(r io.Reader) ([]ImportedSubscription, error) {
+	reader := bufio.NewReader(r)
+
+	// Skip leading whitespace to identify the format
+	for {
+		b, err := reader.Peek(1)
+		if err == io.EOF {
+			return []ImportedSubscription{}, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+
+		reader.Discard(1)
+	}
+
+	b, _ := reader.Peek(1)
+	decoder := json.NewDecoder(reader)
+	if b[0] == '[' {
+		var subscriptions []ImportedSubscription
+		if err := decoder.Decode(&subscriptions); err != nil {
+			return nil, fmt.Errorf("invalid subscriptions: %w", err)
+		}
+
+		return subscriptions, nil
+	}
+
+	subscriptions := make([]ImportedSubscription, 0)
+	for {
+		var subscription ImportedSubscription
+		err := decoder.Decode(&subscription)
+		if err == io.EOF {
+			return subscriptions, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid subscription %d: %w", len(subscriptions), err)
+		}
+
+		subscriptions = append(subscriptions, subscription)
+	}
+}
+
+// RejectedSubscription is an imported subscription that wasn't added.
+type RejectedSubscription struct {
+	// Index is the index of the subscription in the import.
+	Index    int
+	Endpoint string
+	Reason   string
+}
+
+// SubscriptionImportResult is the result of [Store.ImportSubscriptions].
+type SubscriptionImportResult struct {
+	// Imported is the number of added or updated subscriptions.
+	Imported int
+	// Rejected are the invalid subscriptions, which weren't added.
+	Rejected []RejectedSubscription
+}
+
+// ImportKey replaces the key of a topic with a key imported from another Web
+// Push server, so that its subscriptions can be imported without devices
+// having to re-subscribe. Like when rotating keys, the replaced key remains
+// valid for existing subscriptions for gracePeriod. See [Store.RotateKey].
+// Returns [ErrTopicNotFound] if the topic doesn't exist or
+// [ErrExternalKey] if its key is held by a key provider.
+func (s *Store) ImportKey(topicName string, privateKey *ecdsa.PrivateKey, gracePeriod time.Duration) (Client, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	client, ok := s.clients[topicName]
+	if !ok {
+		return Client{}, ErrTopicNotFound
+	}
+
+	if client.key != "" {
+		return Client{}, ErrExternalKey
+	}
+
+	newKeyID, err := keyID(&privateKey.PublicKey)
+	if err != nil {
+		return Client{}, err
+	}
+
+	if newKeyID == client.keyID {
+		return client, nil
+	}
+
+	client, err = s.replaceKey(client, privateKey, gracePeriod)
+	if err != nil {
+		return Client{}, err
+	}
+
+	slog.Info("Imported key", slog.String("topic", topicName), slog.String("keyId", client.keyID))
+	return client, nil
+}
+
+// ImportSubscriptions adds subscriptions imported from another Web Push
+// server to a topic. The subscriptions are made with the topic's current key,
+// so the key they were made with must be imported first. See
+// [Store.ImportKey]. Invalid and expired subscriptions are rejected, without
+// affecting the others. Returns [ErrTopicNotFound] if the topic doesn't exist.
+func (s *Store) ImportSubscriptions(topic string, subscriptions []ImportedSubscription) (*SubscriptionImportResult, error) {
+	if _, ok := s.Client(topic); !ok {
+		return nil, ErrTopicNotFound
+	}
+
+	result := &SubscriptionImportResult{
+		Rejected: make([]RejectedSubscription, 0),
+	}
+
+	now := time.Now()
+	for i, imported := range subscriptions {
+		subscription := imported.Subscription
+
+		// Other servers may store keys using standard base64 or padding
+		for _, value := range []*string{&subscription.Keys.P256DH, &subscription.Keys.Auth} {
+			if raw, err := decodeBase64URL(*value); err == nil {
+				*value = base64.RawURLEncoding.EncodeToString(raw)
+			}
+		}
+
+		reason := ""
+		if err := subscription.Validate(); err != nil {
+			reason = err.Error()
+		} else if subscription.Expired(now) {
+			reason = "subscription has expired"
+		} else if len(imported.Label) > 64 {
+			reason = "label must not exceed 64 characters"
+		}
+
+		if reason != "" {
+			result.Rejected = append(result.Rejected, RejectedSubscription{
+				Index:    i,
+				Endpoint: subscription.Endpoint,
+				Reason:   reason,
+			})
+			continue
+		}
+
+		err := s.AddSubscription(topic, SubscriptionID(subscription.Endpoint), Subscription{
+			Subscription: subscription,
+			Label:        imported.Label,
+		})
+		if err != nil {
+			return result, err
+		}
+
+		result.Imported++
+	}
+
+	slog.Info("Imported subscriptions", slog.String("topic", topic), slog.Int("imported", result.Imported), slog.Int("rejected", len(result.Rejected)))
+	return result, nil
+}
@@ -0,0 +1,198 @@
+package state
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePrivateKey(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	raw, err := privateKey.Bytes()
+	require.NoError(t, err)
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+
+	sec1, err := x509.MarshalECPrivateKey(privateKey)
+	require.NoError(t, err)
+
+	grapevine, err := encodePrivateKey(privateKey)
+	require.NoError(t, err)
+
+	otherCurve, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+
+	otherCurvePKCS8, err := x509.MarshalPKCS8PrivateKey(otherCurve)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		Name  string
+		Key   string
+		Valid bool
+	}{
+		{Name: "base64url", Key: base64.RawURLEncoding.EncodeToString(raw), Valid: true},
+		{Name: "padded base64", Key: base64.StdEncoding.EncodeToString(raw) + "\n", Valid: true},
+		{Name: "PKCS#8", Key: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})), Valid: true},
+		{Name: "SEC 1", Key: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1})), Valid: true},
+		{
+			Name:  "SEC 1 with parameters",
+			Key:   string(pem.EncodeToMemory(&pem.Block{Type: "EC PARAMETERS", Bytes: []byte{0x06, 0x08}})) + string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1})),
+			Valid: true,
+		},
+		{Name: "Grapevine", Key: grapevine, Valid: true},
+		{Name: "P-384", Key: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: otherCurvePKCS8}))},
+		{Name: "short", Key: base64.RawURLEncoding.EncodeToString(raw[:16])},
+		{Name: "invalid base64", Key: "not a key!"},
+		{Name: "public key PEM", Key: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkcs8}))},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			parsed, err := ParsePrivateKey(testCase.Key)
+			if testCase.Valid {
+				require.NoError(t, err)
+				assert.True(t, privateKey.Equal(parsed))
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestCheckPublicKey(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	publicKey, err := encodePublicKey(&privateKey.PublicKey)
+	require.NoError(t, err)
+	assert.NoError(t, CheckPublicKey(privateKey, publicKey))
+
+	otherPublicKey, err := encodePublicKey(&other.PublicKey)
+	require.NoError(t, err)
+	assert.Equal(t, ErrKeyMismatch, CheckPublicKey(privateKey, otherPublicKey))
+}
+
+func TestParseSubscriptions(t *testing.T) {
+	testCases := []struct {
+		Name      string
+		Input     string
+		Endpoints []string
+		Labels    []string
+	}{
+		{
+			Name:      "array",
+			Input:     `[{"endpoint":"https://push.example.com/1","keys":{"p256dh":"a","auth":"b"}},{"endpoint":"https://push.example.com/2"}]`,
+			Endpoints: []string{"https://push.example.com/1", "https://push.example.com/2"},
+			Labels:    []string{"", ""},
+		},
+		{
+			Name:      "newline-delimited",
+			Input:     "{\"endpoint\":\"https://push.example.com/1\"}\n{\"subscription\":{\"endpoint\":\"https://push.example.com/2\"},\"label\":\"Phone\"}\n",
+			Endpoints: []string{"https://push.example.com/1", "https://push.example.com/2"},
+			Labels:    []string{"", "Phone"},
+		},
+		{
+			Name:      "empty",
+			Input:     "  \n",
+			Endpoints: []string{},
+			Labels:    []string{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			subscriptions, err := ParseSubscriptions(strings.NewReader(testCase.Input))
+			require.NoError(t, err)
+
+			endpoints := make([]string, 0)
+			labels := make([]string, 0)
+			for _, subscription := range subscriptions {
+				endpoints = append(endpoints, subscription.Endpoint)
+				labels = append(labels, subscription.Label)
+			}
+
+			assert.Equal(t, testCase.Endpoints, endpoints)
+			assert.Equal(t, testCase.Labels, labels)
+		})
+	}
+
+	_, err := ParseSubscriptions(strings.NewReader(`[{"endpoint":`))
+	assert.Error(t, err)
+}
+
+func TestStoreImport(t *testing.T) {
+	store := newTestStore(t)
+
+	client, ok := store.Client("default")
+	require.True(t, ok)
+	generatedKeyID := client.KeyID()
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	client, err = store.ImportKey("default", privateKey, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, testKeyID(t, &privateKey.PublicKey), client.KeyID())
+	assert.Contains(t, client.PreviousKeys(), generatedKeyID)
+
+	// Importing the current key is a no-op
+	client, err = store.ImportKey("default", privateKey, time.Hour)
+	require.NoError(t, err)
+	assert.Len(t, client.PreviousKeys(), 1)
+
+	userAgentKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	p256dh := userAgentKey.PublicKey().Bytes()
+	offCurve := append([]byte(nil), p256dh...)
+	offCurve[len(offCurve)-1] ^= 1
+
+	auth := make([]byte, 16)
+	subscription := func(endpoint string, p256dh []byte, expirationTime string) string {
+		return fmt.Sprintf(`{"endpoint":%q,"expirationTime":%s,"keys":{"p256dh":%q,"auth":%q}}`, endpoint, expirationTime, base64.StdEncoding.EncodeToString(p256dh), base64.URLEncoding.EncodeToString(auth))
+	}
+
+	input := strings.Join([]string{
+		subscription("https://push.example.com/1", p256dh, "null"),
+		subscription("https://push.example.com/2", offCurve, "null"),
+		subscription("https://push.example.com/3", p256dh, "1"),
+	}, "\n")
+
+	subscriptions, err := ParseSubscriptions(strings.NewReader(input))
+	require.NoError(t, err)
+
+	result, err := store.ImportSubscriptions("default", subscriptions)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Imported)
+	require.Len(t, result.Rejected, 2)
+	assert.Equal(t, 1, result.Rejected[0].Index)
+	assert.Contains(t, result.Rejected[0].Reason, "p256dh")
+	assert.Equal(t, 2, result.Rejected[1].Index)
+
+	// Keys are normalized to base64url and the subscription is bound to the
+	// imported key
+	imported, err := store.GetSubscription("default", SubscriptionID("https://push.example.com/1"))
+	require.NoError(t, err)
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(p256dh), imported.Keys.P256DH)
+	assert.Equal(t, testKeyID(t, &privateKey.PublicKey), imported.KeyID)
+
+	_, err = store.ImportSubscriptions("other", subscriptions)
+	assert.Equal(t, ErrTopicNotFound, err)
+}
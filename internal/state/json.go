@@ -0,0 +1,825 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/AlexGustafsson/grapevine/internal/envelope"
+)
+
+// SaveDelay is the time the JSON backend waits after being modified before
+// saving, coalescing any further modifications into the same save.
+const SaveDelay = 1 * time.Second
+
+var _ Backend = (*JSONBackend)(nil)
+
+// ErrStateLocked is returned when opening the JSON backend while it's opened by
+// another process, such as a running Grapevine server.
+var ErrStateLocked = errors.New("state is in use by another process, stop Grapevine first")
+
+// ErrReadOnly is returned when saving a backend opened read-only.
+var ErrReadOnly = errors.New("backend is opened read-only")
+
+// JSONBackend is a [Backend] storing state in secrets.json, subscriptions.json,
+// topics.json and metadata.json. All state is kept in memory. Modifications
+// are saved by [JSONBackend.Run].
+//
+// As the state is kept in memory, only a single process may open the backend
+// at a time. See [ErrStateLocked].
+//
+// secrets.json and subscriptions.json are optionally encrypted at rest using
+// envelope encryption. topics.json and metadata.json are never encrypted.
+type JSONBackend struct {
+	mutex         sync.RWMutex
+	basePath      string
+	keyring       *envelope.Keyring
+	privateKeys   map[string]string
+	previousKeys  map[string]map[string]PreviousKey
+	subscriptions map[string]map[string]Subscription
+	archived      map[string]time.Time
+	topicConfigs  map[string]Topic
+	metadata      map[string]string
+
+	// saveMutex serializes saves.
+	saveMutex sync.Mutex
+	// modified is true if the backend has been modified since last saved.
+	modified bool
+	// modifiedCh is signalled when the backend is modified.
+	modifiedCh chan struct{}
+	// lock is the lock file of the state, held while the backend is open. Nil
+	// if opened read-only.
+	lock *os.File
+	// readOnly is true if modifications are never saved.
+	readOnly bool
+}
+
+// OpenJSONBackend opens the JSON backend stored in basePath. Files that don't
+// exist are treated as empty.
+//
+// If keyring is set, secrets.json and subscriptions.json are encrypted at rest.
+// Files in plaintext or sealed with a previous master key are immediately
+// re-encrypted using the primary master key.
+//
+// Returns [ErrStateLocked] if the backend is opened by another process.
+func OpenJSONBackend(basePath string, keyring *envelope.Keyring) (*JSONBackend, error) {
+	return openJSONBackend(basePath, keyring, false)
+}
+
+// openJSONBackend opens the JSON backend stored in basePath. If readOnly is
+// true, the backend may be opened while opened by another process, files are
+// never re-encrypted and modifications are never saved.
+func openJSONBackend(basePath string, keyring *envelope.Keyring, readOnly bool) (*JSONBackend, error) {
+	b := &JSONBackend{
+		basePath:   basePath,
+		keyring:    keyring,
+		modifiedCh: make(chan struct{}, 1),
+		readOnly:   readOnly,
+	}
+
+	if !readOnly {
+		lock, err := lockState(basePath)
+		if err != nil {
+			return nil, err
+		}
+
+		b.lock = lock
+	}
+
+	if err := b.load(); err != nil {
+		b.unlock()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// load reads the backend's files.
+func (b *JSONBackend) load() error {
+	var secrets SecretsFile
+	resealSecrets, err := b.readFile(b.basePath, "secrets.json", &secrets)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	var subscriptions SubscriptionsFile
+	resealSubscriptions, err := b.readFile(b.basePath, "subscriptions.json", &subscriptions)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	var topics TopicsFile
+	_, err = b.readFile(b.basePath, "topics.json", &topics)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	var metadata MetadataFile
+	_, err = b.readFile(b.basePath, "metadata.json", &metadata)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	b.privateKeys = make(map[string]string)
+	b.previousKeys = make(map[string]map[string]PreviousKey)
+	for topic, clientSecrets := range secrets.Clients {
+		if clientSecrets.PrivateKey != "" {
+			b.privateKeys[topic] = clientSecrets.PrivateKey
+		}
+
+		if len(clientSecrets.PreviousKeys) > 0 {
+			b.previousKeys[topic] = clientSecrets.PreviousKeys
+		}
+	}
+
+	if subscriptions.Topics == nil {
+		subscriptions.Topics = make(map[string]map[string]Subscription)
+	}
+
+	for topic, topicSubscriptions := range subscriptions.Topics {
+		if topicSubscriptions == nil {
+			subscriptions.Topics[topic] = make(map[string]Subscription)
+		}
+	}
+
+	if subscriptions.Archived == nil {
+		subscriptions.Archived = make(map[string]time.Time)
+	}
+
+	if topics.Topics == nil {
+		topics.Topics = make(map[string]Topic)
+	}
+
+	if metadata.Metadata == nil {
+		metadata.Metadata = make(map[string]string)
+	}
+
+	b.subscriptions = subscriptions.Topics
+	b.archived = subscriptions.Archived
+	b.topicConfigs = topics.Topics
+	b.metadata = metadata.Metadata
+
+	if (resealSecrets || resealSubscriptions) && !b.readOnly {
+		slog.Info("Encrypting state using the primary master key", slog.String("keyId", b.keyring.Primary().ID()))
+		if err := b.Save(); err != nil {
+			return fmt.Errorf("failed to encrypt state: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// unlock releases the lock file of the state, if held.
+func (b *JSONBackend) unlock() error {
+	b.mutex.Lock()
+	lock := b.lock
+	b.lock = nil
+	b.mutex.Unlock()
+
+	if lock == nil {
+		return nil
+	}
+
+	return lock.Close()
+}
+
+// Topics implements Backend.
+func (b *JSONBackend) Topics() ([]string, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return slices.Collect(maps.Keys(b.subscriptions)), nil
+}
+
+// CreateTopic implements Backend.
+func (b *JSONBackend) CreateTopic(topic string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.subscriptions[topic]; ok {
+		return nil
+	}
+
+	b.subscriptions[topic] = make(map[string]Subscription)
+	b.markModified()
+	return nil
+}
+
+// DeleteTopic implements Backend.
+func (b *JSONBackend) DeleteTopic(topic string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.subscriptions[topic]; !ok {
+		return ErrTopicNotFound
+	}
+
+	delete(b.subscriptions, topic)
+	delete(b.previousKeys, topic)
+	delete(b.archived, topic)
+	delete(b.topicConfigs, topic)
+	b.markModified()
+	return nil
+}
+
+// ArchiveTopic implements Backend.
+func (b *JSONBackend) ArchiveTopic(topic string, archivedAt time.Time) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.subscriptions[topic]; !ok {
+		return ErrTopicNotFound
+	}
+
+	b.archived[topic] = archivedAt
+	b.markModified()
+	return nil
+}
+
+// RestoreTopic implements Backend.
+func (b *JSONBackend) RestoreTopic(topic string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.subscriptions[topic]; !ok {
+		return ErrTopicNotFound
+	}
+
+	if _, ok := b.archived[topic]; !ok {
+		return nil
+	}
+
+	delete(b.archived, topic)
+	b.markModified()
+	return nil
+}
+
+// ArchivedTopics implements Backend.
+func (b *JSONBackend) ArchivedTopics() (map[string]time.Time, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return maps.Clone(b.archived), nil
+}
+
+// TopicConfigs implements Backend.
+func (b *JSONBackend) TopicConfigs() (map[string]Topic, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return maps.Clone(b.topicConfigs), nil
+}
+
+// SetTopicConfig implements Backend.
+func (b *JSONBackend) SetTopicConfig(topic string, config Topic) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.subscriptions[topic]; !ok {
+		return ErrTopicNotFound
+	}
+
+	b.topicConfigs[topic] = config
+	b.markModified()
+	return nil
+}
+
+// DeleteTopicConfig implements Backend.
+func (b *JSONBackend) DeleteTopicConfig(topic string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.topicConfigs[topic]; !ok {
+		return ErrTopicNotFound
+	}
+
+	delete(b.topicConfigs, topic)
+	b.markModified()
+	return nil
+}
+
+// PrivateKeys implements Backend.
+func (b *JSONBackend) PrivateKeys() (map[string]string, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return maps.Clone(b.privateKeys), nil
+}
+
+// PrivateKey implements Backend.
+func (b *JSONBackend) PrivateKey(topic string) (string, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	privateKey, ok := b.privateKeys[topic]
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+
+	return privateKey, nil
+}
+
+// SetPrivateKey implements Backend.
+func (b *JSONBackend) SetPrivateKey(topic string, privateKey string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.privateKeys[topic] = privateKey
+	b.markModified()
+	return nil
+}
+
+// DeletePrivateKey implements Backend.
+func (b *JSONBackend) DeletePrivateKey(topic string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.privateKeys[topic]; !ok {
+		return ErrKeyNotFound
+	}
+
+	delete(b.privateKeys, topic)
+	b.markModified()
+	return nil
+}
+
+// PreviousKeys implements Backend.
+func (b *JSONBackend) PreviousKeys(topic string) (map[string]PreviousKey, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if _, ok := b.subscriptions[topic]; !ok {
+		return nil, ErrTopicNotFound
+	}
+
+	previousKeys := maps.Clone(b.previousKeys[topic])
+	if previousKeys == nil {
+		previousKeys = make(map[string]PreviousKey)
+	}
+
+	return previousKeys, nil
+}
+
+// SetPreviousKey implements Backend.
+func (b *JSONBackend) SetPreviousKey(topic string, keyID string, key PreviousKey) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.subscriptions[topic]; !ok {
+		return ErrTopicNotFound
+	}
+
+	previousKeys, ok := b.previousKeys[topic]
+	if !ok {
+		previousKeys = make(map[string]PreviousKey)
+		b.previousKeys[topic] = previousKeys
+	}
+
+	previousKeys[keyID] = key
+	b.markModified()
+	return nil
+}
+
+// DeletePreviousKey implements Backend.
+func (b *JSONBackend) DeletePreviousKey(topic string, keyID string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.previousKeys[topic][keyID]; !ok {
+		return ErrKeyNotFound
+	}
+
+	delete(b.previousKeys[topic], keyID)
+	if len(b.previousKeys[topic]) == 0 {
+		delete(b.previousKeys, topic)
+	}
+
+	b.markModified()
+	return nil
+}
+
+// AddSubscription implements Backend.
+func (b *JSONBackend) AddSubscription(topic string, id string, subscription Subscription) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	subscriptions, ok := b.subscriptions[topic]
+	if !ok {
+		return ErrTopicNotFound
+	}
+
+	subscriptions[id] = subscription
+	b.markModified()
+	return nil
+}
+
+// MergeSubscription implements Backend.
+func (b *JSONBackend) MergeSubscription(topic string, id string, subscription Subscription) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	subscriptions, ok := b.subscriptions[topic]
+	if !ok {
+		return ErrTopicNotFound
+	}
+
+	if existing, ok := subscriptions[id]; ok {
+		subscription = mergeSubscription(existing, subscription)
+	}
+
+	subscriptions[id] = subscription
+	b.markModified()
+	return nil
+}
+
+// GetSubscription implements Backend.
+func (b *JSONBackend) GetSubscription(topic string, id string) (Subscription, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	subscriptions, ok := b.subscriptions[topic]
+	if !ok {
+		return Subscription{}, ErrTopicNotFound
+	}
+
+	subscription, ok := subscriptions[id]
+	if !ok {
+		return Subscription{}, ErrSubscriptionNotFound
+	}
+
+	return subscription, nil
+}
+
+// DeleteSubscription implements Backend.
+func (b *JSONBackend) DeleteSubscription(topic string, id string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	subscriptions, ok := b.subscriptions[topic]
+	if !ok {
+		return ErrTopicNotFound
+	}
+
+	_, ok = subscriptions[id]
+	if !ok {
+		return ErrSubscriptionNotFound
+	}
+
+	delete(subscriptions, id)
+	b.markModified()
+	return nil
+}
+
+// GetSubscriptions implements Backend.
+func (b *JSONBackend) GetSubscriptions(topic string) (map[string]Subscription, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	subscriptions, ok := b.subscriptions[topic]
+	if !ok {
+		return nil, ErrTopicNotFound
+	}
+
+	return maps.Clone(subscriptions), nil
+}
+
+// RecordDelivery implements Backend.
+func (b *JSONBackend) RecordDelivery(topic string, id string, delivered bool, at time.Time) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	subscriptions, ok := b.subscriptions[topic]
+	if !ok {
+		return ErrTopicNotFound
+	}
+
+	subscription, ok := subscriptions[id]
+	if !ok {
+		return ErrSubscriptionNotFound
+	}
+
+	if delivered {
+		subscription.LastDelivered = &at
+		subscription.Failures = 0
+	} else {
+		subscription.Failures++
+	}
+
+	subscriptions[id] = subscription
+	b.markModified()
+	return nil
+}
+
+// Metadata implements Backend.
+func (b *JSONBackend) Metadata() (map[string]string, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return maps.Clone(b.metadata), nil
+}
+
+// GetMetadata implements Backend.
+func (b *JSONBackend) GetMetadata(key string) (string, bool, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	value, ok := b.metadata[key]
+	return value, ok, nil
+}
+
+// SetMetadata implements Backend.
+func (b *JSONBackend) SetMetadata(key string, value string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.metadata[key] = value
+	b.markModified()
+	return nil
+}
+
+// Backup implements Backend.
+func (b *JSONBackend) Backup(dir string) error {
+	return b.writeFiles(dir)
+}
+
+// Close implements Backend. It saves any unsaved modifications and releases
+// the lock of the state.
+func (b *JSONBackend) Close() error {
+	// NOTE: The lock is released even if the state couldn't be saved, as it
+	// would otherwise be held until the process exits
+	err := b.saveIfModified()
+	return errors.Join(err, b.unlock())
+}
+
+// markModified marks the backend as modified, scheduling a save by
+// [JSONBackend.Run]. The caller must hold the write lock.
+func (b *JSONBackend) markModified() {
+	b.modified = true
+
+	select {
+	case b.modifiedCh <- struct{}{}:
+	default:
+	}
+}
+
+// Run saves the backend whenever it's modified, until ctx is done.
+// Modifications made within [SaveDelay] of each other are coalesced into a
+// single save. Any unsaved modifications are saved before Run returns.
+func (b *JSONBackend) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return b.saveIfModified()
+		case <-b.modifiedCh:
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(SaveDelay):
+		}
+
+		if err := b.saveIfModified(); err != nil {
+			slog.Error("Failed to save store", slog.Any("error", err))
+		}
+	}
+}
+
+func (b *JSONBackend) saveIfModified() error {
+	// NOTE: Modifications of read-only backends are discarded
+	if b.readOnly {
+		return nil
+	}
+
+	b.mutex.Lock()
+	modified := b.modified
+	b.modified = false
+	b.mutex.Unlock()
+
+	if !modified {
+		return nil
+	}
+
+	err := b.Save()
+	if err != nil {
+		// Retry on the next modification or shutdown
+		b.mutex.Lock()
+		b.modified = true
+		b.mutex.Unlock()
+	}
+
+	return err
+}
+
+// holdSaves implements saveHolder. Saves, including those when closing, wait
+// until released.
+func (b *JSONBackend) holdSaves() func() {
+	b.saveMutex.Lock()
+	return b.saveMutex.Unlock
+}
+
+// Save saves the backend. Saves are serialized, so that an older snapshot
+// never overwrites a newer one. Returns [ErrReadOnly] if opened read-only.
+func (b *JSONBackend) Save() error {
+	if b.readOnly {
+		return ErrReadOnly
+	}
+
+	b.saveMutex.Lock()
+	defer b.saveMutex.Unlock()
+
+	return b.writeFiles(b.basePath)
+}
+
+// writeFiles writes a snapshot of the backend's state to dir.
+func (b *JSONBackend) writeFiles(dir string) error {
+	secrets, subscriptions, topics, metadata := b.snapshot()
+
+	err := b.writeFile(dir, "secrets.json", secrets)
+	if err != nil {
+		return err
+	}
+
+	err = b.writeFile(dir, "subscriptions.json", subscriptions)
+	if err != nil {
+		return err
+	}
+
+	err = b.writeFile(dir, "topics.json", topics)
+	if err != nil {
+		return err
+	}
+
+	err = b.writeFile(dir, "metadata.json", metadata)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// snapshot returns a copy of the backend's state.
+func (b *JSONBackend) snapshot() (*SecretsFile, *SubscriptionsFile, *TopicsFile, *MetadataFile) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	secrets := &SecretsFile{
+		Clients: make(map[string]ClientSecrets),
+	}
+
+	for topic, privateKey := range b.privateKeys {
+		secrets.Clients[topic] = ClientSecrets{
+			PrivateKey: privateKey,
+		}
+	}
+
+	for topic, previousKeys := range b.previousKeys {
+		clientSecrets := secrets.Clients[topic]
+		clientSecrets.PreviousKeys = maps.Clone(previousKeys)
+		secrets.Clients[topic] = clientSecrets
+	}
+
+	subscriptions := &SubscriptionsFile{
+		Topics:   make(map[string]map[string]Subscription),
+		Archived: maps.Clone(b.archived),
+	}
+
+	for topic, topicSubscriptions := range b.subscriptions {
+		subscriptions.Topics[topic] = maps.Clone(topicSubscriptions)
+	}
+
+	topics := &TopicsFile{
+		Topics: maps.Clone(b.topicConfigs),
+	}
+
+	metadata := &MetadataFile{
+		Metadata: maps.Clone(b.metadata),
+	}
+
+	return secrets, subscriptions, topics, metadata
+}
+
+// sealedFiles are the files encrypted at rest, if a keyring is configured.
+var sealedFiles = []string{"secrets.json", "subscriptions.json"}
+
+// readFile reads the file name in dir into v, opening it using the keyring if
+// it's sealed. Returns true if the file should be resealed using the primary
+// master key, as it's in plaintext or sealed using a previous master key.
+func (b *JSONBackend) readFile(dir string, name string, v any) (bool, error) {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return false, err
+	}
+
+	reseal := false
+	if envelope.IsSealed(data) {
+		if b.keyring == nil {
+			return false, fmt.Errorf("%s is encrypted, but no master key is configured", name)
+		}
+
+		var keyID string
+		data, keyID, err = b.keyring.Open(data, []byte(name))
+		if err != nil {
+			return false, fmt.Errorf("failed to decrypt %s: %w", name, err)
+		}
+
+		reseal = keyID != b.keyring.Primary().ID()
+	} else if b.keyring != nil && slices.Contains(sealedFiles, name) {
+		reseal = true
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+
+	return reseal, nil
+}
+
+// writeFile atomically writes v to the file name in dir, sealing it using the
+// keyring if configured.
+func (b *JSONBackend) writeFile(dir string, name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if b.keyring != nil && slices.Contains(sealedFiles, name) {
+		data, err = b.keyring.Seal(data, []byte(name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeFile(filepath.Join(dir, name), append(data, '\n'))
+}
+
+func readJSON(path string, v any) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return json.NewDecoder(file).Decode(v)
+}
+
+// writeJSON atomically writes v to path. See [writeFile].
+func writeJSON(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFile(path, append(data, '\n'))
+}
+
+// writeFile atomically writes data to path. The content is written to a
+// temporary file which is synced and then renamed, so that path never contains
+// partially written content, even if the process crashes or the disk is full.
+func writeFile(path string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	// NOTE: Fails once renamed, which is fine
+	defer os.Remove(file.Name())
+
+	if err := file.Chmod(0600); err != nil {
+		file.Close()
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(file.Name(), path); err != nil {
+		return err
+	}
+
+	// Sync the directory to persist the rename
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
@@ -0,0 +1,68 @@
+package state
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AlexGustafsson/grapevine/internal/envelope"
+	"github.com/AlexGustafsson/grapevine/internal/webpush"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONBackendEncryption(t *testing.T) {
+	basePath := t.TempDir()
+
+	previousKey, err := envelope.NewKey(bytes.Repeat([]byte{1}, envelope.KeySize))
+	require.NoError(t, err)
+
+	primaryKey, err := envelope.NewKey(bytes.Repeat([]byte{2}, envelope.KeySize))
+	require.NoError(t, err)
+
+	assertSealedWith := func(t *testing.T, key *envelope.Key) {
+		for _, name := range []string{"secrets.json", "subscriptions.json"} {
+			data, err := os.ReadFile(filepath.Join(basePath, name))
+			require.NoError(t, err)
+
+			_, keyID, err := envelope.NewKeyring(key).Open(data, []byte(name))
+			require.NoError(t, err)
+			assert.Equal(t, key.ID(), keyID)
+		}
+	}
+
+	// Write plaintext state
+	backend, err := OpenJSONBackend(basePath, nil)
+	require.NoError(t, err)
+	require.NoError(t, backend.CreateTopic("default"))
+	require.NoError(t, backend.SetPrivateKey("default", "key"))
+	require.NoError(t, backend.AddSubscription("default", "1", Subscription{Subscription: webpush.Subscription{Endpoint: "https://push.example.com/1"}}))
+	require.NoError(t, backend.Close())
+
+	// Plaintext state is transparently encrypted
+	backend, err = OpenJSONBackend(basePath, envelope.NewKeyring(previousKey))
+	require.NoError(t, err)
+	require.NoError(t, backend.Close())
+	assertSealedWith(t, previousKey)
+
+	_, err = OpenJSONBackend(basePath, nil)
+	assert.Error(t, err)
+
+	// Rotating the master key re-encrypts the state
+	backend, err = OpenJSONBackend(basePath, envelope.NewKeyring(primaryKey, previousKey))
+	require.NoError(t, err)
+	require.NoError(t, backend.Close())
+	assertSealedWith(t, primaryKey)
+
+	backend, err = OpenJSONBackend(basePath, envelope.NewKeyring(primaryKey))
+	require.NoError(t, err)
+	defer backend.Close()
+
+	privateKey, err := backend.PrivateKey("default")
+	require.NoError(t, err)
+	assert.Equal(t, "key", privateKey)
+
+	_, err = backend.GetSubscription("default", "1")
+	assert.NoError(t, err)
+}
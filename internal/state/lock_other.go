@@ -0,0 +1,22 @@
+//go:build !unix
+
+package state
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockState opens the lock file of the state stored in basePath.
+//
+// NOTE: Locking is only supported on unix systems. Elsewhere, the state must
+// not be opened by multiple processes at once
+func lockState(basePath string) (*os.File, error) {
+	file, err := os.OpenFile(filepath.Join(basePath, "state.lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	return file, nil
+}
@@ -0,0 +1,34 @@
+//go:build unix
+
+package state
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockState takes an exclusive lock of the state stored in basePath, held
+// until the returned file is closed. Returns [ErrStateLocked] if the lock is
+// held by another process.
+func lockState(basePath string) (*os.File, error) {
+	file, err := os.OpenFile(filepath.Join(basePath, "state.lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	// NOTE: The lock is released by the kernel if the process exits without
+	// closing the file, so a lock is never left behind
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		file.Close()
+		return nil, ErrStateLocked
+	} else if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock state: %w", err)
+	}
+
+	return file, nil
+}
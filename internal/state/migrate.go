@@ -0,0 +1,491 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// SchemaVersion is the schema version of state written by this version of
+// Grapevine.
+const SchemaVersion = 3
+
+// ErrUnsupportedSchemaVersion is returned when the state was written by a newer
+// version of Grapevine.
+var ErrUnsupportedSchemaVersion = errors.New("unsupported schema version")
+
+// schemaVersionKey is the metadata key holding the schema version.
+const schemaVersionKey = "schemaVersion"
+
+type migration struct {
+	Description string
+	Apply       func(basePath string, backend Backend) error
+}
+
+// migrations migrate state to [SchemaVersion]. The migration at index i
+// migrates state from version i to version i+1.
+//
+// NOTE: Migrations must only ever be appended, as released versions of
+// Grapevine may have stamped state with any of the versions.
+var migrations = []migration{
+	{
+		// Version 0 is state written before schema versions were introduced. It's
+		// identical to version 1
+		Description: "Stamp unversioned state with a schema version",
+		Apply: func(basePath string, backend Backend) error {
+			return nil
+		},
+	},
+	{
+		Description: "Add metadata to subscriptions",
+		Apply: func(basePath string, backend Backend) error {
+			topics, err := backend.Topics()
+			if err != nil {
+				return err
+			}
+
+			// NOTE: The actual creation time is unknown
+			now := time.Now()
+			for _, topic := range topics {
+				subscriptions, err := backend.GetSubscriptions(topic)
+				if err != nil {
+					return err
+				}
+
+				for id, subscription := range subscriptions {
+					if !subscription.Created.IsZero() {
+						continue
+					}
+
+					subscription.Created = now
+					subscription.Updated = now
+					if err := backend.AddSubscription(topic, id, subscription); err != nil {
+						return err
+					}
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		Description: "Track the key of subscriptions",
+		Apply: func(basePath string, backend Backend) error {
+			topics, err := backend.Topics()
+			if err != nil {
+				return err
+			}
+
+			// NOTE: Keys couldn't be rotated, so all subscriptions were made with
+			// the topic's only key
+			for _, topic := range topics {
+				privateKeyPEM, err := backend.PrivateKey(topic)
+				if err == ErrKeyNotFound {
+					// Topics removed before archival was introduced have no keys
+					continue
+				} else if err != nil {
+					return err
+				}
+
+				privateKey, err := parsePrivateKey(privateKeyPEM)
+				if err != nil {
+					return fmt.Errorf("invalid secret of topic %s: %w", topic, err)
+				}
+
+				currentKeyID, err := keyID(&privateKey.PublicKey)
+				if err != nil {
+					return fmt.Errorf("invalid secret of topic %s: %w", topic, err)
+				}
+
+				subscriptions, err := backend.GetSubscriptions(topic)
+				if err != nil {
+					return err
+				}
+
+				for id, subscription := range subscriptions {
+					if subscription.KeyID != "" {
+						continue
+					}
+
+					subscription.KeyID = currentKeyID
+					if err := backend.AddSubscription(topic, id, subscription); err != nil {
+						return err
+					}
+				}
+			}
+
+			return nil
+		},
+	},
+}
+
+// schemaMigrator is implemented by backends with a schema of their own, such
+// as [SQLiteBackend]. Their schema is migrated by [Migrate] along with the
+// state, rather than when opened, so that the migration is planned and the
+// state is backed up first.
+type schemaMigrator interface {
+	// pendingSchemaMigrations returns the descriptions of the schema migrations
+	// yet to be applied, in order.
+	pendingSchemaMigrations() ([]string, error)
+	// migrateSchema applies the pending schema migrations.
+	migrateSchema() error
+}
+
+// ReadSchemaVersion returns the schema version of the backend's state. State
+// written before schema versions were introduced has version 0.
+func ReadSchemaVersion(backend Backend) (int, error) {
+	value, ok, err := backend.GetMetadata(schemaVersionKey)
+	if err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, nil
+	}
+
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version %q: %w", value, err)
+	}
+
+	return version, nil
+}
+
+// MigrationPlan describes the changes made by [Migrate].
+type MigrationPlan struct {
+	// FromVersion is the current schema version of the state.
+	FromVersion int
+	// ToVersion is the schema version of the state once migrated.
+	ToVersion int
+	// BackendSteps describes the migrations of the storage backend's schema to
+	// apply, in order, before Steps.
+	BackendSteps []string
+	// Steps describes the schema migrations to apply, in order.
+	Steps []string
+	// NewTopics are topics in config.json for which keys will be generated.
+	NewTopics []string
+	// RestoredTopics are archived topics which are back in config.json and will
+	// be restored, along with their keys and subscriptions.
+	RestoredTopics []string
+	// ArchivedTopics are topics no longer in config.json, which will be
+	// archived along with their keys and subscriptions. Topics created at
+	// runtime are never archived.
+	ArchivedTopics []string
+
+	// topics are the topics in config.json.
+	topics []string
+	// existingTopics are the topics in the backend.
+	existingTopics []string
+	// empty is true if the backend holds no state.
+	empty bool
+	// newKeys are the keys of NewTopics, if generated before the plan is
+	// applied. See [MigrationPlan.generateKeys].
+	newKeys map[string]string
+}
+
+// Empty returns true if migrating wouldn't change anything.
+func (p *MigrationPlan) Empty() bool {
+	return len(p.BackendSteps) == 0 && len(p.Steps) == 0 && len(p.NewTopics) == 0 && len(p.RestoredTopics) == 0 && len(p.ArchivedTopics) == 0
+}
+
+// generateKeys generates the keys of the plan's new topics, so that clients
+// can be created before the plan is applied.
+func (p *MigrationPlan) generateKeys() error {
+	p.newKeys = make(map[string]string, len(p.NewTopics))
+	for _, topic := range p.NewTopics {
+		privateKeyPEM, err := generatePrivateKey()
+		if err != nil {
+			return err
+		}
+
+		p.newKeys[topic] = privateKeyPEM
+	}
+
+	return nil
+}
+
+// PlanMigration returns the changes [Migrate] would make, without making them.
+// Returns [ErrUnsupportedSchemaVersion] if the state was written by a newer
+// version of Grapevine.
+func PlanMigration(basePath string, backend Backend) (*MigrationPlan, error) {
+	var config ConfigFile
+	err := readJSON(filepath.Join(basePath, "config.json"), &config)
+	if err != nil {
+		return nil, err
+	}
+
+	migrator, ok := backend.(schemaMigrator)
+	if !ok {
+		return planMigration(&config, backend)
+	}
+
+	backendSteps, err := migrator.pendingSchemaMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(backendSteps) == 0 {
+		return planMigration(&config, backend)
+	}
+
+	// NOTE: The state can't be read until the backend's schema is migrated, so
+	// the migration is planned using a migrated copy of the backend
+	backup, closeBackup, err := openBackup(basePath, backend)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBackup()
+
+	if err := backup.(schemaMigrator).migrateSchema(); err != nil {
+		return nil, fmt.Errorf("failed to migrate storage schema: %w", err)
+	}
+
+	plan, err := planMigration(&config, backup)
+	if err != nil {
+		return nil, err
+	}
+
+	plan.BackendSteps = backendSteps
+	return plan, nil
+}
+
+// planMigration returns the changes needed to migrate the backend's state and
+// reconcile it with config.
+func planMigration(config *ConfigFile, backend Backend) (*MigrationPlan, error) {
+	version, err := ReadSchemaVersion(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	if version > SchemaVersion {
+		return nil, fmt.Errorf("%w: state has version %d, but only versions up to %d are supported, upgrade Grapevine", ErrUnsupportedSchemaVersion, version, SchemaVersion)
+	}
+
+	privateKeys, err := backend.PrivateKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	topics, err := backend.Topics()
+	if err != nil {
+		return nil, err
+	}
+
+	archivedTopics, err := backend.ArchivedTopics()
+	if err != nil {
+		return nil, err
+	}
+
+	topicConfigs, err := backend.TopicConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &MigrationPlan{
+		FromVersion:    version,
+		ToVersion:      SchemaVersion,
+		topics:         slices.Sorted(maps.Keys(config.Topics)),
+		existingTopics: topics,
+		empty:          len(privateKeys) == 0 && len(topics) == 0,
+	}
+
+	for _, migration := range migrations[version:] {
+		plan.Steps = append(plan.Steps, migration.Description)
+	}
+
+	for _, topic := range plan.topics {
+		// NOTE: Keys held by key providers aren't generated
+		if _, ok := privateKeys[topic]; !ok && config.Topics[topic].Key == "" {
+			plan.NewTopics = append(plan.NewTopics, topic)
+		}
+	}
+
+	for _, topic := range plan.topics {
+		if _, ok := archivedTopics[topic]; ok {
+			plan.RestoredTopics = append(plan.RestoredTopics, topic)
+		}
+	}
+
+	// NOTE: Topics removed before archival was introduced have subscriptions,
+	// but no keys
+	removedTopics := slices.Concat(topics, slices.Collect(maps.Keys(privateKeys)))
+	slices.Sort(removedTopics)
+	for _, topic := range slices.Compact(removedTopics) {
+		_, inConfig := config.Topics[topic]
+		_, createdAtRuntime := topicConfigs[topic]
+		_, archived := archivedTopics[topic]
+		if !inConfig && !createdAtRuntime && !archived {
+			plan.ArchivedTopics = append(plan.ArchivedTopics, topic)
+		}
+	}
+
+	return plan, nil
+}
+
+// Migrate migrates the backend's state to [SchemaVersion] and reconciles it
+// with the topics in config.json, generating keys for new topics. Removed
+// topics are archived rather than deleted, so that re-adding them restores
+// their keys and subscriptions. See [PurgeTopic]. Topics created at runtime
+// are left as is. The state is backed up to the backups directory before any
+// schema migrations, including those of the backend's own schema, are
+// applied. Returns [ErrUnsupportedSchemaVersion] if the state was written by a
+// newer version of Grapevine.
+func Migrate(basePath string, backend Backend) error {
+	plan, err := PlanMigration(basePath, backend)
+	if err != nil {
+		return err
+	}
+
+	if (len(plan.BackendSteps) > 0 || len(plan.Steps) > 0) && !plan.empty {
+		path, err := backup(basePath, backend, plan.FromVersion)
+		if err != nil {
+			return fmt.Errorf("failed to back up state: %w", err)
+		}
+
+		slog.Info("Backed up state before migrating", slog.String("path", path))
+	}
+
+	return applyMigration(basePath, backend, plan)
+}
+
+// applyMigration applies the changes of plan to the backend.
+func applyMigration(basePath string, backend Backend, plan *MigrationPlan) error {
+	if err := migrateBackendSchema(backend, plan); err != nil {
+		return err
+	}
+
+	for i, migration := range migrations[plan.FromVersion:] {
+		version := plan.FromVersion + i + 1
+		slog.Info("Migrating schema", slog.Int("version", version), slog.String("description", migration.Description))
+
+		if err := migration.Apply(basePath, backend); err != nil {
+			return fmt.Errorf("failed to migrate schema to version %d: %w", version, err)
+		}
+
+		if err := backend.SetMetadata(schemaVersionKey, strconv.Itoa(version)); err != nil {
+			return err
+		}
+	}
+
+	// Archive topics that don't exist
+	now := time.Now()
+	for _, topic := range plan.ArchivedTopics {
+		slog.Warn("Identified removed topic, archiving it", slog.String("topic", topic))
+
+		if !slices.Contains(plan.existingTopics, topic) {
+			if err := backend.CreateTopic(topic); err != nil {
+				return err
+			}
+		}
+
+		if err := backend.ArchiveTopic(topic, now); err != nil {
+			return err
+		}
+	}
+
+	// Restore archived topics that exist again
+	for _, topic := range plan.RestoredTopics {
+		slog.Info("Identified re-added topic, restoring it from the archive", slog.String("topic", topic))
+		if err := backend.RestoreTopic(topic); err != nil {
+			return err
+		}
+	}
+
+	// Generate secrets for new topics
+	for _, topic := range plan.NewTopics {
+		slog.Info("Identified new topic, generating secrets", slog.String("topic", topic))
+
+		privateKeyPEM, ok := plan.newKeys[topic]
+		if !ok {
+			var err error
+			privateKeyPEM, err = generatePrivateKey()
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := backend.SetPrivateKey(topic, privateKeyPEM); err != nil {
+			return err
+		}
+	}
+
+	// Add subscriptions for new topics
+	for _, topic := range plan.topics {
+		if err := backend.CreateTopic(topic); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateBackendSchema applies the backend schema migrations of plan.
+func migrateBackendSchema(backend Backend, plan *MigrationPlan) error {
+	if len(plan.BackendSteps) == 0 {
+		return nil
+	}
+
+	for _, step := range plan.BackendSteps {
+		slog.Info("Migrating storage schema", slog.String("description", step))
+	}
+
+	if err := backend.(schemaMigrator).migrateSchema(); err != nil {
+		return fmt.Errorf("failed to migrate storage schema: %w", err)
+	}
+
+	return nil
+}
+
+// checkBackendSchema returns an error if the backend's schema has yet to be
+// migrated, in which case its state can't be read.
+func checkBackendSchema(backend Backend) error {
+	migrator, ok := backend.(schemaMigrator)
+	if !ok {
+		return nil
+	}
+
+	steps, err := migrator.pendingSchemaMigrations()
+	if err != nil {
+		return err
+	} else if len(steps) > 0 {
+		return fmt.Errorf("the storage schema has %d pending migrations, migrate the state first", len(steps))
+	}
+
+	return nil
+}
+
+// backup backs up config.json and the backend's state to a new directory in
+// the backups directory, returning its path.
+func backup(basePath string, backend Backend, version int) (string, error) {
+	name := fmt.Sprintf("%s-v%d", time.Now().UTC().Format("20060102T150405Z"), version)
+	path := filepath.Join(basePath, "backups", name)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+
+	// NOTE: Fails if a backup was made within the same second, rather than
+	// overwriting it
+	if err := os.Mkdir(path, 0700); err != nil {
+		return "", err
+	}
+
+	config, err := os.ReadFile(filepath.Join(basePath, "config.json"))
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(filepath.Join(path, "config.json"), config, 0600); err != nil {
+		return "", err
+	}
+
+	if err := backend.Backup(path); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
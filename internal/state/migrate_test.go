@@ -0,0 +1,210 @@
+package state
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestConfig(t *testing.T, basePath string, topics ...string) {
+	config := ConfigFile{
+		Topics: make(map[string]Topic),
+	}
+
+	for _, topic := range topics {
+		config.Topics[topic] = Topic{Name: topic, ShortName: topic}
+	}
+
+	require.NoError(t, writeJSON(filepath.Join(basePath, "config.json"), &config))
+}
+
+func TestMigrationsMatchSchemaVersion(t *testing.T) {
+	assert.Len(t, migrations, SchemaVersion)
+}
+
+func TestMigrateFresh(t *testing.T) {
+	basePath := t.TempDir()
+	writeTestConfig(t, basePath, "default")
+
+	backend, err := OpenJSONBackend(basePath, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, Migrate(basePath, backend))
+
+	version, err := ReadSchemaVersion(backend)
+	require.NoError(t, err)
+	assert.Equal(t, SchemaVersion, version)
+
+	// There's nothing to back up
+	_, err = os.Stat(filepath.Join(basePath, "backups"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	plan, err := PlanMigration(basePath, backend)
+	require.NoError(t, err)
+	assert.True(t, plan.Empty())
+}
+
+func TestMigrateBacksUpUnversionedState(t *testing.T) {
+	for _, kind := range []BackendKind{BackendJSON, BackendSQLite} {
+		t.Run(string(kind), func(t *testing.T) {
+			basePath := t.TempDir()
+			writeTestConfig(t, basePath, "default", "other")
+
+			backend, err := OpenBackend(kind, basePath, BackendOptions{})
+			require.NoError(t, err)
+			defer backend.Close()
+
+			privateKeyPEM, err := generatePrivateKey()
+			require.NoError(t, err)
+
+			privateKey, err := parsePrivateKey(privateKeyPEM)
+			require.NoError(t, err)
+
+			// State written before schema versions were introduced
+			require.NoError(t, backend.CreateTopic("default"))
+			require.NoError(t, backend.SetPrivateKey("default", privateKeyPEM))
+			require.NoError(t, backend.SetPrivateKey("removed", privateKeyPEM))
+			require.NoError(t, backend.AddSubscription("default", "1", Subscription{}))
+
+			plan, err := PlanMigration(basePath, backend)
+			require.NoError(t, err)
+			assert.Equal(t, 0, plan.FromVersion)
+			assert.Equal(t, SchemaVersion, plan.ToVersion)
+			assert.Len(t, plan.Steps, SchemaVersion)
+			assert.Equal(t, []string{"other"}, plan.NewTopics)
+			assert.Equal(t, []string{"removed"}, plan.ArchivedTopics)
+
+			// Planning doesn't change anything
+			version, err := ReadSchemaVersion(backend)
+			require.NoError(t, err)
+			assert.Equal(t, 0, version)
+
+			require.NoError(t, Migrate(basePath, backend))
+
+			version, err = ReadSchemaVersion(backend)
+			require.NoError(t, err)
+			assert.Equal(t, SchemaVersion, version)
+
+			_, err = backend.PrivateKey("other")
+			assert.NoError(t, err)
+
+			archivedTopics, err := backend.ArchivedTopics()
+			require.NoError(t, err)
+			assert.Contains(t, archivedTopics, "removed")
+
+			subscription, err := backend.GetSubscription("default", "1")
+			require.NoError(t, err)
+			assert.False(t, subscription.Created.IsZero())
+			assert.Equal(t, testKeyID(t, &privateKey.PublicKey), subscription.KeyID)
+
+			backups, err := os.ReadDir(filepath.Join(basePath, "backups"))
+			require.NoError(t, err)
+			require.Len(t, backups, 1)
+
+			// The backup holds the state from before the migration
+			backupBackend, err := OpenBackend(kind, filepath.Join(basePath, "backups", backups[0].Name()), BackendOptions{})
+			require.NoError(t, err)
+			defer backupBackend.Close()
+
+			version, err = ReadSchemaVersion(backupBackend)
+			require.NoError(t, err)
+			assert.Equal(t, 0, version)
+
+			assert.FileExists(t, filepath.Join(basePath, "backups", backups[0].Name(), "config.json"))
+		})
+	}
+}
+
+func TestMigrateRefusesNewerVersion(t *testing.T) {
+	basePath := t.TempDir()
+	writeTestConfig(t, basePath, "default")
+
+	backend, err := OpenJSONBackend(basePath, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, backend.SetMetadata(schemaVersionKey, strconv.Itoa(SchemaVersion+1)))
+
+	err = Migrate(basePath, backend)
+	assert.ErrorIs(t, err, ErrUnsupportedSchemaVersion)
+
+	_, err = backend.PrivateKey("default")
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestMigrateSQLiteSchema(t *testing.T) {
+	basePath := t.TempDir()
+	writeTestConfig(t, basePath, "default")
+
+	privateKeyPEM, err := generatePrivateKey()
+	require.NoError(t, err)
+
+	// A database written before subscriptions had metadata
+	db, err := sql.Open("sqlite", filepath.Join(basePath, "grapevine.db"))
+	require.NoError(t, err)
+	_, err = db.Exec(sqliteMigrations[0].Statements)
+	require.NoError(t, err)
+	_, err = db.Exec(`PRAGMA user_version = 1`)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO topics (id) VALUES ('default')`)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO private_keys (topic, private_key) VALUES ('default', ?)`, privateKeyPEM)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO subscriptions (topic, id, endpoint, auth, p256dh) VALUES ('default', '1', 'https://push.example.com/1', 'auth', 'p256dh')`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	backend, err := OpenSQLiteBackend(basePath)
+	require.NoError(t, err)
+	defer backend.Close()
+
+	// The schema isn't migrated when opened
+	schemaVersion, err := backend.schemaVersion()
+	require.NoError(t, err)
+	assert.Equal(t, 1, schemaVersion)
+
+	_, err = Load(basePath, backend, Options{PublicURL: "https://example.com", VAPIDSubject: "mailto:push@example.com"})
+	assert.ErrorContains(t, err, "pending migrations")
+
+	plan, err := PlanMigration(basePath, backend)
+	require.NoError(t, err)
+	assert.Equal(t, []string{sqliteMigrations[1].Description, sqliteMigrations[2].Description, sqliteMigrations[3].Description}, plan.BackendSteps)
+	assert.Len(t, plan.Steps, SchemaVersion)
+
+	// Planning doesn't change anything
+	schemaVersion, err = backend.schemaVersion()
+	require.NoError(t, err)
+	assert.Equal(t, 1, schemaVersion)
+
+	assert.NoDirExists(t, filepath.Join(basePath, "backups"))
+	temporary, err := filepath.Glob(filepath.Join(basePath, ".backup-*"))
+	require.NoError(t, err)
+	assert.Empty(t, temporary)
+
+	require.NoError(t, Migrate(basePath, backend))
+
+	schemaVersion, err = backend.schemaVersion()
+	require.NoError(t, err)
+	assert.Equal(t, len(sqliteMigrations), schemaVersion)
+
+	subscription, err := backend.GetSubscription("default", "1")
+	require.NoError(t, err)
+	assert.NotEmpty(t, subscription.KeyID)
+
+	// The backup holds the database from before the migration
+	backups, err := os.ReadDir(filepath.Join(basePath, "backups"))
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+
+	backupBackend, err := OpenSQLiteBackend(filepath.Join(basePath, "backups", backups[0].Name()))
+	require.NoError(t, err)
+	defer backupBackend.Close()
+
+	schemaVersion, err = backupBackend.schemaVersion()
+	require.NoError(t, err)
+	assert.Equal(t, 1, schemaVersion)
+}
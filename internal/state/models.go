@@ -1,6 +1,14 @@
 package state
 
-import "github.com/AlexGustafsson/grapevine/internal/webpush"
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/AlexGustafsson/grapevine/internal/signer"
+	"github.com/AlexGustafsson/grapevine/internal/vapid"
+	"github.com/AlexGustafsson/grapevine/internal/webpush"
+)
 
 type ConfigFile struct {
 	Topics map[string]Topic `json:"topics"`
@@ -9,6 +17,183 @@ type ConfigFile struct {
 type Topic struct {
 	Name      string `json:"name"`
 	ShortName string `json:"shortName"`
+	// DefaultTTL is the TTL in seconds used for notifications that don't
+	// specify one.
+	DefaultTTL *int `json:"defaultTtl,omitempty"`
+	// DefaultUrgency is the urgency used for notifications that don't specify
+	// one.
+	DefaultUrgency webpush.Urgency `json:"defaultUrgency,omitempty"`
+	// MaxTTL is the maximum TTL in seconds accepted for notifications. The
+	// default TTL is lowered to it for notifications that don't specify one.
+	MaxTTL *int `json:"maxTtl,omitempty"`
+	// BaseURL is the URL opened by notifications that don't specify one.
+	// Relative URLs of notifications resolve against it.
+	BaseURL string `json:"baseUrl,omitempty"`
+	// Presets are defaults for notifications of the topic.
+	Presets NotificationPresets `json:"presets,omitzero"`
+	// PublicURL overrides the public URL Grapevine is served on for the topic.
+	PublicURL string `json:"publicUrl,omitempty"`
+	// VAPIDSubject overrides the VAPID subject used for the topic.
+	VAPIDSubject string `json:"vapidSubject,omitempty"`
+	// Key is the URI of a key held by a key provider, such as
+	// unix:///run/signer.sock?key=name, used instead of a key generated and
+	// stored by Grapevine. Such keys can't be rotated or imported. Devices
+	// subscribed using another key must re-subscribe. See package signer.
+	Key string `json:"key,omitempty"`
+}
+
+type NotificationPresets struct {
+	Icon               string               `json:"icon,omitempty"`
+	Badge              string               `json:"badge,omitempty"`
+	Actions            []NotificationAction `json:"actions,omitempty"`
+	RequireInteraction *bool                `json:"requireInteraction,omitempty"`
+	TagStrategy        TagStrategy          `json:"tagStrategy,omitempty"`
+}
+
+type NotificationAction struct {
+	Action   string `json:"action"`
+	Title    string `json:"title"`
+	Navigate string `json:"navigate"`
+	Icon     string `json:"icon,omitempty"`
+}
+
+// TagStrategy determines the tag of notifications that don't specify one.
+// Notifications with the same tag replace each other.
+type TagStrategy string
+
+const (
+	// TagStrategyNone doesn't tag notifications.
+	TagStrategyNone TagStrategy = "none"
+	// TagStrategyTopic tags notifications with the topic, so that only the
+	// latest notification of the topic is shown.
+	TagStrategyTopic TagStrategy = "topic"
+	// TagStrategyTitle tags notifications with their title, so that only the
+	// latest notification with a given title is shown.
+	TagStrategyTitle TagStrategy = "title"
+)
+
+// Validate returns an error if the topic's configuration is invalid.
+func (t *Topic) Validate() error {
+	if t.DefaultTTL != nil && *t.DefaultTTL < 0 {
+		return fmt.Errorf("defaultTtl must not be negative")
+	}
+
+	if t.MaxTTL != nil && *t.MaxTTL < 0 {
+		return fmt.Errorf("maxTtl must not be negative")
+	}
+
+	if t.DefaultTTL != nil && t.MaxTTL != nil && *t.DefaultTTL > *t.MaxTTL {
+		return fmt.Errorf("defaultTtl must not exceed maxTtl")
+	}
+
+	if t.DefaultUrgency != "" && !t.DefaultUrgency.Valid() {
+		return fmt.Errorf("invalid defaultUrgency %q", t.DefaultUrgency)
+	}
+
+	var baseURL *url.URL
+	if t.BaseURL != "" {
+		var err error
+		baseURL, err = url.Parse(t.BaseURL)
+		if err != nil || (baseURL.Scheme != "https" && baseURL.Scheme != "http") || baseURL.Host == "" {
+			return fmt.Errorf("invalid baseUrl %q - must be an absolute http(s) URL", t.BaseURL)
+		}
+	}
+
+	validateURL := func(field string, value string) error {
+		if value == "" {
+			return nil
+		}
+
+		u, err := url.Parse(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %w", field, value, err)
+		}
+
+		if !u.IsAbs() && baseURL == nil {
+			return fmt.Errorf("invalid %s %q - relative URLs require baseUrl", field, value)
+		}
+
+		return nil
+	}
+
+	if err := validateURL("presets.icon", t.Presets.Icon); err != nil {
+		return err
+	}
+
+	if err := validateURL("presets.badge", t.Presets.Badge); err != nil {
+		return err
+	}
+
+	for i, action := range t.Presets.Actions {
+		if action.Action == "" || action.Title == "" || action.Navigate == "" {
+			return fmt.Errorf("presets.actions[%d] must have an action, title and navigate", i)
+		}
+
+		if err := validateURL(fmt.Sprintf("presets.actions[%d].navigate", i), action.Navigate); err != nil {
+			return err
+		}
+
+		if err := validateURL(fmt.Sprintf("presets.actions[%d].icon", i), action.Icon); err != nil {
+			return err
+		}
+	}
+
+	if t.PublicURL != "" {
+		if err := ValidatePublicURL(t.PublicURL); err != nil {
+			return fmt.Errorf("invalid publicUrl: %w", err)
+		}
+	}
+
+	if t.VAPIDSubject != "" {
+		if err := vapid.ValidateSubject(t.VAPIDSubject); err != nil {
+			return fmt.Errorf("invalid vapidSubject: %w", err)
+		}
+	}
+
+	if t.Key != "" {
+		if _, err := signer.ParseURI(t.Key); err != nil {
+			return fmt.Errorf("invalid key: %w", err)
+		}
+	}
+
+	switch t.Presets.TagStrategy {
+	case "", TagStrategyNone, TagStrategyTopic, TagStrategyTitle:
+	default:
+		return fmt.Errorf("invalid presets.tagStrategy %q - must be one of none, topic or title", t.Presets.TagStrategy)
+	}
+
+	return nil
+}
+
+// ValidateTopicName returns an error if name is not a valid name of a topic
+// created at runtime. Names are limited to characters that don't need to be
+// escaped in URLs.
+func ValidateTopicName(name string) error {
+	if name == "" || len(name) > 64 {
+		return fmt.Errorf("topic name must be between 1 and 64 characters")
+	}
+
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return fmt.Errorf("invalid topic name %q - must only contain letters, digits, - and _", name)
+		}
+	}
+
+	return nil
+}
+
+// ValidatePublicURL returns an error if value is not an absolute http(s) URL.
+func ValidatePublicURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("%q must be an absolute http(s) URL", value)
+	}
+
+	return nil
 }
 
 type SecretsFile struct {
@@ -17,8 +202,52 @@ type SecretsFile struct {
 
 type ClientSecrets struct {
 	PrivateKey string `json:"privateKey"`
+	// PreviousKeys are rotated keys still valid for existing subscriptions,
+	// keyed by their id.
+	PreviousKeys map[string]PreviousKey `json:"previousKeys,omitempty"`
+}
+
+// PreviousKey is a rotated key of a topic, kept until its subscriptions have
+// re-subscribed using the current key or its grace period expires.
+type PreviousKey struct {
+	// PrivateKey is the PEM-encoded private key.
+	PrivateKey string `json:"privateKey"`
+	// RetireAt is the time the key is retired, along with any subscriptions
+	// still using it.
+	RetireAt time.Time `json:"retireAt"`
 }
 
 type SubscriptionsFile struct {
-	Topics map[string]map[string]webpush.Subscription `json:"topics"`
+	Topics map[string]map[string]Subscription `json:"topics"`
+	// Archived holds the time each archived topic was archived.
+	Archived map[string]time.Time `json:"archived,omitempty"`
+}
+
+// Subscription is a stored push subscription and its metadata.
+type Subscription struct {
+	webpush.Subscription
+	// Created is the time the subscription was first added.
+	Created time.Time `json:"created"`
+	// Updated is the time the subscription was last added.
+	Updated time.Time `json:"updated"`
+	// UserAgent is the user agent of the device that added the subscription.
+	UserAgent string `json:"userAgent,omitempty"`
+	// Label is a user-chosen label of the device.
+	Label string `json:"label,omitempty"`
+	// LastDelivered is the time a push message was last successfully
+	// delivered to the subscription.
+	LastDelivered *time.Time `json:"lastDelivered,omitempty"`
+	// Failures is the number of consecutive failed deliveries.
+	Failures int `json:"failures,omitempty"`
+	// KeyID is the id of the topic's key the subscription was made with.
+	KeyID string `json:"keyId,omitempty"`
+}
+
+// TopicsFile holds the configuration of topics created at runtime.
+type TopicsFile struct {
+	Topics map[string]Topic `json:"topics"`
+}
+
+type MetadataFile struct {
+	Metadata map[string]string `json:"metadata"`
 }
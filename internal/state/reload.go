@@ -0,0 +1,144 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ConfigCheckInterval is the interval at which config.json is checked for
+// changes.
+const ConfigCheckInterval = 5 * time.Second
+
+// configVersion identifies a version of config.json.
+type configVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// readConfig reads config.json in basePath, along with its version.
+func readConfig(basePath string) (*ConfigFile, configVersion, error) {
+	path := filepath.Join(basePath, "config.json")
+
+	// NOTE: Stat before reading, so that a change made while reading is picked
+	// up by the next check
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, configVersion{}, err
+	}
+
+	var config ConfigFile
+	if err := readJSON(path, &config); err != nil {
+		return nil, configVersion{}, err
+	}
+
+	return &config, configVersion{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// Reload reloads config.json, atomically applying added, removed and modified
+// topics. Like when migrating, keys are generated for new topics and removed
+// topics are archived. See [Migrate]. If config.json is invalid, or any of its
+// topics can't be served, the current configuration and state are kept and an
+// error is returned. The reload is then retried on the next change check.
+func (s *Store) Reload() error {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	return s.reloadLocked()
+}
+
+// reloadLocked reloads config.json. The caller must hold the reload lock.
+func (s *Store) reloadLocked() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.reloadStoreLocked()
+}
+
+// reloadStoreLocked reloads config.json. The caller must hold both the reload
+// lock and the store's lock.
+func (s *Store) reloadStoreLocked() error {
+	config, version, err := readConfig(s.basePath)
+	if err != nil {
+		return fmt.Errorf("failed to read config.json: %w", err)
+	}
+
+	for topicName, topic := range config.Topics {
+		if err := topic.Validate(); err != nil {
+			return fmt.Errorf("invalid topic %s: %w", topicName, err)
+		}
+	}
+
+	plan, err := planMigration(config, s.backend)
+	if err != nil {
+		return err
+	}
+
+	if len(plan.Steps) > 0 {
+		return fmt.Errorf("state must be migrated before being reloaded")
+	}
+
+	// NOTE: The clients are created before the backend's state is changed, so
+	// that the state is left as is if any of the topics can't be served
+	if err := plan.generateKeys(); err != nil {
+		return err
+	}
+
+	clients, storedKeys, err := loadClients(config, s.backend, s.options, plan.newKeys)
+	if err != nil {
+		return err
+	}
+
+	if err := applyMigration(s.basePath, s.backend, plan); err != nil {
+		return err
+	}
+
+	if err := keepStoredKeys(s.backend, storedKeys); err != nil {
+		return err
+	}
+
+	s.clients = clients
+	s.configVersion = version
+	slog.Info("Reloaded config.json", slog.Int("topics", len(clients)))
+	return nil
+}
+
+// watchConfig reloads config.json whenever it changes, until ctx is done.
+func (s *Store) watchConfig(ctx context.Context) {
+	ticker := time.NewTicker(ConfigCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !s.configChanged() {
+			continue
+		}
+
+		slog.Info("Identified modified config.json, reloading")
+		if err := s.Reload(); err != nil {
+			slog.Error("Failed to reload config.json, keeping the current config", slog.Any("error", err))
+		}
+	}
+}
+
+// configChanged returns true if config.json has changed since last loaded.
+func (s *Store) configChanged() bool {
+	info, err := os.Stat(filepath.Join(s.basePath, "config.json"))
+	if err != nil {
+		// The file may be in the process of being replaced
+		return false
+	}
+
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	return !info.ModTime().Equal(s.configVersion.modTime) || info.Size() != s.configVersion.size
+}
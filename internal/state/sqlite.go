@@ -0,0 +1,856 @@
+package state
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/AlexGustafsson/grapevine/internal/webpush"
+	_ "modernc.org/sqlite"
+)
+
+var _ Backend = (*SQLiteBackend)(nil)
+
+type sqliteMigration struct {
+	Description string
+	Statements  string
+}
+
+// sqliteMigrations migrate the database schema. The migration at index i
+// migrates the schema from user_version i to i+1. Migrations of existing
+// databases are applied by [Migrate], see [SQLiteBackend.migrateSchema].
+//
+// NOTE: Migrations must only ever be appended.
+var sqliteMigrations = []sqliteMigration{
+	{
+		// NOTE: Databases created before the schema was versioned have
+		// user_version 0, but already contain the tables
+		Description: "Create tables",
+		Statements: `
+		CREATE TABLE IF NOT EXISTS topics (
+			id TEXT PRIMARY KEY
+		) STRICT;
+
+		CREATE TABLE IF NOT EXISTS archived_topics (
+			topic TEXT PRIMARY KEY REFERENCES topics (id) ON DELETE CASCADE,
+			archived_at INTEGER NOT NULL
+		) STRICT;
+
+		CREATE TABLE IF NOT EXISTS private_keys (
+			topic TEXT PRIMARY KEY,
+			private_key TEXT NOT NULL
+		) STRICT;
+
+		CREATE TABLE IF NOT EXISTS subscriptions (
+			topic TEXT NOT NULL REFERENCES topics (id) ON DELETE CASCADE,
+			id TEXT NOT NULL,
+			endpoint TEXT NOT NULL,
+			expiration_time INTEGER,
+			auth TEXT NOT NULL,
+			p256dh TEXT NOT NULL,
+			PRIMARY KEY (topic, id)
+		) STRICT;
+
+		CREATE TABLE IF NOT EXISTS metadata (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		) STRICT;
+		`,
+	},
+	{
+		Description: "Add metadata columns to subscriptions",
+		Statements: `
+		ALTER TABLE subscriptions ADD COLUMN created INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE subscriptions ADD COLUMN updated INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE subscriptions ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+		ALTER TABLE subscriptions ADD COLUMN label TEXT NOT NULL DEFAULT '';
+		ALTER TABLE subscriptions ADD COLUMN last_delivered INTEGER;
+		ALTER TABLE subscriptions ADD COLUMN failures INTEGER NOT NULL DEFAULT 0;
+		`,
+	},
+	{
+		Description: "Create table of topic configs",
+		Statements: `
+		CREATE TABLE topic_configs (
+			topic TEXT PRIMARY KEY REFERENCES topics (id) ON DELETE CASCADE,
+			config TEXT NOT NULL
+		) STRICT;
+		`,
+	},
+	{
+		Description: "Create table of previous keys and add key column to subscriptions",
+		Statements: `
+		CREATE TABLE previous_keys (
+			topic TEXT NOT NULL REFERENCES topics (id) ON DELETE CASCADE,
+			key_id TEXT NOT NULL,
+			private_key TEXT NOT NULL,
+			retire_at INTEGER NOT NULL,
+			PRIMARY KEY (topic, key_id)
+		) STRICT;
+
+		ALTER TABLE subscriptions ADD COLUMN key_id TEXT NOT NULL DEFAULT '';
+		`,
+	},
+}
+
+// subscriptionColumns are the columns scanned by [scanSubscription].
+const subscriptionColumns = `endpoint, expiration_time, auth, p256dh, created, updated, user_agent, label, last_delivered, failures, key_id`
+
+// SQLiteBackend is a [Backend] storing state in an embedded SQLite database,
+// grapevine.db.
+type SQLiteBackend struct {
+	db *sql.DB
+}
+
+// OpenSQLiteBackend opens the SQLite backend stored in basePath, creating it if
+// it doesn't exist. The schema of existing databases is migrated by [Migrate].
+func OpenSQLiteBackend(basePath string) (*SQLiteBackend, error) {
+	return openSQLiteBackend(basePath, false)
+}
+
+// openSQLiteBackend opens the SQLite backend stored in basePath. If readOnly is
+// true, the database must exist and any modification fails.
+func openSQLiteBackend(basePath string, readOnly bool) (*SQLiteBackend, error) {
+	query := url.Values{}
+	if readOnly {
+		query.Set("mode", "ro")
+	}
+	query.Add("_pragma", "foreign_keys(1)")
+	query.Add("_pragma", "journal_mode(WAL)")
+	query.Add("_pragma", "synchronous(FULL)")
+	query.Add("_pragma", "busy_timeout(5000)")
+	// NOTE: Write transactions take the write lock up front, so that they wait
+	// for the busy timeout rather than fail when upgrading from a read lock.
+	// Reads use deferred transactions, see [SQLiteBackend.beginRead]
+	query.Set("_txlock", "immediate")
+
+	dsn := "file:" + filepath.Join(basePath, "grapevine.db") + "?" + query.Encode()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	backend := &SQLiteBackend{
+		db: db,
+	}
+
+	version, err := backend.schemaVersion()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if version > len(sqliteMigrations) {
+		db.Close()
+		return nil, fmt.Errorf("%w: database has version %d, but only versions up to %d are supported", ErrUnsupportedSchemaVersion, version, len(sqliteMigrations))
+	}
+
+	// NOTE: New databases are created with the current schema. The schema of
+	// existing databases is migrated by Migrate, once backed up
+	var tables int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'`).Scan(&tables); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if tables == 0 && readOnly {
+		db.Close()
+		return nil, fmt.Errorf("no database to open read-only")
+	} else if tables == 0 {
+		if err := backend.migrateSchema(); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create schema: %w", err)
+		}
+	}
+
+	return backend, nil
+}
+
+// schemaVersion returns the version of the database schema, its user_version.
+func (b *SQLiteBackend) schemaVersion() (int, error) {
+	var version int
+	err := b.db.QueryRow(`PRAGMA user_version`).Scan(&version)
+	return version, err
+}
+
+// pendingSchemaMigrations implements schemaMigrator.
+func (b *SQLiteBackend) pendingSchemaMigrations() ([]string, error) {
+	version, err := b.schemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	var descriptions []string
+	for _, migration := range sqliteMigrations[min(version, len(sqliteMigrations)):] {
+		descriptions = append(descriptions, migration.Description)
+	}
+
+	return descriptions, nil
+}
+
+// migrateSchema implements schemaMigrator. The pending [sqliteMigrations] are
+// applied in a single transaction.
+func (b *SQLiteBackend) migrateSchema() error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("%w: database has version %d, but only versions up to %d are supported", ErrUnsupportedSchemaVersion, version, len(sqliteMigrations))
+	}
+
+	for i, migration := range sqliteMigrations[version:] {
+		if _, err := tx.Exec(migration.Statements); err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", version+i+1, err)
+		}
+	}
+
+	// NOTE: PRAGMA doesn't support parameters
+	if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, len(sqliteMigrations))); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Topics implements Backend.
+func (b *SQLiteBackend) Topics() ([]string, error) {
+	rows, err := b.db.Query(`SELECT id FROM topics ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	topics := make([]string, 0)
+	for rows.Next() {
+		var topic string
+		if err := rows.Scan(&topic); err != nil {
+			return nil, err
+		}
+		topics = append(topics, topic)
+	}
+
+	return topics, rows.Err()
+}
+
+// CreateTopic implements Backend.
+func (b *SQLiteBackend) CreateTopic(topic string) error {
+	_, err := b.db.Exec(`INSERT INTO topics (id) VALUES (?) ON CONFLICT DO NOTHING`, topic)
+	return err
+}
+
+// DeleteTopic implements Backend.
+func (b *SQLiteBackend) DeleteTopic(topic string) error {
+	// NOTE: Subscriptions, rotated keys, archival and configuration are deleted
+	// by the foreign key constraints
+	result, err := b.db.Exec(`DELETE FROM topics WHERE id = ?`, topic)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result, ErrTopicNotFound)
+}
+
+// ArchiveTopic implements Backend.
+func (b *SQLiteBackend) ArchiveTopic(topic string, archivedAt time.Time) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := topicExists(tx, topic); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO archived_topics (topic, archived_at) VALUES (?, ?)
+		ON CONFLICT (topic) DO UPDATE SET archived_at = excluded.archived_at`,
+		topic, archivedAt.UnixMilli(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RestoreTopic implements Backend.
+func (b *SQLiteBackend) RestoreTopic(topic string) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := topicExists(tx, topic); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM archived_topics WHERE topic = ?`, topic); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ArchivedTopics implements Backend.
+func (b *SQLiteBackend) ArchivedTopics() (map[string]time.Time, error) {
+	rows, err := b.db.Query(`SELECT topic, archived_at FROM archived_topics`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	archivedTopics := make(map[string]time.Time)
+	for rows.Next() {
+		var topic string
+		var archivedAt int64
+		if err := rows.Scan(&topic, &archivedAt); err != nil {
+			return nil, err
+		}
+		archivedTopics[topic] = time.UnixMilli(archivedAt)
+	}
+
+	return archivedTopics, rows.Err()
+}
+
+// TopicConfigs implements Backend.
+func (b *SQLiteBackend) TopicConfigs() (map[string]Topic, error) {
+	rows, err := b.db.Query(`SELECT topic, config FROM topic_configs`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	topicConfigs := make(map[string]Topic)
+	for rows.Next() {
+		var topic, data string
+		if err := rows.Scan(&topic, &data); err != nil {
+			return nil, err
+		}
+
+		var config Topic
+		if err := json.Unmarshal([]byte(data), &config); err != nil {
+			return nil, fmt.Errorf("invalid configuration of topic %s: %w", topic, err)
+		}
+		topicConfigs[topic] = config
+	}
+
+	return topicConfigs, rows.Err()
+}
+
+// SetTopicConfig implements Backend.
+func (b *SQLiteBackend) SetTopicConfig(topic string, config Topic) error {
+	data, err := json.Marshal(&config)
+	if err != nil {
+		return err
+	}
+
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := topicExists(tx, topic); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO topic_configs (topic, config) VALUES (?, ?)
+		ON CONFLICT (topic) DO UPDATE SET config = excluded.config`,
+		topic, string(data),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteTopicConfig implements Backend.
+func (b *SQLiteBackend) DeleteTopicConfig(topic string) error {
+	result, err := b.db.Exec(`DELETE FROM topic_configs WHERE topic = ?`, topic)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result, ErrTopicNotFound)
+}
+
+// PrivateKeys implements Backend.
+func (b *SQLiteBackend) PrivateKeys() (map[string]string, error) {
+	rows, err := b.db.Query(`SELECT topic, private_key FROM private_keys`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	privateKeys := make(map[string]string)
+	for rows.Next() {
+		var topic, privateKey string
+		if err := rows.Scan(&topic, &privateKey); err != nil {
+			return nil, err
+		}
+		privateKeys[topic] = privateKey
+	}
+
+	return privateKeys, rows.Err()
+}
+
+// PrivateKey implements Backend.
+func (b *SQLiteBackend) PrivateKey(topic string) (string, error) {
+	var privateKey string
+	err := b.db.QueryRow(`SELECT private_key FROM private_keys WHERE topic = ?`, topic).Scan(&privateKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrKeyNotFound
+	}
+
+	return privateKey, err
+}
+
+// SetPrivateKey implements Backend.
+func (b *SQLiteBackend) SetPrivateKey(topic string, privateKey string) error {
+	_, err := b.db.Exec(
+		`INSERT INTO private_keys (topic, private_key) VALUES (?, ?)
+		ON CONFLICT (topic) DO UPDATE SET private_key = excluded.private_key`,
+		topic, privateKey,
+	)
+	return err
+}
+
+// DeletePrivateKey implements Backend.
+func (b *SQLiteBackend) DeletePrivateKey(topic string) error {
+	result, err := b.db.Exec(`DELETE FROM private_keys WHERE topic = ?`, topic)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result, ErrKeyNotFound)
+}
+
+// PreviousKeys implements Backend.
+func (b *SQLiteBackend) PreviousKeys(topic string) (map[string]PreviousKey, error) {
+	tx, err := b.beginRead()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := topicExists(tx, topic); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`SELECT key_id, private_key, retire_at FROM previous_keys WHERE topic = ?`, topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	previousKeys := make(map[string]PreviousKey)
+	for rows.Next() {
+		var keyID string
+		var key PreviousKey
+		var retireAt int64
+		if err := rows.Scan(&keyID, &key.PrivateKey, &retireAt); err != nil {
+			return nil, err
+		}
+		key.RetireAt = time.UnixMilli(retireAt)
+		previousKeys[keyID] = key
+	}
+
+	return previousKeys, rows.Err()
+}
+
+// SetPreviousKey implements Backend.
+func (b *SQLiteBackend) SetPreviousKey(topic string, keyID string, key PreviousKey) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := topicExists(tx, topic); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO previous_keys (topic, key_id, private_key, retire_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (topic, key_id) DO UPDATE SET
+			private_key = excluded.private_key,
+			retire_at = excluded.retire_at`,
+		topic, keyID, key.PrivateKey, key.RetireAt.UnixMilli(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeletePreviousKey implements Backend.
+func (b *SQLiteBackend) DeletePreviousKey(topic string, keyID string) error {
+	result, err := b.db.Exec(`DELETE FROM previous_keys WHERE topic = ? AND key_id = ?`, topic, keyID)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result, ErrKeyNotFound)
+}
+
+// AddSubscription implements Backend.
+func (b *SQLiteBackend) AddSubscription(topic string, id string, subscription Subscription) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := topicExists(tx, topic); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO subscriptions (topic, id, `+subscriptionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (topic, id) DO UPDATE SET
+			endpoint = excluded.endpoint,
+			expiration_time = excluded.expiration_time,
+			auth = excluded.auth,
+			p256dh = excluded.p256dh,
+			created = excluded.created,
+			updated = excluded.updated,
+			user_agent = excluded.user_agent,
+			label = excluded.label,
+			last_delivered = excluded.last_delivered,
+			failures = excluded.failures,
+			key_id = excluded.key_id`,
+		topic, id,
+		subscription.Endpoint, nullableTimestamp(subscription.ExpirationTime), subscription.Keys.Auth, subscription.Keys.P256DH,
+		unixMilli(subscription.Created), unixMilli(subscription.Updated), subscription.UserAgent, subscription.Label,
+		nullableTime(subscription.LastDelivered), subscription.Failures, subscription.KeyID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MergeSubscription implements Backend. The subscription is merged by a single
+// UPSERT, equivalent to [mergeSubscription].
+func (b *SQLiteBackend) MergeSubscription(topic string, id string, subscription Subscription) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := topicExists(tx, topic); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO subscriptions (topic, id, `+subscriptionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (topic, id) DO UPDATE SET
+			endpoint = excluded.endpoint,
+			expiration_time = excluded.expiration_time,
+			auth = excluded.auth,
+			p256dh = excluded.p256dh,
+			created = CASE WHEN subscriptions.created = 0 THEN excluded.created ELSE subscriptions.created END,
+			updated = excluded.updated,
+			user_agent = excluded.user_agent,
+			label = CASE WHEN excluded.label = '' THEN subscriptions.label ELSE excluded.label END,
+			key_id = excluded.key_id`,
+		topic, id,
+		subscription.Endpoint, nullableTimestamp(subscription.ExpirationTime), subscription.Keys.Auth, subscription.Keys.P256DH,
+		unixMilli(subscription.Created), unixMilli(subscription.Updated), subscription.UserAgent, subscription.Label,
+		nullableTime(subscription.LastDelivered), subscription.Failures, subscription.KeyID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetSubscription implements Backend.
+func (b *SQLiteBackend) GetSubscription(topic string, id string) (Subscription, error) {
+	tx, err := b.beginRead()
+	if err != nil {
+		return Subscription{}, err
+	}
+	defer tx.Rollback()
+
+	if err := topicExists(tx, topic); err != nil {
+		return Subscription{}, err
+	}
+
+	row := tx.QueryRow(`SELECT `+subscriptionColumns+` FROM subscriptions WHERE topic = ? AND id = ?`, topic, id)
+	subscription, err := scanSubscription(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Subscription{}, ErrSubscriptionNotFound
+	}
+
+	return subscription, err
+}
+
+// DeleteSubscription implements Backend.
+func (b *SQLiteBackend) DeleteSubscription(topic string, id string) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := topicExists(tx, topic); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`DELETE FROM subscriptions WHERE topic = ? AND id = ?`, topic, id)
+	if err != nil {
+		return err
+	}
+
+	if err := expectAffected(result, ErrSubscriptionNotFound); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetSubscriptions implements Backend.
+func (b *SQLiteBackend) GetSubscriptions(topic string) (map[string]Subscription, error) {
+	tx, err := b.beginRead()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := topicExists(tx, topic); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`SELECT id, `+subscriptionColumns+` FROM subscriptions WHERE topic = ?`, topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := make(map[string]Subscription)
+	for rows.Next() {
+		var id string
+		subscription, err := scanSubscription(rows, &id)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions[id] = subscription
+	}
+
+	return subscriptions, rows.Err()
+}
+
+// RecordDelivery implements Backend.
+func (b *SQLiteBackend) RecordDelivery(topic string, id string, delivered bool, at time.Time) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := topicExists(tx, topic); err != nil {
+		return err
+	}
+
+	var result sql.Result
+	if delivered {
+		result, err = tx.Exec(`UPDATE subscriptions SET last_delivered = ?, failures = 0 WHERE topic = ? AND id = ?`, at.UnixMilli(), topic, id)
+	} else {
+		result, err = tx.Exec(`UPDATE subscriptions SET failures = failures + 1 WHERE topic = ? AND id = ?`, topic, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := expectAffected(result, ErrSubscriptionNotFound); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Metadata implements Backend.
+func (b *SQLiteBackend) Metadata() (map[string]string, error) {
+	rows, err := b.db.Query(`SELECT key, value FROM metadata`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metadata := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		metadata[key] = value
+	}
+
+	return metadata, rows.Err()
+}
+
+// GetMetadata implements Backend.
+func (b *SQLiteBackend) GetMetadata(key string) (string, bool, error) {
+	var value string
+	err := b.db.QueryRow(`SELECT value FROM metadata WHERE key = ?`, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	return value, true, nil
+}
+
+// SetMetadata implements Backend.
+func (b *SQLiteBackend) SetMetadata(key string, value string) error {
+	_, err := b.db.Exec(
+		`INSERT INTO metadata (key, value) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value`,
+		key, value,
+	)
+	return err
+}
+
+// Backup implements Backend.
+func (b *SQLiteBackend) Backup(dir string) error {
+	_, err := b.db.Exec(`VACUUM INTO ?`, filepath.Join(dir, "grapevine.db"))
+	return err
+}
+
+// Close implements Backend.
+func (b *SQLiteBackend) Close() error {
+	return b.db.Close()
+}
+
+// beginRead begins a read-only transaction. Unlike write transactions, it
+// doesn't take the write lock, so reads don't wait for concurrent writes.
+func (b *SQLiteBackend) beginRead() (*sql.Tx, error) {
+	return b.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+}
+
+// topicExists returns [ErrTopicNotFound] if topic doesn't exist.
+func topicExists(tx *sql.Tx, topic string) error {
+	var exists bool
+	err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM topics WHERE id = ?)`, topic).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return ErrTopicNotFound
+	}
+
+	return nil
+}
+
+// expectAffected returns notFound if no rows were affected.
+func expectAffected(result sql.Result, notFound error) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return notFound
+	}
+
+	return nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanSubscription scans the [subscriptionColumns] of a subscription, preceded
+// by any columns scanned into prefix.
+func scanSubscription(row scanner, prefix ...any) (Subscription, error) {
+	var subscription Subscription
+	var expirationTime, lastDelivered sql.NullInt64
+	var created, updated int64
+
+	dest := append(
+		prefix,
+		&subscription.Endpoint, &expirationTime, &subscription.Keys.Auth, &subscription.Keys.P256DH,
+		&created, &updated, &subscription.UserAgent, &subscription.Label, &lastDelivered, &subscription.Failures,
+		&subscription.KeyID,
+	)
+	if err := row.Scan(dest...); err != nil {
+		return Subscription{}, err
+	}
+
+	if t := nullTime(expirationTime); t != nil {
+		subscription.ExpirationTime = &webpush.Timestamp{Time: *t}
+	}
+	subscription.LastDelivered = nullTime(lastDelivered)
+
+	// NOTE: Subscriptions added before metadata was introduced have no times
+	if created != 0 {
+		subscription.Created = time.UnixMilli(created)
+	}
+
+	if updated != 0 {
+		subscription.Updated = time.UnixMilli(updated)
+	}
+
+	return subscription, nil
+}
+
+// unixMilli returns t as unix milliseconds, or 0 if t is zero.
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixMilli()
+}
+
+// nullTime returns t, stored as unix milliseconds, as a time, or nil.
+func nullTime(t sql.NullInt64) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+
+	value := time.UnixMilli(t.Int64)
+	return &value
+}
+
+// nullableTimestamp returns t as unix milliseconds, or nil.
+func nullableTimestamp(t *webpush.Timestamp) any {
+	if t == nil {
+		return nil
+	}
+
+	return t.UnixMilli()
+}
+
+// nullableTime returns t as unix milliseconds, or nil.
+func nullableTime(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+
+	return t.UnixMilli()
+}
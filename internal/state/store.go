@@ -1,33 +1,99 @@
 package state
 
 import (
+	"context"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"log/slog"
 	"maps"
-	"os"
-	"path/filepath"
+	"net/url"
 	"slices"
 	"sync"
+	"time"
 
+	"github.com/AlexGustafsson/grapevine/internal/signer"
+	"github.com/AlexGustafsson/grapevine/internal/vapid"
 	"github.com/AlexGustafsson/grapevine/internal/webpush"
 )
 
 var (
 	ErrTopicNotFound        = errors.New("topic not found")
+	ErrTopicExists          = errors.New("topic already exists")
+	ErrTopicInConfig        = errors.New("topic is configured in config.json")
 	ErrSubscriptionNotFound = errors.New("subscription not found")
+	// ErrExternalKey is returned when replacing the key of a topic whose key is
+	// held by a key provider. See [Topic.Key].
+	ErrExternalKey = errors.New("topic's key is held by a key provider")
+	// ErrKeyRetired is returned when using a rotated key which has been
+	// retired.
+	ErrKeyRetired = errors.New("key has been retired")
+)
+
+// DefaultKeyGracePeriod is the default time a replaced key remains valid for
+// subscriptions made with it.
+const DefaultKeyGracePeriod = 30 * 24 * time.Hour
+
+// TopicSource is where a topic is configured.
+type TopicSource string
+
+const (
+	// TopicSourceConfig is used for topics configured in config.json.
+	TopicSourceConfig TopicSource = "config"
+	// TopicSourceAPI is used for topics created through the API. Their
+	// configuration is persisted by the backend.
+	TopicSourceAPI TopicSource = "api"
 )
 
 type Client struct {
-	topic      string
-	name       string
-	shortName  string
-	privateKey *ecdsa.PrivateKey
+	topic          string
+	name           string
+	shortName      string
+	defaultTTL     *int
+	defaultUrgency webpush.Urgency
+	maxTTL         *int
+	baseURL        *url.URL
+	presets        NotificationPresets
+	publicURL      *url.URL
+	subject        string
+	source         TopicSource
+	key            string
+	signer         crypto.Signer
+	publicKey      *ecdsa.PublicKey
+	keyID          string
+	// applicationServerKey is the base64url encoded public key of the current
+	// key.
+	applicationServerKey string
+	previousKeys         map[string]previousKey
+	tokens               *vapid.TokenCache
+}
+
+// previousKey is a rotated key of a topic.
+type previousKey struct {
+	privateKey           *ecdsa.PrivateKey
+	applicationServerKey string
+	retireAt             time.Time
+}
+
+// newPreviousKey returns a rotated key, retired at retireAt.
+func newPreviousKey(privateKey *ecdsa.PrivateKey, retireAt time.Time) (previousKey, error) {
+	applicationServerKey, err := encodePublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return previousKey{}, err
+	}
+
+	return previousKey{
+		privateKey:           privateKey,
+		applicationServerKey: applicationServerKey,
+		retireAt:             retireAt,
+	}, nil
 }
 
 func (c *Client) Topic() string {
@@ -42,299 +108,1141 @@ func (c *Client) ShortName() string {
 	return c.shortName
 }
 
+// DefaultTTL returns the TTL in seconds to use for notifications that don't
+// specify one, if configured.
+func (c *Client) DefaultTTL() (int, bool) {
+	if c.defaultTTL == nil {
+		return 0, false
+	}
+
+	return *c.defaultTTL, true
+}
+
+// DefaultUrgency returns the urgency to use for notifications that don't
+// specify one. Empty if not configured.
+func (c *Client) DefaultUrgency() webpush.Urgency {
+	return c.defaultUrgency
+}
+
+// MaxTTL returns the maximum TTL in seconds accepted for notifications, if
+// configured.
+func (c *Client) MaxTTL() (int, bool) {
+	if c.maxTTL == nil {
+		return 0, false
+	}
+
+	return *c.maxTTL, true
+}
+
+// BaseURL returns the URL opened by notifications that don't specify one.
+// Nil if not configured.
+func (c *Client) BaseURL() *url.URL {
+	return c.baseURL
+}
+
+// Presets returns the defaults for notifications of the topic.
+func (c *Client) Presets() NotificationPresets {
+	return c.presets
+}
+
+// PublicURL returns the URL Grapevine is publicly served on for the topic.
+// Nil if not configured.
+func (c *Client) PublicURL() *url.URL {
+	return c.publicURL
+}
+
+// Subject returns the VAPID subject used to sign push messages.
 func (c *Client) Subject() string {
-	return "https://example.com/" + c.topic // TODO
+	return c.subject
+}
+
+// Source returns where the topic is configured.
+func (c *Client) Source() TopicSource {
+	return c.source
+}
+
+// KeyURI returns the URI of the topic's key if it's held by a key provider.
+// Empty if the key is stored by the backend.
+func (c *Client) KeyURI() string {
+	return c.key
+}
+
+// KeyID returns the id of the topic's current key.
+func (c *Client) KeyID() string {
+	return c.keyID
+}
+
+// PreviousKeys returns the ids of the topic's rotated keys, which are still
+// valid for existing subscriptions, and when they're retired.
+func (c *Client) PreviousKeys() map[string]time.Time {
+	previousKeys := make(map[string]time.Time, len(c.previousKeys))
+	for keyID, key := range c.previousKeys {
+		previousKeys[keyID] = key.retireAt
+	}
+
+	return previousKeys
+}
+
+// ApplicationServerKey returns the base64url encoded public key of the topic's
+// current key, used by user agents to subscribe.
+func (c *Client) ApplicationServerKey() string {
+	return c.applicationServerKey
 }
 
-func (c *Client) WebPushClient() webpush.Client {
-	keyExchangeKey, err := c.privateKey.ECDH()
+// ApplicationServerKeyOf returns the base64url encoded public key of the
+// topic's key with the specified id, which may be a rotated key. An empty id
+// refers to the current key. Returns false if the key has been retired.
+func (c *Client) ApplicationServerKeyOf(keyID string) (string, bool) {
+	if keyID == "" || keyID == c.keyID {
+		return c.applicationServerKey, true
+	}
+
+	key, ok := c.previousKeys[keyID]
+	if !ok {
+		return "", false
+	}
+
+	return key.applicationServerKey, true
+}
+
+// KeyIDOf returns the id of the topic's key with the specified base64url
+// encoded public key, which may be the current key or a rotated key.
+func (c *Client) KeyIDOf(applicationServerKey string) (string, bool) {
+	if applicationServerKey == c.applicationServerKey {
+		return c.keyID, true
+	}
+
+	for keyID, key := range c.previousKeys {
+		if applicationServerKey == key.applicationServerKey {
+			return keyID, true
+		}
+	}
+
+	return "", false
+}
+
+// WebPushClient returns a client signing push messages using the topic's
+// current key. Returns an error if the key can't be used for VAPID, such as
+// if a key provider returns a key that isn't a P-256 key.
+func (c *Client) WebPushClient() (webpush.Client, error) {
+	return c.webPushClient(c.signer)
+}
+
+// WebPushClientFor returns a client signing push messages using the topic's
+// key with the specified id, which may be a rotated key. An empty id refers
+// to the current key. Returns [ErrKeyRetired] if the key has been retired.
+func (c *Client) WebPushClientFor(keyID string) (webpush.Client, error) {
+	if keyID == "" || keyID == c.keyID {
+		return c.WebPushClient()
+	}
+
+	key, ok := c.previousKeys[keyID]
+	if !ok {
+		return nil, ErrKeyRetired
+	}
+
+	return c.webPushClient(key.privateKey)
+}
+
+func (c *Client) webPushClient(signer crypto.Signer) (webpush.Client, error) {
+	client, err := webpush.NewClient(c.Subject(), signer, c.tokens)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("invalid key of topic %s: %w", c.topic, err)
 	}
 
-	return webpush.NewClient(c.Subject(), c.privateKey, keyExchangeKey)
+	return client, nil
 }
 
 type Store struct {
-	mutex         sync.RWMutex
-	basePath      string
-	clients       map[string]Client
-	subscriptions map[string]map[string]webpush.Subscription
+	mutex    sync.RWMutex
+	basePath string
+	clients  map[string]Client
+	backend  Backend
+	options  Options
+
+	// reloadMutex serializes reloads.
+	reloadMutex sync.Mutex
+	// configVersion identifies the version of config.json last loaded.
+	configVersion configVersion
 }
 
 func (s *Store) BasePath() string {
 	return s.basePath
 }
 
-func Migrate(basePath string) error {
-	var config ConfigFile
-	err := readJSON(filepath.Join(basePath, "config.json"), &config)
+// Options are global options for a [Store], which may be overridden per
+// topic.
+type Options struct {
+	// PublicURL is the URL Grapevine is publicly served on.
+	PublicURL string
+	// VAPIDSubject is the contact used in the VAPID token's sub claim.
+	VAPIDSubject string
+	// TokenCache caches the VAPID tokens of all topics. If nil, a token is
+	// signed for every push message.
+	TokenCache *vapid.TokenCache
+	// KeyGracePeriod is the time the stored key of a topic remains valid for
+	// subscriptions made with it, once the topic's key is held by a key
+	// provider. Defaults to [DefaultKeyGracePeriod].
+	KeyGracePeriod time.Duration
+	// ReadOnly loads the store without changing the backend's state, such as
+	// for diagnostics. Keys stored for topics whose key is held by a key
+	// provider are then valid as rotated keys, but aren't moved.
+	ReadOnly bool
+}
+
+// Validate returns an error if the options are invalid.
+func (o *Options) Validate() error {
+	if o.PublicURL != "" {
+		if err := ValidatePublicURL(o.PublicURL); err != nil {
+			return fmt.Errorf("invalid public URL: %w", err)
+		}
+	}
+
+	if o.VAPIDSubject != "" {
+		if err := vapid.ValidateSubject(o.VAPIDSubject); err != nil {
+			return fmt.Errorf("invalid VAPID subject: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// keyGracePeriod returns the configured grace period of replaced keys.
+func (o *Options) keyGracePeriod() time.Duration {
+	if o.KeyGracePeriod <= 0 {
+		return DefaultKeyGracePeriod
+	}
+
+	return o.KeyGracePeriod
+}
+
+func Load(basePath string, backend Backend, options Options) (*Store, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := checkBackendSchema(backend); err != nil {
+		return nil, err
+	}
+
+	config, configVersion, err := readConfig(basePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var secrets SecretsFile
-	err = readJSON(filepath.Join(basePath, "secrets.json"), &secrets)
-	if errors.Is(err, os.ErrNotExist) {
-		secrets.Clients = make(map[string]ClientSecrets)
-	} else if err != nil {
-		return err
+	clients, storedKeys, err := loadClients(config, backend, options, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	var subscriptions SubscriptionsFile
-	err = readJSON(filepath.Join(basePath, "subscriptions.json"), &subscriptions)
-	if errors.Is(err, os.ErrNotExist) {
-		subscriptions.Topics = make(map[string]map[string]webpush.Subscription)
-	} else if err != nil {
-		return err
+	if !options.ReadOnly {
+		if err := keepStoredKeys(backend, storedKeys); err != nil {
+			return nil, err
+		}
 	}
 
-	// Remove secrets for topics that don't exist
-	for clientTopicName := range secrets.Clients {
-		found := false
-		for topicName := range config.Topics {
-			if clientTopicName == topicName {
-				found = true
-				break
-			}
+	return &Store{
+		basePath:      basePath,
+		clients:       clients,
+		backend:       backend,
+		options:       options,
+		configVersion: configVersion,
+	}, nil
+}
+
+// loadClients creates the clients of the topics in config and of the topics
+// created at runtime, without changing the backend's state. newKeys are keys
+// generated for new topics which have yet to be stored. The returned stored
+// keys are to be kept once the clients are used. See [keepStoredKeys].
+func loadClients(config *ConfigFile, backend Backend, options Options, newKeys map[string]string) (map[string]Client, []*storedKey, error) {
+	topicConfigs, err := backend.TopicConfigs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	clients := make(map[string]Client)
+	var storedKeys []*storedKey
+	for topicName, topic := range config.Topics {
+		client, storedKey, err := loadClient(backend, topicName, topic, TopicSourceConfig, options, newKeys)
+		if err != nil {
+			return nil, nil, err
 		}
 
-		if !found {
-			slog.Info("Identified removed topic, removing secrets", slog.String("topic", clientTopicName))
-			delete(secrets.Clients, clientTopicName)
+		clients[topicName] = client
+		if storedKey != nil {
+			storedKeys = append(storedKeys, storedKey)
 		}
 	}
 
-	// Generate secrets for new topics
-	for topicName := range config.Topics {
-		_, ok := secrets.Clients[topicName]
-		if !ok {
-			slog.Info("Identified new topic, generating secrets", slog.String("topic", topicName))
+	for topicName, topic := range topicConfigs {
+		if _, ok := config.Topics[topicName]; ok {
+			slog.Warn("Topic created through the API is also configured in config.json, using config.json", slog.String("topic", topicName))
+			continue
+		}
 
-			privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-			if err != nil {
-				return err
-			}
+		client, storedKey, err := loadClient(backend, topicName, topic, TopicSourceAPI, options, newKeys)
+		if err != nil {
+			return nil, nil, err
+		}
 
-			privateKeyBytes, err := privateKey.Bytes()
-			if err != nil {
-				return err
-			}
+		clients[topicName] = client
+		if storedKey != nil {
+			storedKeys = append(storedKeys, storedKey)
+		}
+	}
 
-			privateKeyPEM := pem.EncodeToMemory(&pem.Block{
-				Type:  "PRIVATE KEY",
-				Bytes: privateKeyBytes,
-			})
+	return clients, storedKeys, nil
+}
 
-			secrets.Clients[topicName] = ClientSecrets{
-				PrivateKey: string(privateKeyPEM),
-			}
-		}
+// loadClient reads the keys of a topic and creates its client, without
+// changing the backend's state.
+func loadClient(backend Backend, topicName string, topic Topic, source TopicSource, options Options, newKeys map[string]string) (Client, *storedKey, error) {
+	key, err := openKey(backend, topicName, topic, newKeys)
+	if err != nil {
+		return Client{}, nil, err
 	}
 
-	// Add subscriptions for new topics
-	for topicName := range config.Topics {
-		_, ok := subscriptions.Topics[topicName]
-		if !ok {
-			subscriptions.Topics[topicName] = make(map[string]webpush.Subscription)
-		}
+	client, err := newClient(topicName, topic, source, key, options)
+	if err != nil {
+		return Client{}, nil, err
 	}
 
-	err = writeJSON(filepath.Join(basePath, "secrets.json"), &secrets)
+	storedKey, err := loadKeys(backend, &client, options.keyGracePeriod())
 	if err != nil {
-		return err
+		return Client{}, nil, err
 	}
 
-	err = writeJSON(filepath.Join(basePath, "subscriptions.json"), &subscriptions)
+	return client, storedKey, nil
+}
+
+// openKey opens the key of a topic, which is either held by a key provider,
+// generated but not yet stored (see [loadClients]) or stored by the backend.
+func openKey(backend Backend, topicName string, topic Topic, newKeys map[string]string) (crypto.Signer, error) {
+	if topic.Key != "" {
+		key, err := signer.Open(topic.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open key of topic %s: %w", topicName, err)
+		}
+
+		return key, nil
+	}
+
+	privateKeyPEM, ok := newKeys[topicName]
+	if !ok {
+		var err error
+		privateKeyPEM, err = backend.PrivateKey(topicName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret of topic %s: %w", topicName, err)
+		}
+	}
+
+	privateKey, err := parsePrivateKey(privateKeyPEM)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("invalid secret of topic %s: %w", topicName, err)
 	}
 
-	return nil
+	return privateKey, nil
 }
 
-func Load(basePath string) (*Store, error) {
-	var config ConfigFile
-	err := readJSON(filepath.Join(basePath, "config.json"), &config)
+// storedKey is a key stored by the backend for a topic whose key is held by a
+// key provider. It's kept as a rotated key, so that subscriptions made with it
+// are notified of the changed key rather than removed.
+type storedKey struct {
+	topic      string
+	keyID      string
+	privateKey *ecdsa.PrivateKey
+	// previousKey is nil if the key provider holds the same key, which then
+	// needs no grace period.
+	previousKey *PreviousKey
+}
+
+// loadKeys reads the rotated keys of a client's topic, including the key the
+// backend stores for it if it's held by a key provider. The returned stored
+// key, if any, is to be kept once the client is used. See [storedKey.keep].
+func loadKeys(backend Backend, client *Client, gracePeriod time.Duration) (*storedKey, error) {
+	previousKeys, err := loadPreviousKeys(backend, client.topic)
 	if err != nil {
 		return nil, err
 	}
 
-	var secrets SecretsFile
-	err = readJSON(filepath.Join(basePath, "secrets.json"), &secrets)
+	storedKey, err := readStoredKey(backend, client, gracePeriod)
 	if err != nil {
 		return nil, err
 	}
 
-	var subscriptions SubscriptionsFile
-	err = readJSON(filepath.Join(basePath, "subscriptions.json"), &subscriptions)
+	if storedKey != nil && storedKey.previousKey != nil {
+		previousKeys[storedKey.keyID], err = newPreviousKey(storedKey.privateKey, storedKey.previousKey.RetireAt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret of topic %s: %w", client.topic, err)
+		}
+	}
+
+	client.previousKeys = previousKeys
+	return storedKey, nil
+}
+
+// readStoredKey reads the key stored by the backend for a topic whose key is
+// held by a key provider. Returns nil if there's none.
+func readStoredKey(backend Backend, client *Client, gracePeriod time.Duration) (*storedKey, error) {
+	if client.key == "" {
+		return nil, nil
+	}
+
+	privateKeyPEM, err := backend.PrivateKey(client.topic)
+	if err == ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read secret of topic %s: %w", client.topic, err)
+	}
+
+	privateKey, err := parsePrivateKey(privateKeyPEM)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid secret of topic %s: %w", client.topic, err)
 	}
 
-	clients := make(map[string]Client)
-	for topicName, topic := range config.Topics {
-		secrets, ok := secrets.Clients[topicName]
-		if !ok {
-			return nil, fmt.Errorf("invalid secrets file")
+	storedKeyID, err := keyID(&privateKey.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret of topic %s: %w", client.topic, err)
+	}
+
+	storedKey := &storedKey{
+		topic:      client.topic,
+		keyID:      storedKeyID,
+		privateKey: privateKey,
+	}
+
+	if storedKey.keyID != client.keyID {
+		storedKey.previousKey = &PreviousKey{
+			PrivateKey: privateKeyPEM,
+			RetireAt:   time.Now().Add(gracePeriod),
+		}
+	}
+
+	return storedKey, nil
+}
+
+// keep moves the stored key to the topic's rotated keys. Does nothing if k is
+// nil.
+func (k *storedKey) keep(backend Backend) error {
+	if k == nil {
+		return nil
+	}
+
+	if k.previousKey != nil {
+		// NOTE: The stored key is kept before being deleted, so that it's never
+		// lost
+		if err := backend.SetPreviousKey(k.topic, k.keyID, *k.previousKey); err != nil {
+			return err
 		}
 
-		block, rest := pem.Decode([]byte(secrets.PrivateKey))
-		if len(rest) > 0 {
-			return nil, fmt.Errorf("invalid secret in secrets file")
+		slog.Info("Replaced stored key with key provider, keeping the stored key for existing subscriptions", slog.String("topic", k.topic), slog.String("previousKeyId", k.keyID), slog.Time("retireAt", k.previousKey.RetireAt))
+	}
+
+	return backend.DeletePrivateKey(k.topic)
+}
+
+// keepStoredKeys keeps the stored keys returned by [loadClients].
+func keepStoredKeys(backend Backend, storedKeys []*storedKey) error {
+	for _, storedKey := range storedKeys {
+		if err := storedKey.keep(backend); err != nil {
+			return err
 		}
+	}
+
+	return nil
+}
+
+// loadPreviousKeys reads the rotated keys of a topic.
+func loadPreviousKeys(backend Backend, topicName string) (map[string]previousKey, error) {
+	previousKeys := make(map[string]previousKey)
 
-		privateKey, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), block.Bytes)
+	keys, err := backend.PreviousKeys(topicName)
+	if err == ErrTopicNotFound {
+		return previousKeys, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read rotated keys of topic %s: %w", topicName, err)
+	}
+
+	for keyID, key := range keys {
+		privateKey, err := parsePrivateKey(key.PrivateKey)
 		if err != nil {
-			return nil, fmt.Errorf("invalid secret in secrets file: %w", err)
+			return nil, fmt.Errorf("invalid rotated key %s of topic %s: %w", keyID, topicName, err)
 		}
 
-		clients[topicName] = Client{
-			topic:      topicName,
-			name:       topic.Name,
-			shortName:  topic.ShortName,
-			privateKey: privateKey,
+		previousKeys[keyID], err = newPreviousKey(privateKey, key.RetireAt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rotated key %s of topic %s: %w", keyID, topicName, err)
 		}
 	}
 
-	return &Store{
-		basePath:      basePath,
-		clients:       clients,
-		subscriptions: subscriptions.Topics,
+	return previousKeys, nil
+}
+
+// newClient creates the client of a topic, signing push messages using key.
+func newClient(topicName string, topic Topic, source TopicSource, key crypto.Signer, options Options) (Client, error) {
+	if err := topic.Validate(); err != nil {
+		return Client{}, fmt.Errorf("invalid topic %s: %w", topicName, err)
+	}
+
+	publicKey, err := vapid.PublicKey(key)
+	if err != nil {
+		return Client{}, fmt.Errorf("invalid key of topic %s: %w", topicName, err)
+	}
+
+	// NOTE: URLs are validated above
+	var baseURL *url.URL
+	if topic.BaseURL != "" {
+		baseURL, _ = url.Parse(topic.BaseURL)
+	}
+
+	var publicURL *url.URL
+	if topic.PublicURL != "" {
+		publicURL, _ = url.Parse(topic.PublicURL)
+	} else if options.PublicURL != "" {
+		publicURL, _ = url.Parse(options.PublicURL)
+	}
+
+	subject := topic.VAPIDSubject
+	if subject == "" {
+		subject = options.VAPIDSubject
+	}
+
+	// Unless configured, default to the public URL which the operator can be
+	// contacted through
+	if subject == "" && publicURL != nil && publicURL.Scheme == "https" {
+		subject = publicURL.String()
+	}
+
+	// NOTE: Push services reject push messages without a valid subject
+	if subject == "" {
+		return Client{}, fmt.Errorf("no VAPID subject configured for topic %s - configure a mailto: or https: VAPID subject, or an https public URL", topicName)
+	}
+
+	if err := vapid.ValidateSubject(subject); err != nil {
+		return Client{}, fmt.Errorf("invalid VAPID subject of topic %s: %w", topicName, err)
+	}
+
+	id, err := keyID(publicKey)
+	if err != nil {
+		return Client{}, fmt.Errorf("invalid key of topic %s: %w", topicName, err)
+	}
+
+	applicationServerKey, err := encodePublicKey(publicKey)
+	if err != nil {
+		return Client{}, fmt.Errorf("invalid key of topic %s: %w", topicName, err)
+	}
+
+	return Client{
+		topic:                topicName,
+		name:                 topic.Name,
+		shortName:            topic.ShortName,
+		defaultTTL:           topic.DefaultTTL,
+		defaultUrgency:       topic.DefaultUrgency,
+		maxTTL:               topic.MaxTTL,
+		baseURL:              baseURL,
+		presets:              topic.Presets,
+		publicURL:            publicURL,
+		subject:              subject,
+		source:               source,
+		key:                  topic.Key,
+		signer:               key,
+		publicKey:            publicKey,
+		keyID:                id,
+		applicationServerKey: applicationServerKey,
+		previousKeys:         make(map[string]previousKey),
+		tokens:               options.TokenCache,
 	}, nil
 }
 
+// keyID returns an identifier of a VAPID key, derived from its public key,
+// which is safe to store and log.
+func keyID(publicKey *ecdsa.PublicKey) (string, error) {
+	raw, err := publicKeyBytes(publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha256.Sum256(raw)
+	return hex.EncodeToString(digest[:8]), nil
+}
+
+// encodePublicKey returns the base64url encoded public key of a VAPID key, as
+// used for the applicationServerKey of subscriptions.
+func encodePublicKey(publicKey *ecdsa.PublicKey) (string, error) {
+	raw, err := publicKeyBytes(publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// publicKeyBytes returns the uncompressed public key of a VAPID key.
+func publicKeyBytes(publicKey *ecdsa.PublicKey) ([]byte, error) {
+	raw, err := publicKey.Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+
+	return raw, nil
+}
+
+// generatePrivateKey generates a PEM-encoded VAPID key.
+func generatePrivateKey() (string, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	return encodePrivateKey(privateKey)
+}
+
+// encodePrivateKey PEM-encodes a VAPID key.
+func encodePrivateKey(privateKey *ecdsa.PrivateKey) (string, error) {
+	privateKeyBytes, err := privateKey.Bytes()
+	if err != nil {
+		return "", err
+	}
+
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: privateKeyBytes,
+	})
+
+	return string(privateKeyPEM), nil
+}
+
+// parsePrivateKey parses a PEM-encoded VAPID key.
+func parsePrivateKey(privateKeyPEM string) (*ecdsa.PrivateKey, error) {
+	block, rest := pem.Decode([]byte(privateKeyPEM))
+	if block == nil || len(rest) > 0 {
+		return nil, fmt.Errorf("invalid PEM")
+	}
+
+	return ecdsa.ParseRawPrivateKey(elliptic.P256(), block.Bytes)
+}
+
 func (s *Store) Client(topic string) (Client, bool) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 
 	client, ok := s.clients[topic]
 	return client, ok
 }
 
-func (s *Store) AddSubscription(topic string, id string, subscription webpush.Subscription) error {
+// Clients returns the clients of all topics, sorted by topic.
+func (s *Store) Clients() []Client {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	clients := make([]Client, 0, len(s.clients))
+	for _, topic := range slices.Sorted(maps.Keys(s.clients)) {
+		clients = append(clients, s.clients[topic])
+	}
+
+	return clients
+}
+
+// CreateTopic creates a topic at runtime, generating its key. The topic is
+// served immediately and its configuration is persisted by the backend. If the
+// topic was previously archived, it's restored along with its key and
+// subscriptions. Returns [ErrTopicExists] if the topic already exists.
+func (s *Store) CreateTopic(topicName string, topic Topic) (Client, error) {
+	if err := ValidateTopicName(topicName); err != nil {
+		return Client{}, err
+	}
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	subscriptions, ok := s.subscriptions[topic]
-	if !ok {
-		return ErrTopicNotFound
+	if _, ok := s.clients[topicName]; ok {
+		return Client{}, ErrTopicExists
 	}
 
-	subscriptions[id] = subscription
-	return nil
+	// NOTE: The topic is validated before its key is generated, so that no key
+	// is stored for an invalid topic
+	if err := topic.Validate(); err != nil {
+		return Client{}, fmt.Errorf("invalid topic %s: %w", topicName, err)
+	}
+
+	if err := s.ensureKey(topicName, topic); err != nil {
+		return Client{}, err
+	}
+
+	client, storedKey, err := loadClient(s.backend, topicName, topic, TopicSourceAPI, s.options, nil)
+	if err != nil {
+		return Client{}, err
+	}
+
+	if err := s.backend.CreateTopic(topicName); err != nil {
+		return Client{}, err
+	}
+
+	if err := s.backend.RestoreTopic(topicName); err != nil {
+		return Client{}, err
+	}
+
+	if err := s.backend.SetTopicConfig(topicName, topic); err != nil {
+		return Client{}, err
+	}
+
+	if err := storedKey.keep(s.backend); err != nil {
+		return Client{}, err
+	}
+
+	s.clients[topicName] = client
+	slog.Info("Created topic", slog.String("topic", topicName))
+	return client, nil
 }
 
-func (s *Store) GetSubscription(topic string, id string) (webpush.Subscription, error) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+// ensureKey generates the key of a topic, unless it's held by a key provider
+// or the backend already stores one, such as for previously archived topics.
+func (s *Store) ensureKey(topicName string, topic Topic) error {
+	if topic.Key != "" {
+		return nil
+	}
 
-	subscriptions, ok := s.subscriptions[topic]
-	if !ok {
-		return webpush.Subscription{}, ErrTopicNotFound
+	_, err := s.backend.PrivateKey(topicName)
+	if err == nil {
+		slog.Info("Using previously stored key of topic", slog.String("topic", topicName))
+		return nil
+	} else if err != ErrKeyNotFound {
+		return err
+	}
+
+	privateKeyPEM, err := generatePrivateKey()
+	if err != nil {
+		return err
 	}
 
-	subscription, ok := subscriptions[id]
+	return s.backend.SetPrivateKey(topicName, privateKeyPEM)
+}
+
+// UpdateTopic updates the configuration of a topic created at runtime. Returns
+// [ErrTopicNotFound] if the topic doesn't exist or [ErrTopicInConfig] if it's
+// configured in config.json.
+func (s *Store) UpdateTopic(topicName string, topic Topic) (Client, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	existing, ok := s.clients[topicName]
 	if !ok {
-		return webpush.Subscription{}, ErrSubscriptionNotFound
+		return Client{}, ErrTopicNotFound
+	} else if existing.source != TopicSourceAPI {
+		return Client{}, ErrTopicInConfig
+	}
+
+	if err := topic.Validate(); err != nil {
+		return Client{}, fmt.Errorf("invalid topic %s: %w", topicName, err)
+	}
+
+	key := existing.signer
+	if topic.Key != existing.key {
+		if err := s.ensureKey(topicName, topic); err != nil {
+			return Client{}, err
+		}
+
+		var err error
+		key, err = openKey(s.backend, topicName, topic, nil)
+		if err != nil {
+			return Client{}, err
+		}
+	}
+
+	client, err := newClient(topicName, topic, TopicSourceAPI, key, s.options)
+	if err != nil {
+		return Client{}, err
+	}
+
+	storedKey, err := loadKeys(s.backend, &client, s.options.keyGracePeriod())
+	if err != nil {
+		return Client{}, err
 	}
 
-	return subscription, nil
+	if err := s.backend.SetTopicConfig(topicName, topic); err != nil {
+		return Client{}, err
+	}
+
+	if err := storedKey.keep(s.backend); err != nil {
+		return Client{}, err
+	}
+
+	s.clients[topicName] = client
+	return client, nil
 }
 
-func (s *Store) DeleteSubscription(topic string, id string) error {
+// DeleteTopic deletes a topic created at runtime. Like topics removed from
+// config.json, the topic is archived along with its key and subscriptions
+// until purged. See [PurgeTopic]. Returns [ErrTopicNotFound] if the topic
+// doesn't exist or [ErrTopicInConfig] if it's configured in config.json.
+func (s *Store) DeleteTopic(topicName string) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	subscriptions, ok := s.subscriptions[topic]
+	existing, ok := s.clients[topicName]
 	if !ok {
 		return ErrTopicNotFound
+	} else if existing.source != TopicSourceAPI {
+		return ErrTopicInConfig
 	}
 
-	_, ok = subscriptions[id]
-	if !ok {
-		return ErrSubscriptionNotFound
+	if err := s.backend.ArchiveTopic(topicName, time.Now()); err != nil {
+		return err
 	}
 
-	delete(subscriptions, id)
+	if err := s.backend.DeleteTopicConfig(topicName); err != nil {
+		return err
+	}
+
+	delete(s.clients, topicName)
+	slog.Info("Deleted topic, archiving it", slog.String("topic", topicName))
 	return nil
 }
 
-func (s *Store) GetSubscriptions(topic string) ([]webpush.Subscription, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+// AddSubscription adds or updates a subscription. The creation time, and the
+// label unless a new one is specified, are kept when updating a subscription,
+// along with its delivery metadata. Subscriptions without a key id are made
+// with the topic's current key.
+func (s *Store) AddSubscription(topic string, id string, subscription Subscription) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 
-	subscriptions, ok := s.subscriptions[topic]
+	client, ok := s.clients[topic]
 	if !ok {
+		return ErrTopicNotFound
+	}
+
+	if subscription.KeyID == "" {
+		subscription.KeyID = client.keyID
+	}
+
+	now := time.Now()
+	subscription.Created = now
+	subscription.Updated = now
+
+	// NOTE: The subscription is merged by the backend, so that concurrently
+	// recorded deliveries aren't lost
+	return s.backend.MergeSubscription(topic, id, subscription)
+}
+
+// mergeSubscription returns subscription as an update of existing. The
+// creation time, and the label unless a new one is specified, are kept along
+// with the delivery metadata.
+func mergeSubscription(existing Subscription, subscription Subscription) Subscription {
+	if !existing.Created.IsZero() {
+		subscription.Created = existing.Created
+	}
+
+	if subscription.Label == "" {
+		subscription.Label = existing.Label
+	}
+
+	subscription.LastDelivered = existing.LastDelivered
+	subscription.Failures = existing.Failures
+	return subscription
+}
+
+func (s *Store) GetSubscription(topic string, id string) (Subscription, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if _, ok := s.clients[topic]; !ok {
+		return Subscription{}, ErrTopicNotFound
+	}
+
+	return s.backend.GetSubscription(topic, id)
+}
+
+func (s *Store) DeleteSubscription(topic string, id string) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if _, ok := s.clients[topic]; !ok {
+		return ErrTopicNotFound
+	}
+
+	return s.backend.DeleteSubscription(topic, id)
+}
+
+// GetSubscriptions returns all subscriptions of a topic, keyed by their id.
+func (s *Store) GetSubscriptions(topic string) (map[string]Subscription, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if _, ok := s.clients[topic]; !ok {
 		return nil, ErrTopicNotFound
 	}
 
-	return slices.Collect(maps.Values(subscriptions)), nil
+	return s.backend.GetSubscriptions(topic)
 }
 
-func (s *Store) Save(basePath string) error {
+// RecordDelivery records whether or not a push message was delivered to a
+// subscription.
+func (s *Store) RecordDelivery(topic string, id string, delivered bool) error {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	secrets := SecretsFile{
-		Clients: make(map[string]ClientSecrets),
+	if _, ok := s.clients[topic]; !ok {
+		return ErrTopicNotFound
 	}
 
-	for topic, client := range s.clients {
-		privateKeyBytes, err := client.privateKey.Bytes()
-		if err != nil {
-			return err
-		}
+	return s.backend.RecordDelivery(topic, id, delivered, time.Now())
+}
 
-		privateKey := pem.EncodeToMemory(&pem.Block{
-			Type:  "PRIVATE KEY",
-			Bytes: privateKeyBytes,
-		})
+// RotateKey replaces the key of a topic with a newly generated one. The
+// previous key remains valid for existing subscriptions until they have
+// re-subscribed using the new key, or until gracePeriod has passed. See
+// [Store.RetireKeys]. Returns [ErrTopicNotFound] if the topic doesn't exist or
+// [ErrExternalKey] if its key is held by a key provider.
+func (s *Store) RotateKey(topicName string, gracePeriod time.Duration) (Client, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-		secrets.Clients[topic] = ClientSecrets{
-			PrivateKey: string(privateKey),
-		}
+	client, ok := s.clients[topicName]
+	if !ok {
+		return Client{}, ErrTopicNotFound
+	} else if client.key != "" {
+		return Client{}, ErrExternalKey
 	}
 
-	subscriptions := SubscriptionsFile{
-		Topics: s.subscriptions,
+	privateKeyPEM, err := generatePrivateKey()
+	if err != nil {
+		return Client{}, err
 	}
 
-	err := writeJSON(filepath.Join(basePath, "secrets.json"), &secrets)
+	privateKey, err := parsePrivateKey(privateKeyPEM)
 	if err != nil {
-		return err
+		return Client{}, err
 	}
 
-	err = writeJSON(filepath.Join(basePath, "subscriptions.json"), &subscriptions)
+	client, err = s.replaceKey(client, privateKey, gracePeriod)
 	if err != nil {
-		return err
+		return Client{}, err
 	}
 
-	return nil
+	slog.Info("Rotated key", slog.String("topic", topicName), slog.String("keyId", client.keyID))
+	return client, nil
 }
 
-func readJSON(path string, v any) error {
-	file, err := os.Open(path)
+// replaceKey replaces the key of a client's topic, keeping the current key as
+// a rotated key for gracePeriod. Returns [ErrExternalKey] if the current key
+// is held by a key provider. The store's mutex must be held.
+func (s *Store) replaceKey(client Client, privateKey *ecdsa.PrivateKey, gracePeriod time.Duration) (Client, error) {
+	currentKey, ok := client.signer.(*ecdsa.PrivateKey)
+	if client.key != "" || !ok {
+		return Client{}, ErrExternalKey
+	}
+
+	currentKeyPEM, err := encodePrivateKey(currentKey)
 	if err != nil {
-		return err
+		return Client{}, err
 	}
-	defer file.Close()
 
-	return json.NewDecoder(file).Decode(v)
-}
+	privateKeyPEM, err := encodePrivateKey(privateKey)
+	if err != nil {
+		return Client{}, err
+	}
 
-func writeJSON(path string, v any) error {
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	newKeyID, err := keyID(&privateKey.PublicKey)
 	if err != nil {
-		return err
+		return Client{}, err
 	}
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(v); err != nil {
-		file.Close()
-		return err
+	applicationServerKey, err := encodePublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return Client{}, err
+	}
+
+	retireAt := time.Now().Add(gracePeriod)
+
+	// NOTE: The current key is kept before being replaced, so that it's never
+	// lost
+	err = s.backend.SetPreviousKey(client.topic, client.keyID, PreviousKey{
+		PrivateKey: currentKeyPEM,
+		RetireAt:   retireAt,
+	})
+	if err != nil {
+		return Client{}, err
+	}
+
+	if err := s.backend.SetPrivateKey(client.topic, privateKeyPEM); err != nil {
+		return Client{}, err
+	}
+
+	previousKeys := maps.Clone(client.previousKeys)
+	previousKeys[client.keyID] = previousKey{
+		privateKey:           currentKey,
+		applicationServerKey: client.applicationServerKey,
+		retireAt:             retireAt,
+	}
+
+	// A rotated key may be made current again
+	if _, ok := previousKeys[newKeyID]; ok {
+		if err := s.backend.DeletePreviousKey(client.topic, newKeyID); err != nil {
+			return Client{}, err
+		}
+
+		delete(previousKeys, newKeyID)
+	}
+
+	slog.Info("Replaced key, keeping the previous key for existing subscriptions", slog.String("topic", client.topic), slog.String("previousKeyId", client.keyID), slog.Time("retireAt", retireAt))
+
+	client.signer = privateKey
+	client.publicKey = &privateKey.PublicKey
+	client.keyID = newKeyID
+	client.applicationServerKey = applicationServerKey
+	client.previousKeys = previousKeys
+	s.clients[client.topic] = client
+	return client, nil
+}
+
+// RetireKeys retires rotated keys which are no longer used by any
+// subscription, or whose grace period has passed at the specified time.
+// Subscriptions still using a retired key are removed, as push messages can no
+// longer be sent to them. Returns the number of retired keys.
+func (s *Store) RetireKeys(now time.Time) (int, error) {
+	// NOTE: The lock is held throughout, so that keys rotated meanwhile aren't
+	// lost when the clients are updated
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	retired := 0
+	for _, topic := range slices.Sorted(maps.Keys(s.clients)) {
+		client := s.clients[topic]
+		if len(client.previousKeys) == 0 {
+			continue
+		}
+
+		subscriptions, err := s.backend.GetSubscriptions(topic)
+		if err != nil {
+			return retired, err
+		}
+
+		subscriptionsByKey := make(map[string][]string)
+		for id, subscription := range subscriptions {
+			subscriptionsByKey[subscription.KeyID] = append(subscriptionsByKey[subscription.KeyID], id)
+		}
+
+		previousKeys := maps.Clone(client.previousKeys)
+		for keyID, key := range client.previousKeys {
+			ids := subscriptionsByKey[keyID]
+			if len(ids) > 0 && now.Before(key.retireAt) {
+				continue
+			}
+
+			for _, id := range ids {
+				err := s.backend.DeleteSubscription(topic, id)
+				if err != nil && err != ErrSubscriptionNotFound {
+					return retired, err
+				}
+
+				slog.Info("Removed subscription using retired key", slog.String("topic", topic), slog.String("subscription", id), slog.String("keyId", keyID))
+			}
+
+			if err := s.backend.DeletePreviousKey(topic, keyID); err != nil && err != ErrKeyNotFound {
+				return retired, err
+			}
+
+			delete(previousKeys, keyID)
+			slog.Info("Retired key", slog.String("topic", topic), slog.String("keyId", keyID), slog.Int("removedSubscriptions", len(ids)))
+			retired++
+		}
+
+		client.previousKeys = previousKeys
+		s.clients[topic] = client
+	}
+
+	return retired, nil
+}
+
+// SweepInterval is the interval at which expired subscriptions are removed.
+const SweepInterval = 1 * time.Hour
+
+// Sweep removes all subscriptions that have expired at the specified time.
+// Returns the number of removed subscriptions.
+func (s *Store) Sweep(now time.Time) (int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	topics := slices.Sorted(maps.Keys(s.clients))
+
+	removed := 0
+	for _, topic := range topics {
+		subscriptions, err := s.backend.GetSubscriptions(topic)
+		if err != nil {
+			return removed, err
+		}
+
+		for id, subscription := range subscriptions {
+			if !subscription.Expired(now) {
+				continue
+			}
+
+			err := s.backend.DeleteSubscription(topic, id)
+			if err == ErrSubscriptionNotFound {
+				continue
+			} else if err != nil {
+				return removed, err
+			}
+
+			slog.Info("Removed expired subscription", slog.String("topic", topic), slog.String("subscription", id))
+			removed++
+		}
 	}
 
-	return file.Close()
+	return removed, nil
+}
+
+// Run runs background work until ctx is done. Expired subscriptions are
+// removed and rotated keys are retired every [SweepInterval], config.json is
+// reloaded when changed and the backend's background work, such as saving
+// modifications, is run.
+func (s *Store) Run(ctx context.Context) error {
+	watcherDone := make(chan struct{})
+	go func() {
+		defer close(watcherDone)
+		s.watchConfig(ctx)
+	}()
+
+	sweeperDone := make(chan struct{})
+	go func() {
+		defer close(sweeperDone)
+
+		ticker := time.NewTicker(SweepInterval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := s.Sweep(time.Now()); err != nil {
+				slog.Error("Failed to remove expired subscriptions", slog.Any("error", err))
+			}
+
+			if _, err := s.RetireKeys(time.Now()); err != nil {
+				slog.Error("Failed to retire rotated keys", slog.Any("error", err))
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	var err error
+	if runner, ok := s.backend.(interface {
+		Run(context.Context) error
+	}); ok {
+		err = runner.Run(ctx)
+	} else {
+		<-ctx.Done()
+	}
+
+	<-sweeperDone
+	<-watcherDone
+	return err
+}
+
+// Close closes the store's backend.
+func (s *Store) Close() error {
+	return s.backend.Close()
 }
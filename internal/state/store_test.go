@@ -0,0 +1,589 @@
+package state
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AlexGustafsson/grapevine/internal/webpush"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testOptions are the options of stores in tests.
+var testOptions = Options{
+	VAPIDSubject: "mailto:push@example.com",
+}
+
+// testKeyID returns the id of a key.
+func testKeyID(t *testing.T, publicKey *ecdsa.PublicKey) string {
+	id, err := keyID(publicKey)
+	require.NoError(t, err)
+	return id
+}
+
+func newTestStore(t *testing.T) *Store {
+	basePath := t.TempDir()
+
+	config := ConfigFile{
+		Topics: map[string]Topic{
+			"default": {Name: "Default", ShortName: "Default"},
+		},
+	}
+	require.NoError(t, writeJSON(filepath.Join(basePath, "config.json"), &config))
+
+	backend, err := OpenJSONBackend(basePath, nil)
+	require.NoError(t, err)
+	require.NoError(t, Migrate(basePath, backend))
+
+	store, err := Load(basePath, backend, testOptions)
+	require.NoError(t, err)
+
+	return store
+}
+
+func TestWriteJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.json")
+
+	require.NoError(t, writeJSON(path, map[string]string{"key": "value"}))
+	require.NoError(t, writeJSON(path, map[string]string{"key": "other"}))
+
+	var actual map[string]string
+	require.NoError(t, readJSON(path, &actual))
+	assert.Equal(t, map[string]string{"key": "other"}, actual)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// No temporary files should be left behind
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestStoreRunSavesOnShutdown(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- store.Run(ctx)
+	}()
+
+	subscription := Subscription{
+		Subscription: webpush.Subscription{Endpoint: "https://push.example.com/1"},
+		Label:        "Phone",
+	}
+	require.NoError(t, store.AddSubscription("default", "1", subscription))
+
+	cancel()
+	require.NoError(t, <-done)
+	require.NoError(t, store.Close())
+
+	backend, err := OpenJSONBackend(store.BasePath(), nil)
+	require.NoError(t, err)
+
+	reloaded, err := Load(store.BasePath(), backend, testOptions)
+	require.NoError(t, err)
+
+	actual, err := reloaded.GetSubscription("default", "1")
+	require.NoError(t, err)
+	assert.Equal(t, subscription.Endpoint, actual.Endpoint)
+	assert.Equal(t, subscription.Label, actual.Label)
+}
+
+func TestStoreAddSubscriptionKeepsMetadata(t *testing.T) {
+	store := newTestStore(t)
+
+	subscription := Subscription{
+		Subscription: webpush.Subscription{Endpoint: "https://push.example.com/1"},
+		UserAgent:    "Mozilla/5.0",
+		Label:        "Phone",
+	}
+	require.NoError(t, store.AddSubscription("default", "1", subscription))
+	require.NoError(t, store.RecordDelivery("default", "1", false))
+
+	created, err := store.GetSubscription("default", "1")
+	require.NoError(t, err)
+	assert.False(t, created.Created.IsZero())
+
+	// Subscribing again without a label keeps the label and metadata
+	subscription.Label = ""
+	require.NoError(t, store.AddSubscription("default", "1", subscription))
+
+	updated, err := store.GetSubscription("default", "1")
+	require.NoError(t, err)
+	assert.True(t, created.Created.Equal(updated.Created))
+	assert.False(t, updated.Updated.Before(created.Updated))
+	assert.Equal(t, "Phone", updated.Label)
+	assert.Equal(t, 1, updated.Failures)
+}
+
+func TestStoreSweep(t *testing.T) {
+	store := newTestStore(t)
+
+	now := time.Now()
+	expired := Subscription{Subscription: webpush.Subscription{
+		Endpoint:       "https://push.example.com/1",
+		ExpirationTime: &webpush.Timestamp{Time: now.Add(-time.Minute)},
+	}}
+	valid := Subscription{Subscription: webpush.Subscription{
+		Endpoint:       "https://push.example.com/2",
+		ExpirationTime: &webpush.Timestamp{Time: now.Add(time.Minute)},
+	}}
+
+	require.NoError(t, store.AddSubscription("default", "1", expired))
+	require.NoError(t, store.AddSubscription("default", "2", valid))
+	require.NoError(t, store.AddSubscription("default", "3", Subscription{}))
+
+	removed, err := store.Sweep(now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+
+	subscriptions, err := store.GetSubscriptions("default")
+	require.NoError(t, err)
+	assert.Len(t, subscriptions, 2)
+	assert.NotContains(t, subscriptions, "1")
+}
+
+func TestStoreRotateKey(t *testing.T) {
+	store := newTestStore(t)
+
+	client, ok := store.Client("default")
+	require.True(t, ok)
+	previousKeyID := client.KeyID()
+	previousPublicKey := client.ApplicationServerKey()
+
+	require.NoError(t, store.AddSubscription("default", "1", Subscription{Subscription: webpush.Subscription{Endpoint: "https://push.example.com/1"}}))
+	require.NoError(t, store.AddSubscription("default", "2", Subscription{Subscription: webpush.Subscription{Endpoint: "https://push.example.com/2"}}))
+
+	now := time.Now()
+	client, err := store.RotateKey("default", time.Hour)
+	require.NoError(t, err)
+	assert.NotEqual(t, previousKeyID, client.KeyID())
+	assert.NotEqual(t, previousPublicKey, client.ApplicationServerKey())
+	assert.Contains(t, client.PreviousKeys(), previousKeyID)
+
+	// Existing subscriptions keep using the previous key
+	subscription, err := store.GetSubscription("default", "1")
+	require.NoError(t, err)
+	assert.Equal(t, previousKeyID, subscription.KeyID)
+
+	webPushClient, err := client.WebPushClientFor(subscription.KeyID)
+	require.NoError(t, err)
+	assert.Equal(t, previousPublicKey, webPushClient.PublicKeyString())
+
+	keyID, ok := client.KeyIDOf(previousPublicKey)
+	require.True(t, ok)
+	assert.Equal(t, previousKeyID, keyID)
+
+	// Re-subscribing migrates the subscription to the new key
+	require.NoError(t, store.AddSubscription("default", "1", Subscription{Subscription: webpush.Subscription{Endpoint: "https://push.example.com/1"}}))
+	subscription, err = store.GetSubscription("default", "1")
+	require.NoError(t, err)
+	assert.Equal(t, client.KeyID(), subscription.KeyID)
+
+	// The key is kept while used, until the grace period has passed
+	retired, err := store.RetireKeys(now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, retired)
+
+	// Rotated keys survive restarts
+	require.NoError(t, store.Close())
+	backend, err := OpenJSONBackend(store.BasePath(), nil)
+	require.NoError(t, err)
+	store, err = Load(store.BasePath(), backend, testOptions)
+	require.NoError(t, err)
+
+	client, ok = store.Client("default")
+	require.True(t, ok)
+	assert.Contains(t, client.PreviousKeys(), previousKeyID)
+
+	retired, err = store.RetireKeys(now.Add(2 * time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, retired)
+
+	client, ok = store.Client("default")
+	require.True(t, ok)
+	assert.Empty(t, client.PreviousKeys())
+
+	_, err = client.WebPushClientFor(previousKeyID)
+	assert.Equal(t, ErrKeyRetired, err)
+
+	// Subscriptions still using the retired key are removed
+	subscriptions, err := store.GetSubscriptions("default")
+	require.NoError(t, err)
+	assert.Len(t, subscriptions, 1)
+	assert.Contains(t, subscriptions, "1")
+
+	// Unused keys are retired immediately
+	_, err = store.RotateKey("default", time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, store.AddSubscription("default", "1", Subscription{Subscription: webpush.Subscription{Endpoint: "https://push.example.com/1"}}))
+
+	retired, err = store.RetireKeys(now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, retired)
+
+	_, err = store.RotateKey("other", time.Hour)
+	assert.Equal(t, ErrTopicNotFound, err)
+}
+
+func TestClientInvalidKey(t *testing.T) {
+	// A key provider may return a key that can't be used for VAPID
+	privateKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+
+	client := Client{topic: "default", subject: "mailto:push@example.com", signer: privateKey}
+
+	_, err = client.WebPushClient()
+	assert.ErrorContains(t, err, "invalid key of topic default")
+
+	_, err = client.WebPushClientFor("")
+	assert.Error(t, err)
+
+	_, err = client.WebPushClientFor("retired")
+	assert.Equal(t, ErrKeyRetired, err)
+}
+
+func TestStoreExternalKey(t *testing.T) {
+	basePath := t.TempDir()
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	privateKeyPEM, err := encodePrivateKey(privateKey)
+	require.NoError(t, err)
+
+	keyPath := filepath.Join(basePath, "key.pem")
+	require.NoError(t, os.WriteFile(keyPath, []byte(privateKeyPEM), 0600))
+
+	config := ConfigFile{
+		Topics: map[string]Topic{
+			"default": {Name: "Default", ShortName: "Default", Key: "file://" + keyPath},
+		},
+	}
+	require.NoError(t, writeJSON(filepath.Join(basePath, "config.json"), &config))
+
+	backend, err := OpenJSONBackend(basePath, nil)
+	require.NoError(t, err)
+	require.NoError(t, Migrate(basePath, backend))
+
+	// No key is generated for the topic
+	_, err = backend.PrivateKey("default")
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	store, err := Load(basePath, backend, testOptions)
+	require.NoError(t, err)
+
+	client, ok := store.Client("default")
+	require.True(t, ok)
+	assert.Equal(t, "file://"+keyPath, client.KeyURI())
+	assert.Equal(t, testKeyID(t, &privateKey.PublicKey), client.KeyID())
+
+	_, err = store.RotateKey("default", time.Hour)
+	assert.Equal(t, ErrExternalKey, err)
+
+	_, err = store.ImportKey("default", privateKey, time.Hour)
+	assert.Equal(t, ErrExternalKey, err)
+
+	config.Topics["default"] = Topic{Name: "Default", ShortName: "Default", Key: "other:key"}
+	require.NoError(t, writeJSON(filepath.Join(basePath, "config.json"), &config))
+	assert.ErrorContains(t, store.Reload(), "unsupported key URI")
+}
+
+func TestStoreSwitchToExternalKey(t *testing.T) {
+	store := newTestStore(t)
+
+	client, ok := store.Client("default")
+	require.True(t, ok)
+	previousKeyID := client.KeyID()
+	previousPublicKey := client.ApplicationServerKey()
+
+	require.NoError(t, store.AddSubscription("default", "1", Subscription{Subscription: webpush.Subscription{Endpoint: "https://push.example.com/1"}}))
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	privateKeyPEM, err := encodePrivateKey(privateKey)
+	require.NoError(t, err)
+
+	keyPath := filepath.Join(store.BasePath(), "key.pem")
+	require.NoError(t, os.WriteFile(keyPath, []byte(privateKeyPEM), 0600))
+
+	config := ConfigFile{
+		Topics: map[string]Topic{
+			"default": {Name: "Default", ShortName: "Default", Key: "file://" + keyPath},
+		},
+	}
+	require.NoError(t, writeJSON(filepath.Join(store.BasePath(), "config.json"), &config))
+
+	now := time.Now()
+	require.NoError(t, store.Reload())
+
+	client, ok = store.Client("default")
+	require.True(t, ok)
+	assert.Equal(t, testKeyID(t, &privateKey.PublicKey), client.KeyID())
+
+	// The stored key is kept for the grace period, like a rotated key
+	require.Contains(t, client.PreviousKeys(), previousKeyID)
+	assert.WithinDuration(t, now.Add(DefaultKeyGracePeriod), client.PreviousKeys()[previousKeyID], time.Minute)
+
+	_, err = store.backend.PrivateKey("default")
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// Existing subscriptions keep using the stored key
+	subscription, err := store.GetSubscription("default", "1")
+	require.NoError(t, err)
+	assert.Equal(t, previousKeyID, subscription.KeyID)
+
+	webPushClient, err := client.WebPushClientFor(subscription.KeyID)
+	require.NoError(t, err)
+	assert.Equal(t, previousPublicKey, webPushClient.PublicKeyString())
+
+	retired, err := store.RetireKeys(now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, retired)
+
+	// The stored key survives restarts
+	require.NoError(t, store.Close())
+	backend, err := OpenJSONBackend(store.BasePath(), nil)
+	require.NoError(t, err)
+	store, err = Load(store.BasePath(), backend, testOptions)
+	require.NoError(t, err)
+
+	client, ok = store.Client("default")
+	require.True(t, ok)
+	assert.Contains(t, client.PreviousKeys(), previousKeyID)
+}
+
+func TestLoadReadOnly(t *testing.T) {
+	store := newTestStore(t)
+
+	client, ok := store.Client("default")
+	require.True(t, ok)
+	storedKeyID := client.KeyID()
+	require.NoError(t, store.Close())
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	privateKeyPEM, err := encodePrivateKey(privateKey)
+	require.NoError(t, err)
+
+	keyPath := filepath.Join(store.BasePath(), "key.pem")
+	require.NoError(t, os.WriteFile(keyPath, []byte(privateKeyPEM), 0600))
+
+	config := ConfigFile{
+		Topics: map[string]Topic{
+			"default": {Name: "Default", ShortName: "Default", Key: "file://" + keyPath},
+		},
+	}
+	require.NoError(t, writeJSON(filepath.Join(store.BasePath(), "config.json"), &config))
+
+	backend, err := OpenJSONBackend(store.BasePath(), nil)
+	require.NoError(t, err)
+	defer backend.Close()
+
+	options := testOptions
+	options.ReadOnly = true
+	store, err = Load(store.BasePath(), backend, options)
+	require.NoError(t, err)
+
+	// The stored key is valid, but not moved
+	client, ok = store.Client("default")
+	require.True(t, ok)
+	assert.Contains(t, client.PreviousKeys(), storedKeyID)
+
+	_, err = backend.PrivateKey("default")
+	assert.NoError(t, err)
+
+	previousKeys, err := backend.PreviousKeys("default")
+	require.NoError(t, err)
+	assert.Empty(t, previousKeys)
+}
+
+func TestLoadRequiresSubject(t *testing.T) {
+	basePath := t.TempDir()
+	writeTestConfig(t, basePath, "default")
+
+	backend, err := OpenJSONBackend(basePath, nil)
+	require.NoError(t, err)
+	require.NoError(t, Migrate(basePath, backend))
+
+	testCases := []struct {
+		Name     string
+		Options  Options
+		Expected string
+	}{
+		{Name: "subject", Options: Options{VAPIDSubject: "mailto:push@example.com"}, Expected: "mailto:push@example.com"},
+		{Name: "https public URL", Options: Options{PublicURL: "https://example.com"}, Expected: "https://example.com"},
+		{Name: "http public URL", Options: Options{PublicURL: "http://example.com"}},
+		{Name: "localhost public URL", Options: Options{PublicURL: "https://localhost:8080"}},
+		{Name: "none", Options: Options{}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			store, err := Load(basePath, backend, testCase.Options)
+			if testCase.Expected == "" {
+				assert.ErrorContains(t, err, "VAPID subject")
+				return
+			}
+
+			require.NoError(t, err)
+			client, ok := store.Client("default")
+			require.True(t, ok)
+			assert.Equal(t, testCase.Expected, client.Subject())
+		})
+	}
+}
+
+func TestStoreTopics(t *testing.T) {
+	store := newTestStore(t)
+
+	_, err := store.CreateTopic("default", Topic{Name: "Default"})
+	assert.Equal(t, ErrTopicExists, err)
+
+	_, err = store.CreateTopic("invalid topic", Topic{Name: "Invalid"})
+	assert.Error(t, err)
+
+	// No key is stored for an invalid topic
+	_, err = store.CreateTopic("invalid", Topic{Name: "Invalid", BaseURL: "ftp://example.com"})
+	assert.ErrorContains(t, err, "invalid baseUrl")
+
+	_, err = store.backend.PrivateKey("invalid")
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	client, err := store.CreateTopic("alerts", Topic{Name: "Alerts"})
+	require.NoError(t, err)
+	assert.Equal(t, TopicSourceAPI, client.Source())
+	publicKey := client.ApplicationServerKey()
+
+	// The topic is served immediately
+	_, ok := store.Client("alerts")
+	assert.True(t, ok)
+
+	_, err = store.UpdateTopic("default", Topic{Name: "Other"})
+	assert.Equal(t, ErrTopicInConfig, err)
+
+	client, err = store.UpdateTopic("alerts", Topic{Name: "Alerts", ShortName: "A"})
+	require.NoError(t, err)
+	assert.Equal(t, "A", client.ShortName())
+	assert.Equal(t, publicKey, client.ApplicationServerKey())
+
+	require.NoError(t, store.AddSubscription("alerts", "1", Subscription{Subscription: webpush.Subscription{Endpoint: "https://push.example.com/1"}}))
+
+	// Topics created at runtime survive restarts and aren't archived when
+	// reconciling config.json
+	require.NoError(t, store.Close())
+	backend, err := OpenJSONBackend(store.BasePath(), nil)
+	require.NoError(t, err)
+	require.NoError(t, Migrate(store.BasePath(), backend))
+	store, err = Load(store.BasePath(), backend, testOptions)
+	require.NoError(t, err)
+
+	client, ok = store.Client("alerts")
+	require.True(t, ok)
+	assert.Equal(t, "A", client.ShortName())
+	assert.Equal(t, publicKey, client.ApplicationServerKey())
+
+	assert.Equal(t, ErrTopicInConfig, store.DeleteTopic("default"))
+	require.NoError(t, store.DeleteTopic("alerts"))
+	assert.Equal(t, ErrTopicNotFound, store.DeleteTopic("alerts"))
+
+	archivedTopics, err := backend.ArchivedTopics()
+	require.NoError(t, err)
+	assert.Contains(t, archivedTopics, "alerts")
+
+	// Re-creating the topic restores its key and subscriptions
+	client, err = store.CreateTopic("alerts", Topic{Name: "Alerts"})
+	require.NoError(t, err)
+	assert.Equal(t, publicKey, client.ApplicationServerKey())
+
+	_, err = store.GetSubscription("alerts", "1")
+	assert.NoError(t, err)
+}
+
+func TestStoreReload(t *testing.T) {
+	store := newTestStore(t)
+	path := filepath.Join(store.BasePath(), "config.json")
+
+	_, err := store.CreateTopic("alerts", Topic{Name: "Alerts"})
+	require.NoError(t, err)
+
+	assert.False(t, store.configChanged())
+
+	config := ConfigFile{
+		Topics: map[string]Topic{
+			"default": {Name: "Renamed", ShortName: "Default"},
+			"other":   {Name: "Other", ShortName: "Other"},
+		},
+	}
+	require.NoError(t, writeJSON(path, &config))
+	assert.True(t, store.configChanged())
+
+	require.NoError(t, store.Reload())
+	assert.False(t, store.configChanged())
+
+	client, ok := store.Client("default")
+	require.True(t, ok)
+	assert.Equal(t, "Renamed", client.Name())
+
+	// Keys are generated for new topics
+	_, ok = store.Client("other")
+	assert.True(t, ok)
+
+	// Topics created at runtime are kept
+	_, ok = store.Client("alerts")
+	assert.True(t, ok)
+
+	// An invalid config is not applied
+	config.Topics["other"] = Topic{Name: "Other", BaseURL: "invalid"}
+	delete(config.Topics, "default")
+	require.NoError(t, writeJSON(path, &config))
+	assert.Error(t, store.Reload())
+
+	_, ok = store.Client("default")
+	assert.True(t, ok)
+
+	// Nor is a config with topics which can't be served, leaving the state as
+	// is and retrying once changed again
+	config.Topics["other"] = Topic{Name: "Other"}
+	config.Topics["external"] = Topic{Name: "External", Key: "file://" + filepath.Join(store.BasePath(), "missing.pem")}
+	config.Topics["new"] = Topic{Name: "New"}
+	require.NoError(t, writeJSON(path, &config))
+	assert.ErrorContains(t, store.Reload(), "failed to open key of topic external")
+	assert.True(t, store.configChanged())
+
+	_, ok = store.Client("default")
+	assert.True(t, ok)
+
+	archivedTopics, err := store.backend.ArchivedTopics()
+	require.NoError(t, err)
+	assert.NotContains(t, archivedTopics, "default")
+
+	_, err = store.backend.PrivateKey("new")
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	delete(config.Topics, "external")
+	delete(config.Topics, "new")
+
+	// Removed topics are archived
+	config.Topics["other"] = Topic{Name: "Other"}
+	require.NoError(t, writeJSON(path, &config))
+	require.NoError(t, store.Reload())
+
+	_, ok = store.Client("default")
+	assert.False(t, ok)
+
+	archivedTopics, err = store.backend.ArchivedTopics()
+	require.NoError(t, err)
+	assert.Contains(t, archivedTopics, "default")
+}
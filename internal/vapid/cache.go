@@ -0,0 +1,107 @@
+package vapid
+
+import (
+	"crypto"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTokenExpiry is the default lifetime of tokens.
+	DefaultTokenExpiry = 1 * time.Hour
+	// MaxTokenExpiry is the maximum lifetime of tokens.
+	//
+	// SEE: https://datatracker.ietf.org/doc/html/rfc8292#section-2.
+	MaxTokenExpiry = 24 * time.Hour
+)
+
+// TokenCache caches tokens, which are valid for any push message to the same
+// push service until they expire. Tokens are cached per audience, subject and
+// signing key, and are refreshed once half of their lifetime has passed, so
+// that push messages are never sent with tokens about to expire. A TokenCache
+// is safe for concurrent use.
+type TokenCache struct {
+	expiry time.Duration
+
+	mutex  sync.Mutex
+	tokens map[tokenCacheKey]cachedToken
+}
+
+type tokenCacheKey struct {
+	audience string
+	subject  string
+	// publicKey is the uncompressed public key of the signing key.
+	publicKey string
+}
+
+type cachedToken struct {
+	token     string
+	refreshAt time.Time
+	expires   time.Time
+}
+
+// NewTokenCache returns a cache of tokens with the specified lifetime, which
+// must not exceed [MaxTokenExpiry].
+func NewTokenCache(expiry time.Duration) (*TokenCache, error) {
+	if expiry <= 0 || expiry > MaxTokenExpiry {
+		return nil, fmt.Errorf("invalid token expiry %s - must be positive and at most %s", expiry, MaxTokenExpiry)
+	}
+
+	return &TokenCache{
+		expiry: expiry,
+		tokens: make(map[tokenCacheKey]cachedToken),
+	}, nil
+}
+
+// Token returns a token for audience, signed by signer, at the specified
+// time. A cached token is returned if one is still fresh. See [NewToken].
+func (c *TokenCache) Token(audience string, subject string, signer crypto.Signer, now time.Time) (string, error) {
+	publicKey, err := PublicKey(signer)
+	if err != nil {
+		return "", err
+	}
+
+	// NOTE: The key is verified to be on the P-256 curve above
+	publicKeyBytes, _ := publicKey.Bytes()
+
+	key := tokenCacheKey{
+		audience:  audience,
+		subject:   subject,
+		publicKey: string(publicKeyBytes),
+	}
+
+	c.mutex.Lock()
+	cached, ok := c.tokens[key]
+	c.mutex.Unlock()
+
+	if ok && now.Before(cached.refreshAt) {
+		return cached.token, nil
+	}
+
+	// NOTE: Tokens are signed without holding the lock, as signers may be slow.
+	// Concurrent pushes may therefore sign redundant tokens, which is harmless
+	expires := now.Add(c.expiry)
+	token, err := NewToken(audience, expires, subject, signer)
+	if err != nil {
+		return "", err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Remove expired tokens, such as of rotated keys
+	for key, cached := range c.tokens {
+		if !now.Before(cached.expires) {
+			delete(c.tokens, key)
+		}
+	}
+
+	c.tokens[key] = cachedToken{
+		token:     token,
+		refreshAt: now.Add(c.expiry / 2),
+		expires:   expires,
+	}
+
+	return token, nil
+}
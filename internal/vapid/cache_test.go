@@ -0,0 +1,90 @@
+package vapid
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTokenCache(t *testing.T) {
+	_, err := NewTokenCache(time.Hour)
+	assert.NoError(t, err)
+
+	_, err = NewTokenCache(0)
+	assert.Error(t, err)
+
+	_, err = NewTokenCache(25 * time.Hour)
+	assert.Error(t, err)
+}
+
+func TestTokenCache(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	cache, err := NewTokenCache(time.Hour)
+	require.NoError(t, err)
+
+	now := time.Now()
+	const audience = "https://push.example.com"
+	const subject = "mailto:push@example.com"
+
+	token, err := cache.Token(audience, subject, key, now)
+	require.NoError(t, err)
+
+	// Tokens are reused until half of their lifetime has passed
+	cached, err := cache.Token(audience, subject, key, now.Add(29*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, token, cached)
+
+	refreshed, err := cache.Token(audience, subject, key, now.Add(30*time.Minute))
+	require.NoError(t, err)
+	assert.NotEqual(t, token, refreshed)
+
+	// Tokens are cached per audience, subject and key
+	_, err = cache.Token("https://push.example.net", subject, key, now)
+	require.NoError(t, err)
+
+	_, err = cache.Token(audience, "mailto:other@example.com", key, now)
+	require.NoError(t, err)
+
+	_, err = cache.Token(audience, subject, otherKey, now)
+	require.NoError(t, err)
+	assert.Len(t, cache.tokens, 4)
+
+	// Expired tokens are removed
+	_, err = cache.Token(audience, subject, key, now.Add(2*time.Hour))
+	require.NoError(t, err)
+	assert.Len(t, cache.tokens, 1)
+}
+
+func TestTokenCacheConcurrency(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	cache, err := NewTokenCache(time.Hour)
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			for range 16 {
+				_, err := cache.Token("https://push.example.com", "mailto:push@example.com", key, now)
+				assert.NoError(t, err)
+			}
+		})
+	}
+	wg.Wait()
+
+	assert.Len(t, cache.tokens, 1)
+}
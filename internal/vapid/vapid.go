@@ -1,13 +1,18 @@
 package vapid
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/asn1"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
 	"time"
 )
 
@@ -18,9 +23,16 @@ func FormatAuthorizationHeader(token string, key *ecdsa.PublicKey) string {
 	return fmt.Sprintf("%s t=%s, k=%s", AuthorizationScheme, token, k)
 }
 
-// NewToken creates a new VAPID JWT.
+// NewToken creates a new VAPID JWT, signed by signer. The signer's key must be
+// an ECDSA P-256 key, such as an [*ecdsa.PrivateKey] or a key kept outside the
+// process. Signers must return ASN.1 DER encoded signatures, like
+// [ecdsa.PrivateKey.Sign].
 // - expires MUST be less than 24 hours.
-func NewToken(audience string, expires time.Time, subject string, key *ecdsa.PrivateKey) (string, error) {
+func NewToken(audience string, expires time.Time, subject string, signer crypto.Signer) (string, error) {
+	if _, err := PublicKey(signer); err != nil {
+		return "", err
+	}
+
 	// SEE: https://datatracker.ietf.org/doc/html/rfc7519#section-5
 	header := map[string]any{
 		"typ": "JWT",
@@ -47,14 +59,74 @@ func NewToken(audience string, expires time.Time, subject string, key *ecdsa.Pri
 
 	hash := sha256.Sum256([]byte(jwt))
 
-	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	der, err := signer.Sign(rand.Reader, hash[:], crypto.SHA256)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("failed to sign token: %w", err)
+	}
+
+	// JWS uses the raw signature rather than DER
+	// SEE: https://datatracker.ietf.org/doc/html/rfc7518#section-3.4
+	var signature struct {
+		R, S *big.Int
+	}
+	if rest, err := asn1.Unmarshal(der, &signature); err != nil || len(rest) > 0 {
+		return "", fmt.Errorf("invalid signature - must be ASN.1 DER encoded")
+	}
+
+	if signature.R.Sign() <= 0 || signature.S.Sign() <= 0 || signature.R.BitLen() > 256 || signature.S.BitLen() > 256 {
+		return "", fmt.Errorf("invalid signature - not a P-256 signature")
+	}
+
+	raw := make([]byte, 64)
+	signature.R.FillBytes(raw[:32])
+	signature.S.FillBytes(raw[32:])
+
+	return jwt + "." + base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// PublicKey returns the public key of signer. Returns an error unless it's
+// an ECDSA P-256 key, as required by VAPID.
+func PublicKey(signer crypto.Signer) (*ecdsa.PublicKey, error) {
+	publicKey, ok := signer.Public().(*ecdsa.PublicKey)
+	if !ok || publicKey.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("unsupported key - must be an ECDSA P-256 key")
+	}
+
+	return publicKey, nil
+}
+
+// ValidateSubject returns an error if value is not a valid VAPID subject, that
+// is a mailto: or https: URL. Apple's push service also rejects subjects
+// pointing to localhost.
+//
+// SEE: https://datatracker.ietf.org/doc/html/rfc8292#section-2.1.
+func ValidateSubject(value string) error {
+	if value == "" {
+		return fmt.Errorf("missing subject")
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
 	}
 
-	signature := make([]byte, 64)
-	r.FillBytes(signature[:32])
-	s.FillBytes(signature[32:])
+	switch u.Scheme {
+	case "mailto":
+		if u.Opaque == "" || !strings.Contains(u.Opaque, "@") {
+			return fmt.Errorf("%q must contain an email address", value)
+		}
+	case "https":
+		if u.Host == "" {
+			return fmt.Errorf("%q must be an absolute https URL", value)
+		}
+
+		// Apple rejects subjects pointing to localhost
+		if hostname := u.Hostname(); hostname == "localhost" || strings.HasSuffix(hostname, ".localhost") {
+			return fmt.Errorf("%q must not point to localhost", value)
+		}
+	default:
+		return fmt.Errorf("%q must be a mailto: or https: URL", value)
+	}
 
-	return jwt + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+	return nil
 }
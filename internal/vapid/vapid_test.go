@@ -1,13 +1,18 @@
 package vapid
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
 	"fmt"
+	"io"
+	"math/big"
+	"strings"
 	"testing"
 	"time"
 
@@ -85,3 +90,77 @@ func TestNewToken(t *testing.T) {
 	fmt.Println(token)
 	fmt.Println()
 }
+
+// opaqueSigner hides the private key, like a key held outside of memory.
+type opaqueSigner struct {
+	key *ecdsa.PrivateKey
+}
+
+func (s opaqueSigner) Public() crypto.PublicKey {
+	return s.key.Public()
+}
+
+func (s opaqueSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.key.Sign(rand, digest, opts)
+}
+
+func TestNewTokenSigner(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	token, err := NewToken("https://push.example.com", time.Now().Add(1*time.Hour), "mailto:push@example.com", opaqueSigner{key: key})
+	require.NoError(t, err)
+
+	parts := strings.Split(token, ".")
+	require.Len(t, parts, 3)
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(t, err)
+	require.Len(t, signature, 64)
+
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	assert.True(t, ecdsa.Verify(&key.PublicKey, hash[:], r, s))
+
+	otherCurve, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+
+	_, err = NewToken("https://push.example.com", time.Now().Add(1*time.Hour), "mailto:push@example.com", otherCurve)
+	assert.Error(t, err)
+}
+
+func TestValidateSubject(t *testing.T) {
+	testCases := []struct {
+		Value string
+		Valid bool
+	}{
+		{Value: "mailto:push@example.com", Valid: true},
+		{Value: "https://example.com", Valid: true},
+		{Value: "https://example.com/contact", Valid: true},
+		{Value: "", Valid: false},
+		{Value: "mailto:", Valid: false},
+		{Value: "mailto:example.com", Valid: false},
+		{Value: "push@example.com", Valid: false},
+		{Value: "http://example.com", Valid: false},
+		{Value: "https://", Valid: false},
+		{Value: "https:///contact", Valid: false},
+		{Value: "https://localhost", Valid: false},
+		{Value: "https://localhost:8080/contact", Valid: false},
+		{Value: "https://grapevine.localhost", Valid: false},
+		{Value: "https://localhost.example.com", Valid: true},
+		{Value: "ftp://example.com", Valid: false},
+		{Value: "://example.com", Valid: false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Value, func(t *testing.T) {
+			err := ValidateSubject(testCase.Value)
+			if testCase.Valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package vapid
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidHeader is returned when an Authorization header isn't a valid
+	// VAPID header.
+	ErrInvalidHeader = errors.New("invalid authorization header")
+	// ErrInvalidToken is returned when a token is malformed or has invalid
+	// claims.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrInvalidSignature is returned when a token isn't signed by the key.
+	ErrInvalidSignature = errors.New("invalid token signature")
+	// ErrTokenExpired is returned when a token has expired.
+	ErrTokenExpired = errors.New("token has expired")
+	// ErrAudienceMismatch is returned when a token is for another push service.
+	ErrAudienceMismatch = errors.New("token audience doesn't match push service")
+)
+
+// Claims are the claims of a verified token.
+//
+// SEE: https://datatracker.ietf.org/doc/html/rfc8292#section-2.
+type Claims struct {
+	// Audience is the origin of the push service the token is for.
+	Audience string
+	// Expires is when the token expires.
+	Expires time.Time
+	// Subject is the contact of the application server, a mailto: or https:
+	// URL.
+	Subject string
+}
+
+// ParseAuthorizationHeader parses an Authorization header as formatted by
+// [FormatAuthorizationHeader], returning the token and the public key of the
+// application server.
+//
+// SEE: https://datatracker.ietf.org/doc/html/rfc8292#section-3.
+func ParseAuthorizationHeader(header string) (string, *ecdsa.PublicKey, error) {
+	scheme, params, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if !strings.EqualFold(scheme, AuthorizationScheme) {
+		return "", nil, fmt.Errorf("%w: scheme must be %s", ErrInvalidHeader, AuthorizationScheme)
+	}
+
+	values := make(map[string]string)
+	for param := range strings.SplitSeq(params, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			return "", nil, fmt.Errorf("%w: invalid parameter %q", ErrInvalidHeader, param)
+		}
+
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := values[name]; ok {
+			return "", nil, fmt.Errorf("%w: duplicate parameter %s", ErrInvalidHeader, name)
+		}
+
+		values[name] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+
+	token := values["t"]
+	if token == "" {
+		return "", nil, fmt.Errorf("%w: missing token (t)", ErrInvalidHeader)
+	}
+
+	if values["k"] == "" {
+		return "", nil, fmt.Errorf("%w: missing key (k)", ErrInvalidHeader)
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(values["k"], "="))
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: key (k) must be base64url encoded", ErrInvalidHeader)
+	}
+
+	key, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), raw)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: key (k) must be an uncompressed P-256 public key", ErrInvalidHeader)
+	}
+
+	return token, key, nil
+}
+
+// VerifyToken verifies that token is signed by key and valid at the specified
+// time for the push service with the origin audience. The token must expire
+// within [MaxTokenExpiry] and have a mailto: or https: subject, as required by
+// Apple's push service.
+func VerifyToken(token string, key *ecdsa.PublicKey, audience string, now time.Time) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, fmt.Errorf("%w: must be a JWS in compact serialization", ErrInvalidToken)
+	}
+
+	var header struct {
+		Type      string `json:"typ"`
+		Algorithm string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Claims{}, fmt.Errorf("%w: invalid header: %w", ErrInvalidToken, err)
+	}
+
+	if header.Algorithm != "ES256" {
+		return Claims{}, fmt.Errorf("%w: unsupported algorithm %q - must be ES256", ErrInvalidToken, header.Algorithm)
+	}
+
+	if header.Type != "" && !strings.EqualFold(header.Type, "JWT") {
+		return Claims{}, fmt.Errorf("%w: unsupported type %q - must be JWT", ErrInvalidToken, header.Type)
+	}
+
+	// SEE: https://datatracker.ietf.org/doc/html/rfc7518#section-3.4
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		return Claims{}, ErrInvalidSignature
+	}
+
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(key, hash[:], r, s) {
+		return Claims{}, ErrInvalidSignature
+	}
+
+	var claims struct {
+		Audience string       `json:"aud"`
+		Expires  *json.Number `json:"exp"`
+		Subject  string       `json:"sub"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Claims{}, fmt.Errorf("%w: invalid claims: %w", ErrInvalidToken, err)
+	}
+
+	if claims.Audience != audience {
+		return Claims{}, fmt.Errorf("%w: got %q, expected %q", ErrAudienceMismatch, claims.Audience, audience)
+	}
+
+	if claims.Expires == nil {
+		return Claims{}, fmt.Errorf("%w: missing expiry (exp)", ErrInvalidToken)
+	}
+
+	exp, err := claims.Expires.Int64()
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: expiry (exp) must be an integer", ErrInvalidToken)
+	}
+
+	expires := time.Unix(exp, 0)
+	if !now.Before(expires) {
+		return Claims{}, fmt.Errorf("%w: expired at %s", ErrTokenExpired, expires.UTC().Format(time.RFC3339))
+	}
+
+	if expires.After(now.Add(MaxTokenExpiry)) {
+		return Claims{}, fmt.Errorf("%w: expiry (exp) must be within %s", ErrInvalidToken, MaxTokenExpiry)
+	}
+
+	if err := ValidateSubject(claims.Subject); err != nil {
+		return Claims{}, fmt.Errorf("%w: invalid subject (sub): %w", ErrInvalidToken, err)
+	}
+
+	return Claims{
+		Audience: claims.Audience,
+		Expires:  expires,
+		Subject:  claims.Subject,
+	}, nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token.
+func decodeSegment(segment string, value any) error {
+	content, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(content, value)
+}
@@ -65,7 +65,7 @@ func NewServer(store *state.Store) *Server {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		err = indexTemplate.Execute(w, IndexData{
 			ManifestPath:         "/topics/default/manifest.json",
-			ApplicationServerKey: client.WebPushClient().PublicKeyString(),
+			ApplicationServerKey: client.ApplicationServerKey(),
 			Topic:                "default",
 		})
 		if err != nil {
@@ -86,7 +86,7 @@ func NewServer(store *state.Store) *Server {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		err = indexTemplate.Execute(w, IndexData{
 			ManifestPath:         fmt.Sprintf("/topics/%s/manifest.json", url.PathEscape(topic)),
-			ApplicationServerKey: client.WebPushClient().PublicKeyString(),
+			ApplicationServerKey: client.ApplicationServerKey(),
 			Topic:                url.PathEscape(topic),
 		})
 		if err != nil {
@@ -104,13 +104,20 @@ func NewServer(store *state.Store) *Server {
 			return
 		}
 
+		icon := fmt.Sprintf("/topics/%s/icon.png", url.PathEscape(topic))
+		startURL := fmt.Sprintf("/topics/%s", url.PathEscape(topic))
+		if publicURL := client.PublicURL(); publicURL != nil {
+			icon = publicURL.JoinPath("topics", topic, "icon.png").String()
+			startURL = publicURL.JoinPath("topics", topic).String()
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		err = manifestTemplate.Execute(w, ManifestData{
 			ID:        client.Topic(),
 			ShortName: client.ShortName(),
 			Name:      client.Name(),
-			Icon:      fmt.Sprintf("/topics/%s/icon.png", topic),
-			StartURL:  fmt.Sprintf("/topics/%s", topic),
+			Icon:      icon,
+			StartURL:  startURL,
 		})
 		if err != nil {
 			slog.Error("Failed to render manifest.json", slog.Any("error", err))
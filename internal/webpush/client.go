@@ -3,11 +3,13 @@ package webpush
 import (
 	"bytes"
 	"context"
+	"crypto"
 	"crypto/ecdh"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -19,7 +21,10 @@ import (
 
 type Client interface {
 	PublicKeyString() string
-	Push(context.Context, *PushTarget, []byte, *PushOptions) error
+	// AuthorizationHeader returns the VAPID Authorization header of push
+	// messages sent to push services with the origin audience.
+	AuthorizationHeader(audience string) (string, error)
+	Push(context.Context, *PushTarget, []byte, *PushOptions) (*PushResponse, error)
 }
 
 // Client implements a Web Push Application Server.
@@ -32,24 +37,44 @@ type Client interface {
 //
 // SEE: Apple docs - https://developer.apple.com/documentation/usernotifications/sending-web-push-notifications-in-web-apps-and-browsers#Send-your-notification-request-to-the-recipients-endpoint
 type client struct {
-	subject        string
-	signingKey     *ecdsa.PrivateKey
-	keyExchangeKey *ecdh.PrivateKey
+	subject   string
+	signer    crypto.Signer
+	publicKey *ecdsa.PublicKey
+	tokens    *vapid.TokenCache
 }
 
-func NewClient(subject string, signingKey *ecdsa.PrivateKey, keyExchangeKey *ecdh.PrivateKey) Client {
-	return &client{
-		subject:        subject,
-		signingKey:     signingKey,
-		keyExchangeKey: keyExchangeKey,
+// NewClient returns a client signing VAPID tokens using signer. The signer's
+// key must be an ECDSA P-256 key, but doesn't need to be held in memory. See
+// [vapid.NewToken]. Tokens are reused from tokens, which may be shared by
+// clients. If nil, a token valid for [vapid.DefaultTokenExpiry] is signed for
+// every push message.
+func NewClient(subject string, signer crypto.Signer, tokens *vapid.TokenCache) (Client, error) {
+	publicKey, err := vapid.PublicKey(signer)
+	if err != nil {
+		return nil, err
 	}
+
+	return &client{
+		subject:   subject,
+		signer:    signer,
+		publicKey: publicKey,
+		tokens:    tokens,
+	}, nil
 }
 
 func (c *client) PublicKeyString() string {
-	return base64.RawURLEncoding.EncodeToString(c.keyExchangeKey.PublicKey().Bytes())
+	// NOTE: The key is verified to be on the P-256 curve in NewClient
+	publicKey, _ := c.publicKey.ECDH()
+	return base64.RawURLEncoding.EncodeToString(publicKey.Bytes())
 }
 
 type PushOptions struct {
+	// TTL is the number of seconds the push service retains the message if the
+	// user agent isn't reachable. A TTL of 0 requires the message to be
+	// delivered immediately. The TTL header is required by push services, so it
+	// is always sent.
+	//
+	// SEE: https://www.rfc-editor.org/rfc/rfc8030.html#section-5.2.
 	TTL         int64
 	ContentType string
 	// Indication of whether to send the notification immediately or prioritize
@@ -74,6 +99,40 @@ const (
 	UrgencyHigh    Urgency = "high"
 )
 
+// Valid returns whether or not the urgency is one of the defined values.
+//
+// SEE: https://www.rfc-editor.org/rfc/rfc8030.html#section-5.3.
+func (u Urgency) Valid() bool {
+	switch u {
+	case UrgencyVeryLow, UrgencyLow, UrgencyNormal, UrgencyHigh:
+		return true
+	default:
+		return false
+	}
+}
+
+// PushResponse is the response of a push service to a push message.
+type PushResponse struct {
+	StatusCode int
+	// Location is the URL of the push message resource created by the push
+	// service, if any.
+	Location string
+	// Body is the (possibly truncated) response body.
+	Body string
+}
+
+// maxResponseBodySize is the maximum number of bytes read from a push
+// service's response body.
+const maxResponseBodySize = 4096
+
+// PushTimeout is the maximum time a push message may take to be sent to a push
+// service, including reading its response.
+const PushTimeout = 30 * time.Second
+
+// httpClient sends push messages. It's shared by all clients, so that
+// connections to push services are reused.
+var httpClient = &http.Client{Timeout: PushTimeout}
+
 type PushTarget struct {
 	Endpoint             string
 	UserAgentPublicKey   *ecdh.PublicKey
@@ -89,26 +148,26 @@ func (p PushTarget) Audience() (string, error) {
 	return u.Scheme + "://" + u.Host, nil
 }
 
-func (c *client) Push(ctx context.Context, target *PushTarget, content []byte, options *PushOptions) error {
+func (c *client) Push(ctx context.Context, target *PushTarget, content []byte, options *PushOptions) (*PushResponse, error) {
 	// SEE: https://www.rfc-editor.org/rfc/rfc8291.html#section-4
 	if len(content) > 3993 {
-		return fmt.Errorf("record size is too large - cannot exceed 3993B")
+		return nil, fmt.Errorf("record size is too large - cannot exceed 3993B")
 	}
 
 	audience, err := target.Audience()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	vapidToken, err := vapid.NewToken(audience, time.Now().Add(5*time.Minute), c.subject, c.signingKey)
+	authorization, err := c.AuthorizationHeader(audience)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Ephemeral sender key
 	privateKey, err := ecdh.P256().GenerateKey(rand.Reader)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	ikm, err := DeriveInputKeyingMaterial(
@@ -117,12 +176,12 @@ func (c *client) Push(ctx context.Context, target *PushTarget, content []byte, o
 		target.AuthenticationSecret,
 	)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var salt [16]byte
 	if _, err := rand.Read(salt[:]); err != nil {
-		return err
+		return nil, err
 	}
 
 	// An application server MUST encrypt a push message with a single record
@@ -133,18 +192,18 @@ func (c *client) Push(ctx context.Context, target *PushTarget, content []byte, o
 
 	ciphertext, err := aes128gcm.Encrypt(content, ikm, salt[:], privateKey.PublicKey().Bytes(), recordSize)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, target.Endpoint, bytes.NewReader(ciphertext))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.Endpoint, bytes.NewReader(ciphertext))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	req.Header.Set("Content-Encoding", "aes128gcm")
-	req.Header.Set("Authorization", vapid.FormatAuthorizationHeader(vapidToken, &c.signingKey.PublicKey))
+	req.Header.Set("Authorization", authorization)
 
-	if options != nil && options.TTL != 0 {
+	if options != nil {
 		req.Header.Set("TTL", strconv.FormatInt(options.TTL, 10))
 	}
 
@@ -160,17 +219,45 @@ func (c *client) Push(ctx context.Context, target *PushTarget, content []byte, o
 		req.Header.Set("Topic", options.Topic)
 	}
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := httpClient.Do(req)
 	if err != nil {
-		return err
+		return nil, &TransportError{Err: err}
 	}
 	defer res.Body.Close()
 
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxResponseBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	response := &PushResponse{
+		StatusCode: res.StatusCode,
+		Location:   res.Header.Get("Location"),
+		Body:       string(body),
+	}
+
 	if res.StatusCode != http.StatusCreated {
-		// TODO: Parse body and create a proper error
-		// {"reason":"VapidPkHashMismatch"}
-		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+		return response, parsePushError(target.Endpoint, res.StatusCode, res.Header, body, time.Now())
+	}
+
+	return response, nil
+}
+
+func (c *client) AuthorizationHeader(audience string) (string, error) {
+	token, err := c.token(audience)
+	if err != nil {
+		return "", err
+	}
+
+	return vapid.FormatAuthorizationHeader(token, c.publicKey), nil
+}
+
+// token returns a VAPID token for audience.
+func (c *client) token(audience string) (string, error) {
+	now := time.Now()
+	if c.tokens == nil {
+		return vapid.NewToken(audience, now.Add(vapid.DefaultTokenExpiry), c.subject, c.signer)
 	}
 
-	return nil
+	return c.tokens.Token(audience, c.subject, c.signer, now)
 }
@@ -0,0 +1,107 @@
+package webpush
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientPushTTL(t *testing.T) {
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	client, err := NewClient("mailto:push@example.com", signer, nil)
+	require.NoError(t, err)
+
+	userAgentKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	target := &PushTarget{
+		Endpoint:             server.URL,
+		UserAgentPublicKey:   userAgentKey.PublicKey(),
+		AuthenticationSecret: make([]byte, 16),
+	}
+
+	testCases := []struct {
+		Name     string
+		Options  *PushOptions
+		Expected []string
+	}{
+		{
+			Name:     "ttl",
+			Options:  &PushOptions{TTL: 60},
+			Expected: []string{"60"},
+		},
+		{
+			Name:     "zero ttl",
+			Options:  &PushOptions{TTL: 0},
+			Expected: []string{"0"},
+		},
+		{
+			Name:     "no options",
+			Options:  nil,
+			Expected: nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			res, err := client.Push(context.Background(), target, []byte("Hello, World!"), testCase.Options)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusCreated, res.StatusCode)
+			assert.Equal(t, testCase.Expected, header.Values("TTL"))
+		})
+	}
+}
+
+func TestClientPushCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	client, err := NewClient("mailto:push@example.com", signer, nil)
+	require.NoError(t, err)
+
+	userAgentKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	target := &PushTarget{
+		Endpoint:             server.URL,
+		UserAgentPublicKey:   userAgentKey.PublicKey(),
+		AuthenticationSecret: make([]byte, 16),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Pushes cancelled by the caller are not retried
+	_, err = client.Push(ctx, target, []byte("Hello, World!"), nil)
+	var transportErr *TransportError
+	require.ErrorAs(t, err, &transportErr)
+	assert.False(t, transportErr.Temporary())
+
+	// Pushes that fail to reach the push service are
+	server.Close()
+	_, err = client.Push(context.Background(), target, []byte("Hello, World!"), nil)
+	require.ErrorAs(t, err, &transportErr)
+	assert.True(t, transportErr.Temporary())
+}
@@ -5,7 +5,7 @@ type DeclerativePushMessage struct {
 	// WebPush MUST be set to 8030.
 	WebPush      int                         `json:"web_push"`
 	Notification DeclerativePushNotification `json:"notification"`
-	AppBadge     uint64                      `json:"app_badge,omitempty"`
+	AppBadge     *uint64                     `json:"app_badge,omitempty"`
 	Mutable      *bool                       `json:"mutable,omitempty"`
 }
 
@@ -14,7 +14,7 @@ type DeclerativePushNotification struct {
 	Title              string                              `json:"title"`
 	Navigate           string                              `json:"navigate"`
 	Language           string                              `json:"lang,omitempty"`
-	Direction          string                              `json:"ltr,omitempty"`
+	Direction          string                              `json:"dir,omitempty"`
 	Body               string                              `json:"body,omitempty"`
 	Tag                string                              `json:"tag,omitempty"`
 	Image              string                              `json:"image,omitempty"`
@@ -0,0 +1,378 @@
+package webpush
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrSubscriptionGone is matched by errors returned when the push service
+// reports that a subscription no longer exists, such as when it has expired or
+// the user has uninstalled the app. The subscription should not be used again.
+var ErrSubscriptionGone = errors.New("subscription gone")
+
+// Service identifies a known push service.
+type Service string
+
+const (
+	ServiceUnknown Service = ""
+	ServiceApple   Service = "apple"
+	ServiceFCM     Service = "fcm"
+	ServiceMozilla Service = "mozilla"
+)
+
+// ServiceFromEndpoint returns the push service hosting a subscription's
+// endpoint.
+func ServiceFromEndpoint(endpoint string) Service {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return ServiceUnknown
+	}
+
+	host := u.Hostname()
+	switch {
+	case host == "web.push.apple.com" || strings.HasSuffix(host, ".push.apple.com"):
+		return ServiceApple
+	case host == "fcm.googleapis.com" || host == "android.googleapis.com":
+		return ServiceFCM
+	case strings.HasSuffix(host, ".push.services.mozilla.com"):
+		return ServiceMozilla
+	default:
+		return ServiceUnknown
+	}
+}
+
+// Reason is a reason for a push service rejecting a push message, normalized
+// across push services.
+type Reason string
+
+const (
+	ReasonUnknown Reason = "Unknown"
+	// ReasonSubscriptionGone is used when the subscription has expired or has
+	// been removed by the user.
+	ReasonSubscriptionGone Reason = "SubscriptionGone"
+	// ReasonVapidKeyMismatch is used when the VAPID key used to sign the message
+	// is not the key the subscription was created with.
+	ReasonVapidKeyMismatch Reason = "VapidKeyMismatch"
+	// ReasonBadJWT is used when the VAPID JWT or Authorization header is
+	// invalid, such as when it has expired or has an invalid subject.
+	ReasonBadJWT          Reason = "BadJwt"
+	ReasonBadTopic        Reason = "BadTopic"
+	ReasonBadUrgency      Reason = "BadUrgency"
+	ReasonBadTTL          Reason = "BadTtl"
+	ReasonBadEncryption   Reason = "BadEncryption"
+	ReasonPayloadTooLarge Reason = "PayloadTooLarge"
+	ReasonTooManyRequests Reason = "TooManyRequests"
+	// ReasonServiceUnavailable is used when the push service failed to process
+	// the message due to an internal error or because it is unavailable.
+	ReasonServiceUnavailable Reason = "ServiceUnavailable"
+	ReasonBadRequest         Reason = "BadRequest"
+)
+
+// Category is a category of push errors, determining how a caller should
+// respond.
+type Category string
+
+const (
+	// CategoryTemporary errors may succeed if retried at a later time.
+	CategoryTemporary Category = "temporary"
+	// CategoryPermanent errors will not succeed if retried. The message or
+	// subscription is at fault.
+	CategoryPermanent Category = "permanent"
+	// CategoryConfiguration errors will not succeed until the application
+	// server's configuration is fixed.
+	CategoryConfiguration Category = "configuration"
+)
+
+type reasonDescription struct {
+	category Category
+	fix      string
+}
+
+var reasonDescriptions = map[Reason]reasonDescription{
+	ReasonUnknown: {
+		category: CategoryPermanent,
+	},
+	ReasonSubscriptionGone: {
+		category: CategoryPermanent,
+		fix:      "subscription expired or was removed, device must resubscribe",
+	},
+	ReasonVapidKeyMismatch: {
+		category: CategoryConfiguration,
+		fix:      "VAPID key rotated, device must resubscribe",
+	},
+	ReasonBadJWT: {
+		category: CategoryConfiguration,
+		fix:      "VAPID token was rejected: check the subject (mailto: or https:), the expiry (at most 24h) and the system clock",
+	},
+	ReasonBadTopic: {
+		category: CategoryConfiguration,
+		fix:      "BadWebPushTopic: topic header must be 32 URL-safe base64 characters",
+	},
+	ReasonBadUrgency: {
+		category: CategoryConfiguration,
+		fix:      "urgency header must be one of very-low, low, normal or high",
+	},
+	ReasonBadTTL: {
+		category: CategoryConfiguration,
+		fix:      "TTL header must be a non-negative number of seconds",
+	},
+	ReasonBadEncryption: {
+		category: CategoryPermanent,
+		fix:      "message could not be decrypted: subscription keys may be invalid, device must resubscribe",
+	},
+	ReasonPayloadTooLarge: {
+		category: CategoryPermanent,
+		fix:      "payload must not exceed 4096 bytes after encryption",
+	},
+	ReasonTooManyRequests: {
+		category: CategoryTemporary,
+		fix:      "rate limited by the push service, retry later",
+	},
+	ReasonServiceUnavailable: {
+		category: CategoryTemporary,
+		fix:      "push service is unavailable, retry later",
+	},
+	ReasonBadRequest: {
+		category: CategoryPermanent,
+	},
+}
+
+// PushError is returned when a push service rejects a push message.
+type PushError struct {
+	StatusCode int
+	Service    Service
+	Reason     Reason
+	// ServiceReason is the reason as reported by the push service, such as
+	// Apple's "VapidPkHashMismatch" or Mozilla's errno.
+	ServiceReason string
+	// Message is a human readable message reported by the push service, if
+	// any.
+	Message string
+	// RetryAfter is the duration the push service asked to wait before retrying,
+	// as specified by the Retry-After header. Zero if not specified.
+	RetryAfter time.Duration
+}
+
+func (e *PushError) Error() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "push service rejected message: %d %s", e.StatusCode, e.Reason)
+
+	if e.ServiceReason != "" {
+		fmt.Fprintf(&builder, " (%s)", e.ServiceReason)
+	}
+
+	if fix := e.Fix(); fix != "" {
+		fmt.Fprintf(&builder, ": %s", fix)
+	}
+
+	return builder.String()
+}
+
+// Is implements errors.Is. A push error matches [ErrSubscriptionGone] if the
+// push service reported that the subscription no longer exists.
+//
+// SEE: https://www.rfc-editor.org/rfc/rfc8030.html#section-7.3.
+func (e *PushError) Is(target error) bool {
+	return target == ErrSubscriptionGone && e.Reason == ReasonSubscriptionGone
+}
+
+// Category returns the category of the error.
+func (e *PushError) Category() Category {
+	description, ok := reasonDescriptions[e.Reason]
+	if !ok {
+		return CategoryPermanent
+	}
+
+	return description.category
+}
+
+// Temporary returns whether or not retrying the push message at a later time
+// may succeed.
+func (e *PushError) Temporary() bool {
+	return e.Category() == CategoryTemporary
+}
+
+// Fix returns a suggested fix for the error, if any.
+func (e *PushError) Fix() string {
+	return reasonDescriptions[e.Reason].fix
+}
+
+// TransportError is returned when a push message could not be sent to the push
+// service, such as when the network is unavailable.
+type TransportError struct {
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("failed to send push message: %v", e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary implements the same behavior as [PushError.Temporary]. Transport
+// errors are considered temporary, unless the push was cancelled by the
+// caller.
+func (e *TransportError) Temporary() bool {
+	return !errors.Is(e.Err, context.Canceled)
+}
+
+// appleResponse is the body of an error response from Apple's push service.
+//
+// SEE: https://developer.apple.com/documentation/usernotifications/sending-web-push-notifications-in-web-apps-and-browsers.
+type appleResponse struct {
+	Reason string `json:"reason"`
+}
+
+// mozillaResponse is the body of an error response from Mozilla's autopush.
+//
+// SEE: https://mozilla-services.github.io/autopush-rs/errors.html.
+type mozillaResponse struct {
+	Code     int    `json:"code"`
+	Errno    int    `json:"errno"`
+	Error    string `json:"error"`
+	Message  string `json:"message"`
+	MoreInfo string `json:"more_info"`
+}
+
+var appleReasons = map[string]Reason{
+	"BadDeviceToken":       ReasonSubscriptionGone,
+	"Unregistered":         ReasonSubscriptionGone,
+	"ExpiredToken":         ReasonSubscriptionGone,
+	"VapidPkHashMismatch":  ReasonVapidKeyMismatch,
+	"BadJwtToken":          ReasonBadJWT,
+	"ExpiredJwtToken":      ReasonBadJWT,
+	"InvalidProviderToken": ReasonBadJWT,
+	"MissingProviderToken": ReasonBadJWT,
+	"BadWebPushTopic":      ReasonBadTopic,
+	"BadPriority":          ReasonBadUrgency,
+	"BadExpirationDate":    ReasonBadTTL,
+	"PayloadTooLarge":      ReasonPayloadTooLarge,
+	"TooManyRequests":      ReasonTooManyRequests,
+	"InternalServerError":  ReasonServiceUnavailable,
+	"ServiceUnavailable":   ReasonServiceUnavailable,
+	"Shutdown":             ReasonServiceUnavailable,
+}
+
+var mozillaReasons = map[int]Reason{
+	102: ReasonSubscriptionGone,
+	103: ReasonSubscriptionGone,
+	104: ReasonPayloadTooLarge,
+	105: ReasonSubscriptionGone,
+	106: ReasonSubscriptionGone,
+	109: ReasonBadJWT,
+	110: ReasonBadEncryption,
+	112: ReasonBadTTL,
+	113: ReasonBadTopic,
+	201: ReasonTooManyRequests,
+	202: ReasonServiceUnavailable,
+}
+
+// fcmReasons maps substrings of FCM's plain text responses to reasons.
+var fcmReasons = []struct {
+	substring string
+	reason    Reason
+}{
+	{substring: "does not correspond to the sender ID", reason: ReasonVapidKeyMismatch},
+	{substring: "unsubscribed or expired", reason: ReasonSubscriptionGone},
+	{substring: "authorization header", reason: ReasonBadJWT},
+	{substring: "crypto-key", reason: ReasonBadEncryption},
+	{substring: "encryption", reason: ReasonBadEncryption},
+}
+
+// parsePushError parses a push service's error response.
+func parsePushError(endpoint string, statusCode int, header http.Header, body []byte, now time.Time) *PushError {
+	err := &PushError{
+		StatusCode: statusCode,
+		Service:    ServiceFromEndpoint(endpoint),
+		Reason:     reasonFromStatusCode(statusCode),
+		RetryAfter: parseRetryAfter(header.Get("Retry-After"), now),
+	}
+
+	var apple appleResponse
+	var mozilla mozillaResponse
+	switch {
+	case json.Unmarshal(body, &apple) == nil && apple.Reason != "":
+		err.ServiceReason = apple.Reason
+		if reason, ok := appleReasons[apple.Reason]; ok {
+			err.Reason = reason
+		}
+	case json.Unmarshal(body, &mozilla) == nil && mozilla.Errno != 0:
+		err.ServiceReason = strconv.Itoa(mozilla.Errno)
+		err.Message = mozilla.Message
+		if reason, ok := mozillaReasons[mozilla.Errno]; ok {
+			err.Reason = reason
+		}
+	case err.Service == ServiceFCM || err.Service == ServiceUnknown:
+		text := strings.TrimSpace(string(body))
+		// Don't include HTML error pages
+		if !strings.HasPrefix(text, "<") {
+			err.Message = text
+		}
+
+		lower := strings.ToLower(text)
+		for _, fcmReason := range fcmReasons {
+			if strings.Contains(lower, strings.ToLower(fcmReason.substring)) {
+				err.Reason = fcmReason.reason
+				break
+			}
+		}
+	}
+
+	return err
+}
+
+// reasonFromStatusCode returns the reason implied by a status code alone.
+//
+// SEE: https://www.rfc-editor.org/rfc/rfc8030.html#section-5.
+//
+// SEE: https://www.rfc-editor.org/rfc/rfc8292.html#section-4.
+func reasonFromStatusCode(statusCode int) Reason {
+	switch {
+	case statusCode == http.StatusNotFound || statusCode == http.StatusGone:
+		return ReasonSubscriptionGone
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ReasonBadJWT
+	case statusCode == http.StatusRequestEntityTooLarge:
+		return ReasonPayloadTooLarge
+	case statusCode == http.StatusTooManyRequests:
+		return ReasonTooManyRequests
+	case statusCode >= 500:
+		return ReasonServiceUnavailable
+	case statusCode == http.StatusBadRequest:
+		return ReasonBadRequest
+	default:
+		return ReasonUnknown
+	}
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or an HTTP date.
+//
+// SEE: https://www.rfc-editor.org/rfc/rfc9110.html#name-retry-after.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0)
+	}
+
+	return 0
+}
@@ -0,0 +1,168 @@
+package webpush
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushErrorIsSubscriptionGone(t *testing.T) {
+	testCases := []struct {
+		StatusCode int
+		Expected   bool
+	}{
+		{StatusCode: 400, Expected: false},
+		{StatusCode: 403, Expected: false},
+		{StatusCode: 404, Expected: true},
+		{StatusCode: 410, Expected: true},
+		{StatusCode: 429, Expected: false},
+		{StatusCode: 500, Expected: false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", testCase.StatusCode), func(t *testing.T) {
+			err := fmt.Errorf("wrapped: %w", parsePushError("https://push.example.com", testCase.StatusCode, http.Header{}, nil, time.Now()))
+			assert.Equal(t, testCase.Expected, errors.Is(err, ErrSubscriptionGone))
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		Name     string
+		Value    string
+		Expected time.Duration
+	}{
+		{Name: "empty", Value: "", Expected: 0},
+		{Name: "seconds", Value: "120", Expected: 2 * time.Minute},
+		{Name: "negative seconds", Value: "-1", Expected: 0},
+		{Name: "date", Value: "Sat, 01 Nov 2025 12:05:00 GMT", Expected: 5 * time.Minute},
+		{Name: "past date", Value: "Sat, 01 Nov 2025 11:00:00 GMT", Expected: 0},
+		{Name: "invalid", Value: "soon", Expected: 0},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			assert.Equal(t, testCase.Expected, parseRetryAfter(testCase.Value, now))
+		})
+	}
+}
+
+func TestParsePushError(t *testing.T) {
+	testCases := []struct {
+		Name                  string
+		Endpoint              string
+		StatusCode            int
+		Body                  string
+		ExpectedService       Service
+		ExpectedReason        Reason
+		ExpectedServiceReason string
+		ExpectedCategory      Category
+	}{
+		{
+			Name:                  "Apple VAPID key mismatch",
+			Endpoint:              "https://web.push.apple.com/QOd0jOwC7p0d",
+			StatusCode:            403,
+			Body:                  `{"reason":"VapidPkHashMismatch"}`,
+			ExpectedService:       ServiceApple,
+			ExpectedReason:        ReasonVapidKeyMismatch,
+			ExpectedServiceReason: "VapidPkHashMismatch",
+			ExpectedCategory:      CategoryConfiguration,
+		},
+		{
+			Name:                  "Apple bad topic",
+			Endpoint:              "https://web.push.apple.com/QOd0jOwC7p0d",
+			StatusCode:            400,
+			Body:                  `{"reason":"BadWebPushTopic"}`,
+			ExpectedService:       ServiceApple,
+			ExpectedReason:        ReasonBadTopic,
+			ExpectedServiceReason: "BadWebPushTopic",
+			ExpectedCategory:      CategoryConfiguration,
+		},
+		{
+			Name:                  "Apple unregistered",
+			Endpoint:              "https://web.push.apple.com/QOd0jOwC7p0d",
+			StatusCode:            410,
+			Body:                  `{"reason":"Unregistered"}`,
+			ExpectedService:       ServiceApple,
+			ExpectedReason:        ReasonSubscriptionGone,
+			ExpectedServiceReason: "Unregistered",
+			ExpectedCategory:      CategoryPermanent,
+		},
+		{
+			Name:                  "Apple too many requests",
+			Endpoint:              "https://web.push.apple.com/QOd0jOwC7p0d",
+			StatusCode:            429,
+			Body:                  `{"reason":"TooManyRequests"}`,
+			ExpectedService:       ServiceApple,
+			ExpectedReason:        ReasonTooManyRequests,
+			ExpectedServiceReason: "TooManyRequests",
+			ExpectedCategory:      CategoryTemporary,
+		},
+		{
+			Name:                  "Mozilla expired",
+			Endpoint:              "https://updates.push.services.mozilla.com/wpush/v2/gAAAAA",
+			StatusCode:            410,
+			Body:                  `{"code":410,"errno":103,"error":"Gone","message":"Request did not validate","more_info":"http://autopush.readthedocs.io/en/latest/http.html#error-codes"}`,
+			ExpectedService:       ServiceMozilla,
+			ExpectedReason:        ReasonSubscriptionGone,
+			ExpectedServiceReason: "103",
+			ExpectedCategory:      CategoryPermanent,
+		},
+		{
+			Name:                  "Mozilla invalid authentication",
+			Endpoint:              "https://updates.push.services.mozilla.com/wpush/v2/gAAAAA",
+			StatusCode:            401,
+			Body:                  `{"code":401,"errno":109,"error":"Unauthorized","message":"Request did not validate invalid token"}`,
+			ExpectedService:       ServiceMozilla,
+			ExpectedReason:        ReasonBadJWT,
+			ExpectedServiceReason: "109",
+			ExpectedCategory:      CategoryConfiguration,
+		},
+		{
+			Name:             "FCM sender mismatch",
+			Endpoint:         "https://fcm.googleapis.com/fcm/send/dGVzdA",
+			StatusCode:       403,
+			Body:             "the key in the authorization header does not correspond to the sender ID used to subscribe this user. Please ensure you are using the correct sender ID and server Key from the Firebase console.\n",
+			ExpectedService:  ServiceFCM,
+			ExpectedReason:   ReasonVapidKeyMismatch,
+			ExpectedCategory: CategoryConfiguration,
+		},
+		{
+			Name:             "FCM unsubscribed",
+			Endpoint:         "https://fcm.googleapis.com/fcm/send/dGVzdA",
+			StatusCode:       410,
+			Body:             "push subscription has unsubscribed or expired.\n",
+			ExpectedService:  ServiceFCM,
+			ExpectedReason:   ReasonSubscriptionGone,
+			ExpectedCategory: CategoryPermanent,
+		},
+		{
+			Name:             "Unknown service unavailable",
+			Endpoint:         "https://push.example.com/abc",
+			StatusCode:       503,
+			Body:             "<html>Service Unavailable</html>",
+			ExpectedService:  ServiceUnknown,
+			ExpectedReason:   ReasonServiceUnavailable,
+			ExpectedCategory: CategoryTemporary,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			err := parsePushError(testCase.Endpoint, testCase.StatusCode, http.Header{}, []byte(testCase.Body), time.Now())
+			assert.Equal(t, testCase.StatusCode, err.StatusCode)
+			assert.Equal(t, testCase.ExpectedService, err.Service)
+			assert.Equal(t, testCase.ExpectedReason, err.Reason)
+			assert.Equal(t, testCase.ExpectedServiceReason, err.ServiceReason)
+			assert.Equal(t, testCase.ExpectedCategory, err.Category())
+			assert.Equal(t, testCase.ExpectedCategory == CategoryTemporary, err.Temporary())
+		})
+	}
+}
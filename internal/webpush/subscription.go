@@ -3,6 +3,9 @@ package webpush
 import (
 	"crypto/ecdh"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
 	"time"
 )
 
@@ -12,7 +15,7 @@ import (
 // SEE: https://developer.mozilla.org/en-US/docs/Web/API/PushSubscription.
 type Subscription struct {
 	Endpoint       string           `json:"endpoint"`
-	ExpirationTime *time.Time       `json:"expirationTime,omitempty"`
+	ExpirationTime *Timestamp       `json:"expirationTime,omitempty"`
 	Keys           SubscriptionKeys `json:"keys"`
 }
 
@@ -36,6 +39,72 @@ func (s *Subscription) PushTarget() (*PushTarget, error) {
 	}, nil
 }
 
+// Validate returns an error if the subscription can't be pushed to. The
+// endpoint must be an absolute https URL, p256dh must be a point on the P-256
+// curve and auth must be 16 bytes.
+//
+// SEE: https://www.rfc-editor.org/rfc/rfc8291.html#section-3.2
+func (s *Subscription) Validate() error {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+		return fmt.Errorf("invalid endpoint %q - must be an absolute https URL", s.Endpoint)
+	}
+
+	if _, err := s.Keys.PublicKey(); err != nil {
+		return fmt.Errorf("invalid p256dh - must be a base64url encoded point on the P-256 curve: %w", err)
+	}
+
+	authenticationSecret, err := s.Keys.AuthenticationSecret()
+	if err != nil {
+		return fmt.Errorf("invalid auth - must be base64url encoded: %w", err)
+	}
+
+	if len(authenticationSecret) != 16 {
+		return fmt.Errorf("invalid auth - must be 16 bytes, got %d", len(authenticationSecret))
+	}
+
+	return nil
+}
+
+// Expired returns true if the subscription has expired at the specified time.
+func (s *Subscription) Expired(now time.Time) bool {
+	return s.ExpirationTime != nil && !now.Before(s.ExpirationTime.Time)
+}
+
+// ExpiresWithin returns true if the subscription expires within d of the
+// specified time, or has already expired.
+func (s *Subscription) ExpiresWithin(now time.Time, d time.Duration) bool {
+	return s.ExpirationTime != nil && !now.Add(d).Before(s.ExpirationTime.Time)
+}
+
+// Timestamp is a time which, in JSON, is either a number of milliseconds since
+// the Unix epoch, as used by the Push API, or an RFC 3339 string. It's encoded
+// as an RFC 3339 string.
+//
+// SEE: https://w3c.github.io/push-api/#dom-pushsubscriptionjson-expirationtime
+type Timestamp struct {
+	time.Time
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	if len(data) > 0 && data[0] == '"' {
+		return t.Time.UnmarshalJSON(data)
+	}
+
+	var milliseconds float64
+	if err := json.Unmarshal(data, &milliseconds); err != nil {
+		return fmt.Errorf("invalid timestamp: %w", err)
+	}
+
+	t.Time = time.UnixMilli(int64(milliseconds))
+	return nil
+}
+
 type SubscriptionKeys struct {
 	Auth   string `json:"auth"`
 	P256DH string `json:"p256dh"`
@@ -0,0 +1,114 @@
+package webpush
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscriptionExpirationTime(t *testing.T) {
+	expected := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		Name     string
+		JSON     string
+		Expected *time.Time
+	}{
+		{Name: "null", JSON: `{"endpoint":"https://push.example.com","expirationTime":null}`, Expected: nil},
+		{Name: "missing", JSON: `{"endpoint":"https://push.example.com"}`, Expected: nil},
+		{Name: "milliseconds", JSON: `{"endpoint":"https://push.example.com","expirationTime":1767225600000}`, Expected: &expected},
+		{Name: "RFC 3339", JSON: `{"endpoint":"https://push.example.com","expirationTime":"2026-01-01T00:00:00Z"}`, Expected: &expected},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var subscription Subscription
+			require.NoError(t, json.Unmarshal([]byte(testCase.JSON), &subscription))
+
+			if testCase.Expected == nil {
+				assert.Nil(t, subscription.ExpirationTime)
+			} else {
+				require.NotNil(t, subscription.ExpirationTime)
+				assert.True(t, testCase.Expected.Equal(subscription.ExpirationTime.Time))
+			}
+		})
+	}
+}
+
+func TestSubscriptionExpired(t *testing.T) {
+	now := time.Now()
+	subscription := Subscription{ExpirationTime: &Timestamp{Time: now.Add(time.Hour)}}
+
+	assert.False(t, subscription.Expired(now))
+	assert.True(t, subscription.Expired(now.Add(time.Hour)))
+	assert.False(t, subscription.ExpiresWithin(now, 30*time.Minute))
+	assert.True(t, subscription.ExpiresWithin(now, 2*time.Hour))
+
+	assert.False(t, (&Subscription{}).Expired(now))
+}
+
+func TestSubscriptionValidate(t *testing.T) {
+	privateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	publicKey := privateKey.PublicKey().Bytes()
+
+	// Flipping a bit of the y coordinate moves the point off the curve
+	offCurve := append([]byte(nil), publicKey...)
+	offCurve[len(offCurve)-1] ^= 1
+
+	p256dh := base64.RawURLEncoding.EncodeToString(publicKey)
+	auth := base64.RawURLEncoding.EncodeToString(make([]byte, 16))
+
+	testCases := []struct {
+		Name         string
+		Subscription Subscription
+		Valid        bool
+	}{
+		{
+			Name:         "valid",
+			Subscription: Subscription{Endpoint: "https://push.example.com/1", Keys: SubscriptionKeys{P256DH: p256dh, Auth: auth}},
+			Valid:        true,
+		},
+		{
+			Name:         "http endpoint",
+			Subscription: Subscription{Endpoint: "http://push.example.com/1", Keys: SubscriptionKeys{P256DH: p256dh, Auth: auth}},
+		},
+		{
+			Name:         "relative endpoint",
+			Subscription: Subscription{Endpoint: "/1", Keys: SubscriptionKeys{P256DH: p256dh, Auth: auth}},
+		},
+		{
+			Name:         "p256dh off curve",
+			Subscription: Subscription{Endpoint: "https://push.example.com/1", Keys: SubscriptionKeys{P256DH: base64.RawURLEncoding.EncodeToString(offCurve), Auth: auth}},
+		},
+		{
+			Name:         "compressed p256dh",
+			Subscription: Subscription{Endpoint: "https://push.example.com/1", Keys: SubscriptionKeys{P256DH: base64.RawURLEncoding.EncodeToString(publicKey[:33]), Auth: auth}},
+		},
+		{
+			Name:         "short auth",
+			Subscription: Subscription{Endpoint: "https://push.example.com/1", Keys: SubscriptionKeys{P256DH: p256dh, Auth: "AAAA"}},
+		},
+		{
+			Name:         "missing keys",
+			Subscription: Subscription{Endpoint: "https://push.example.com/1"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			err := testCase.Subscription.Validate()
+			if testCase.Valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
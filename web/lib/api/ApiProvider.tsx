@@ -36,6 +36,28 @@ async function deriveSubscriptionId(
     )
 }
 
+async function createSubscription(
+  client: ApiClient,
+  applicationServerKey: string = window.grapevine.applicationServerKey
+): Promise<[PushSubscription, string]> {
+  const subscription = await window.pushManager.subscribe({
+    // MUST be true for declerative web push
+    userVisibleOnly: true,
+    applicationServerKey,
+  })
+
+  const subscriptionId = await deriveSubscriptionId(subscription)
+
+  await client.subscribe(
+    window.grapevine.topic,
+    subscriptionId,
+    subscription.toJSON(),
+    applicationServerKey
+  )
+
+  return [subscription, subscriptionId]
+}
+
 export function useSubscription(): [
   string | undefined,
   () => Promise<void>,
@@ -47,6 +69,31 @@ export function useSubscription(): [
   const [subscriptionId, setSubscriptionId] = useState<string>()
   const [serverHasSubscription, setServerHasSubscription] = useState(false)
 
+  // Replace a subscription that is about to expire, or that was made with a
+  // rotated key, with a new one before notifications silently stop
+  const renew = useCallback(
+    async (
+      subscription: PushSubscription,
+      subscriptionId: string,
+      applicationServerKey?: string
+    ): Promise<[PushSubscription, string]> => {
+      // NOTE: The browser requires the subscription to be removed before
+      // subscribing using another key
+      await subscription.unsubscribe()
+      const renewed = await createSubscription(client, applicationServerKey)
+
+      try {
+        await client.unsubscribe(window.grapevine.topic, subscriptionId)
+      } catch (error) {
+        // The server removes expired subscriptions by itself
+        console.warn('Failed to remove renewed subscription', error)
+      }
+
+      return renewed
+    },
+    [client]
+  )
+
   // Get initial state of the local subscription
   useEffect(() => {
     window.pushManager
@@ -59,10 +106,26 @@ export function useSubscription(): [
               setSubscriptionId(subscriptionId)
 
               client
-                .subscriptionExists(window.grapevine.topic, subscriptionId)
-                .then(setServerHasSubscription)
+                .subscriptionStatus(window.grapevine.topic, subscriptionId)
+                .then((status) => {
+                  setServerHasSubscription(status !== undefined)
+                  if (status?.expiresSoon || status?.keyChanged) {
+                    renew(
+                      subscription,
+                      subscriptionId,
+                      status.applicationServerKey
+                    )
+                      .then(([subscription, subscriptionId]) => {
+                        setSubscription(subscription)
+                        setSubscriptionId(subscriptionId)
+                      })
+                      .catch((error) => {
+                        console.error('Failed to renew subscription', error)
+                      })
+                  }
+                })
                 .catch((error) => {
-                  console.error('Failed to check if subscription exists', error)
+                  console.error('Failed to check subscription status', error)
                 })
             })
             .catch((error) => {
@@ -73,25 +136,13 @@ export function useSubscription(): [
       .catch((error) => {
         console.error('Failed to identify existing subscription', error)
       })
-  }, [client])
+  }, [client, renew])
 
   // TODO: Error handling
   const subscribe = useCallback(async () => {
-    const subscription = await window.pushManager.subscribe({
-      // MUST be true for declerative web push
-      userVisibleOnly: true,
-      applicationServerKey: window.grapevine.applicationServerKey,
-    })
+    const [subscription, subscriptionId] = await createSubscription(client)
     setSubscription(subscription)
-
-    const subscriptionId = await deriveSubscriptionId(subscription)
     setSubscriptionId(subscriptionId)
-
-    await client.subscribe(
-      window.grapevine.topic,
-      subscriptionId,
-      subscription.toJSON()
-    )
     setServerHasSubscription(true)
   }, [client])
 
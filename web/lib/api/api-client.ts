@@ -1,4 +1,8 @@
-import { ApiError, type ApiClient as IApiClient } from './client'
+import {
+  ApiError,
+  type ApiClient as IApiClient,
+  type SubscriptionStatus,
+} from './client'
 
 export const DEFAULT_API_ENDPOINT = import.meta.env.VITE_API_ENDPOINT
 
@@ -12,7 +16,8 @@ export class ApiClient implements IApiClient {
   async subscribe(
     topic: string,
     id: string,
-    subscription: PushSubscriptionJSON
+    subscription: PushSubscriptionJSON,
+    applicationServerKey: string
   ): Promise<void> {
     const res = await fetch(
       `${this.#endpoint}/subscriptions/${encodeURIComponent(topic)}/${encodeURIComponent(id)}`,
@@ -21,7 +26,7 @@ export class ApiClient implements IApiClient {
         headers: {
           'content-type': 'application/json',
         },
-        body: JSON.stringify(subscription),
+        body: JSON.stringify({ ...subscription, applicationServerKey }),
       }
     )
 
@@ -57,4 +62,26 @@ export class ApiClient implements IApiClient {
 
     return res.status === 200
   }
+
+  async subscriptionStatus(
+    topic: string,
+    id: string
+  ): Promise<SubscriptionStatus | undefined> {
+    const res = await fetch(
+      `${this.#endpoint}/subscriptions/${encodeURIComponent(topic)}/${encodeURIComponent(id)}`,
+      {
+        method: 'get',
+      }
+    )
+
+    if (res.status === 404) {
+      return undefined
+    }
+
+    if (res.status !== 200) {
+      throw new ApiError('unexpected status code', res.status)
+    }
+
+    return (await res.json()) as SubscriptionStatus
+  }
 }
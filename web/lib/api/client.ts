@@ -7,14 +7,33 @@ export class ApiError extends Error {
   }
 }
 
+export type SubscriptionStatus = {
+  expirationTime?: string
+  // True if the subscription expires soon and should be renewed
+  expiresSoon: boolean
+  // True if the topic's key has been rotated and the subscription should be
+  // renewed using applicationServerKey
+  keyChanged: boolean
+  // The topic's current key, set if keyChanged
+  applicationServerKey?: string
+}
+
 export type ApiClient = {
+  // applicationServerKey is the key the subscription was made with
   subscribe(
     topic: string,
     id: string,
-    subscription: PushSubscriptionJSON
+    subscription: PushSubscriptionJSON,
+    applicationServerKey: string
   ): Promise<void>
 
   unsubscribe(topic: string, id: string): Promise<void>
 
   subscriptionExists(topic: string, id: string): Promise<boolean>
+
+  // Returns undefined if the subscription doesn't exist
+  subscriptionStatus(
+    topic: string,
+    id: string
+  ): Promise<SubscriptionStatus | undefined>
 }